@@ -0,0 +1,186 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Data of the components/sessionTable template, sessions are revoked with
+// DELETE RevokeURL/:id
+type SessionTable struct {
+	Sessions  []db.ActiveSession
+	Current   string
+	RevokeURL string
+}
+
+// Self-service routes acting on the account of the logged in user
+func RegisterAccountRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Get("/", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		return c.JSON(fiber.Map{
+			"username":               username,
+			"remainingRecoveryCodes": authSvc.RemainingRecoveryCodes(username),
+		})
+	})
+	router.Post("/recovery-codes", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		codes, err := authSvc.GenerateRecoveryCodes(username)
+		if err != nil {
+			log.Err(err).Msg("failed to regenerate recovery codes")
+			return c.SendStatus(500)
+		}
+		audit.Record(c, audit.Entry{
+			Action: "recovery_codes_regenerated",
+			Actor:  username,
+			Target: username,
+		})
+		return c.JSON(fiber.Map{"recoveryCodes": codes})
+	})
+	router.Get("/sessions", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		return c.JSON(fiber.Map{
+			"current":  db.CurrentSessionID(c),
+			"sessions": userDb.GetActiveSessions(username),
+		})
+	})
+	router.Delete("/sessions/:id", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		err = userDb.RevokeSession(username, c.Params("id"))
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		audit.Record(c, audit.Entry{
+			Action:  "session_revoked",
+			Actor:   username,
+			Target:  username,
+			Details: map[string]string{"session": c.Params("id")},
+		})
+		return nil
+	})
+	// Signs out every session of the user except the current one
+	router.Post("/sessions/revoke-others", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		count, err := userDb.RevokeSessions(username, db.CurrentSessionID(c))
+		if err != nil {
+			log.Err(err)
+			return c.SendStatus(500)
+		}
+		audit.Record(c, audit.Entry{
+			Action:  "sessions_revoked",
+			Actor:   username,
+			Target:  username,
+			Details: map[string]string{"count": strconv.FormatInt(count, 10)},
+		})
+		return c.JSON(fiber.Map{"revoked": count})
+	})
+	// Registers a passkey replacing the legacy U2F keys of the account
+	router.Get("/upgrade/begin", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		options, err := authSvc.BeginUpgrade(username, c.Hostname())
+		if err != nil {
+			log.Err(err).Msg("failed to begin credential upgrade")
+			switch {
+			case errors.Is(err, auth.ErrNoLegacyKeys):
+				return c.Status(409).SendString(err.Error())
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		return c.JSON(options)
+	})
+	router.Post("/upgrade/finish", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		body := new(protocol.CredentialCreationResponse)
+		if err := c.BodyParser(body); err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		response, err := body.Parse()
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		removed, err := authSvc.FinishUpgrade(*response, username)
+		recordAuthenticatorCeremony(c, "credential_upgrade", username,
+			response.Response.AttestationObject.AuthData.AttData.AAGUID, err)
+		if err != nil {
+			switch {
+			case errors.Is(err, auth.ErrNoLegacyKeys):
+				return c.Status(409).SendString(err.Error())
+			case errors.Is(err, auth.ErrAuthenticatorNotAllowed):
+				return c.Status(403).SendString(err.Error())
+			default:
+				return c.Status(400).SendString(err.Error())
+			}
+		}
+		return c.JSON(fiber.Map{"removed": removed})
+	})
+	router.Delete("/credentials/:id", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		id, err := base64.RawURLEncoding.DecodeString(c.Params("id"))
+		if err != nil {
+			return c.Status(400).SendString("invalid credential id")
+		}
+		user, err := userDb.GetUser(username)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		if len(user.Credentials) <= 1 {
+			return c.Status(409).SendString("can not remove the last passkey of the account")
+		}
+		err = userDb.DeleteCredential(*user, id)
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		log.Printf("removed passkey of user: %s", username)
+		audit.Record(c, audit.Entry{
+			Action:  "passkey_removed",
+			Actor:   username,
+			Target:  username,
+			Details: map[string]string{"credential": c.Params("id")},
+		})
+		return nil
+	})
+}
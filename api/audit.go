@@ -0,0 +1,94 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const auditPageSize = 100
+
+// Routes for querying, exporting and verifying the audit log
+func RegisterAuditRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewSuperAdminGuard(userDb))
+	router.Get("/", func(c *fiber.Ctx) error {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if filter.Limit <= 0 || filter.Limit > auditPageSize {
+			filter.Limit = auditPageSize
+		}
+		return c.JSON(audit.Events(filter))
+	})
+	router.Get("/export", func(c *fiber.Ctx) error {
+		filter, err := parseAuditFilter(c)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		c.Set(fiber.HeaderContentType, "application/x-ndjson")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="audit.jsonl"`)
+		return audit.Export(filter, func(b []byte) error {
+			_, err := c.Write(b)
+			return err
+		})
+	})
+	router.Get("/verify", func(c *fiber.Ctx) error {
+		count, err := audit.Verify()
+		if err != nil {
+			log.Err(err).Msg("audit log verification failed")
+			if !errors.Is(err, audit.ErrTampered) && !errors.Is(err, audit.ErrUnverifiable) {
+				return c.SendStatus(500)
+			}
+			return c.Status(409).JSON(fiber.Map{
+				"valid":  false,
+				"events": count,
+				"error":  err.Error(),
+			})
+		}
+		return c.JSON(fiber.Map{"valid": true, "events": count})
+	})
+}
+
+// Parses the audit filter from the query, from and to are RFC 3339 times
+func parseAuditFilter(c *fiber.Ctx) (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		Actor:   c.Query("actor"),
+		Target:  c.Query("target"),
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+		Limit:   c.QueryInt("limit"),
+		Offset:  c.QueryInt("offset"),
+	}
+	var err error
+	if from := c.Query("from"); len(from) > 0 {
+		filter.From, err = parseAuditTime(from)
+		if err != nil {
+			return filter, err
+		}
+	}
+	if to := c.Query("to"); len(to) > 0 {
+		filter.To, err = parseAuditTime(to)
+		if err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
+
+// Accepts both RFC 3339 times and the values of datetime-local inputs
+func parseAuditTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02T15:04", value, time.UTC)
+	if err != nil {
+		return t, errors.New("invalid time, expected RFC 3339")
+	}
+	return t, nil
+}
@@ -1,15 +1,23 @@
 package api
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 
 	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/aaguid"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
 	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/ratelimit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
 )
 
 var (
@@ -18,20 +26,39 @@ var (
 
 func RegisterAuthRoutes(r fiber.Router, userDb db.UserDb) {
 	log.Printf("Router uDb: %v", userDb)
-	auth, err := auth.InitAuth(userDb)
-	authSvc = auth
+	svc, err := auth.InitAuth(userDb)
+	authSvc = svc
 	if err != nil {
 		log.Fatal().Err(err)
 	}
+	limit := ratelimit.New()
+	lockout := ratelimit.NewLockoutGuard()
 
-	r.Get("/register/begin/:username", func(c *fiber.Ctx) error {
-		options, err := authSvc.BeginRegistration(c.Params("username"))
+	r.Get("/register/begin/:username", limit, func(c *fiber.Ctx) error {
+		username, err := db.QualifyUsername(c, c.Params("username"))
 		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		user, err := userDb.GetUser(username)
+		if err == nil && user.Status == db.Recovering {
+			recovering, err := db.GetRecoverySession(c)
+			if err != nil || recovering != username {
+				recordCeremony(c, "register_begin", username, auth.ErrRegistrationNotAllowed)
+				return c.Status(403).SendString(auth.ErrRegistrationNotAllowed.Error())
+			}
+		}
+		options, err := authSvc.BeginRegistration(username, c.Hostname())
+		if err != nil {
+			recordCeremony(c, "register_begin", username, err)
 			return err
 		}
 		return c.JSON(options)
 	})
-	r.Post("/verify-registration/:username", func(c *fiber.Ctx) error {
+	r.Post("/verify-registration/:username", limit, func(c *fiber.Ctx) error {
+		username, err := db.QualifyUsername(c, c.Params("username"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
 		body := new(protocol.CredentialCreationResponse)
 		if err := c.BodyParser(body); err != nil {
 			return err
@@ -40,26 +67,98 @@ func RegisterAuthRoutes(r fiber.Router, userDb db.UserDb) {
 		if err != nil {
 			return err
 		}
-		err = authSvc.FinishRegistration(*response, c.Params("username"))
+		err = authSvc.FinishRegistration(*response, username)
+		recordAuthenticatorCeremony(c, "register", username,
+			response.Response.AttestationObject.AuthData.AttData.AAGUID, err)
+		if errors.Is(err, auth.ErrAuthenticatorNotAllowed) {
+			return c.Status(403).SendString(err.Error())
+		}
 		if err != nil {
 			return err
 		}
-		_, err = db.GetLoginSession(c, c.Params("username"))
+		user, err := userDb.GetUser(username)
+		if err == nil {
+			webhooks.Emit(webhooks.UserRegistered, user.Username, webhooks.NewUser(*user))
+		}
+		authData := response.Response.AttestationObject.AuthData
+		err = db.GetLoginSession(c, username, webauthn.Credential{
+			ID:    authData.AttData.CredentialID,
+			Flags: webauthn.CredentialFlags{UserVerified: authData.Flags.HasUserVerified()},
+		}, c.QueryBool("remember"))
 		if err != nil {
 			log.Err(err)
 		}
 
-		return c.JSON("Registration Success")
+		// Recovery codes are only shown once, new codes are generated
+		// when the user has none left
+		var codes []string
+		if authSvc.RemainingRecoveryCodes(username) == 0 {
+			codes, err = authSvc.GenerateRecoveryCodes(username)
+			if err != nil {
+				log.Err(err).Msg("failed to generate recovery codes")
+			}
+		}
+
+		return c.JSON(fiber.Map{
+			"status":        "Registration Success",
+			"recoveryCodes": codes,
+		})
 	})
-	r.Get("/generate-authentication-options/:username", func(c *fiber.Ctx) error {
-		resp, err := authSvc.BeginLogin(c.Params("username"))
+	r.Post("/recover/:username", limit, lockout, func(c *fiber.Ctx) error {
+		username, err := db.QualifyUsername(c, c.Params("username"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		defer auth.UniformLatency(time.Now())
+		method, err := authSvc.RecoverAccount(username, c.FormValue("code"))
+		if err != nil {
+			log.Err(err).Msg("account recovery failed")
+			recordCeremony(c, "account_recovery", username, err)
+			ratelimit.Failure(c, username)
+			if auth.EnumerationProtection() {
+				err = auth.ErrAuthenticationFailed
+			}
+			return c.Status(401).SendString(err.Error())
+		}
+		ratelimit.Success(username)
+		audit.Record(c, audit.Entry{
+			Action:  "account_recovery",
+			Actor:   username,
+			Target:  username,
+			Details: map[string]string{"method": method},
+		})
+		err = db.SetRecoverySession(c, username)
+		if err != nil {
+			return err
+		}
+		return c.SendStatus(204)
+	})
+	r.Get("/generate-authentication-options/:username", limit, lockout, func(c *fiber.Ctx) error {
+		largeBlob, err := auth.ParseLargeBlobOperation(c.Query("largeBlob"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		username, err := db.QualifyUsername(c, c.Params("username"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		defer auth.UniformLatency(time.Now())
+		resp, err := authSvc.BeginLogin(username, largeBlob)
 		if err != nil {
 			log.Err(err)
+			recordCeremony(c, "login_begin", username, err)
+			if auth.EnumerationProtection() {
+				return c.Status(401).SendString(auth.ErrAuthenticationFailed.Error())
+			}
 			return err
 		}
 		return c.JSON(resp)
 	})
-	r.Post("/verify-authentication/:username", func(c *fiber.Ctx) error {
+	r.Post("/verify-authentication/:username", limit, lockout, func(c *fiber.Ctx) error {
+		username, err := db.QualifyUsername(c, c.Params("username"))
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
 		body := new(protocol.CredentialAssertionResponse)
 		if err := c.BodyParser(body); err != nil {
 			log.Err(err)
@@ -70,20 +169,40 @@ func RegisterAuthRoutes(r fiber.Router, userDb db.UserDb) {
 			log.Err(err)
 			return err
 		}
-		err = authSvc.FinishLogin(c.Params("username"), *response)
+		defer auth.UniformLatency(time.Now())
+		credential, err := authSvc.FinishLogin(username, *response)
+		if credential != nil {
+			recordAuthenticatorCeremony(c, "login", username, credential.Authenticator.AAGUID, err)
+		} else {
+			recordCeremony(c, "login", username, err)
+		}
+		// The user proved possession of the credential, so the reason can
+		// be told without revealing anything about the username
+		if errors.Is(err, auth.ErrAuthenticatorNotAllowed) {
+			return c.Status(403).SendString(err.Error())
+		}
 		if err != nil {
+			ratelimit.Failure(c, username)
+			if auth.EnumerationProtection() {
+				return c.Status(401).SendString(auth.ErrAuthenticationFailed.Error())
+			}
 			return err
 		}
+		ratelimit.Success(username)
 
-		_, err = db.GetLoginSession(c, c.Params("username"))
+		err = db.GetLoginSession(c, username, *credential, c.QueryBool("remember"))
 		if err != nil {
 			return err
 		}
+		// Legacy U2F keys are replaced by a passkey on the account page
+		if credential.AttestationType == protocol.CredentialTypeFIDOU2F {
+			return c.JSON(fiber.Map{"upgrade": "/account"})
+		}
 
 		return nil
 	})
 	r.Get("/status", func(c *fiber.Ctx) error {
-		s := c.Request().Header.Cookie("session_id")
+		s := c.Request().Header.Cookie(db.SessionCookie)
 		if len(s) == 0 {
 			return c.SendStatus(204)
 		}
@@ -93,10 +212,12 @@ func RegisterAuthRoutes(r fiber.Router, userDb db.UserDb) {
 			return c.SendStatus(204)
 		}
 
-		return c.SendString(fmt.Sprint(username))
+		return c.SendString(fmt.Sprint(db.LocalUsername(username)))
 	})
 	r.Get("/logout", func(c *fiber.Ctx) error {
+		username, _ := db.ValidateLoginSession(c)
 		err := db.DeleteLoginSession(c)
+		recordCeremony(c, "logout", username, err)
 		if err != nil {
 			return err
 		}
@@ -106,27 +227,54 @@ func RegisterAuthRoutes(r fiber.Router, userDb db.UserDb) {
 
 }
 
+// Records the outcome of an authentication ceremony of the user
+func recordCeremony(c *fiber.Ctx, action string, username string, err error) {
+	audit.Record(c, ceremonyEntry(action, username, err))
+}
+
+// Records the outcome of a ceremony along with the name of the
+// authenticator model, when the aaguid catalogue knows it
+func recordAuthenticatorCeremony(c *fiber.Ctx, action string, username string, model []byte, err error) {
+	entry := ceremonyEntry(action, username, err)
+	if name := aaguid.Name(model); name != "" {
+		if entry.Details == nil {
+			entry.Details = map[string]string{}
+		}
+		entry.Details["authenticator"] = name
+	}
+	audit.Record(c, entry)
+}
+
+func ceremonyEntry(action string, username string, err error) audit.Entry {
+	entry := audit.Entry{Action: action, Actor: username, Target: username}
+	if err != nil {
+		entry.Outcome = audit.OutcomeFailure
+		entry.Details = map[string]string{"error": err.Error()}
+	}
+	return entry
+}
+
 func CheckLoginStatus(c *fiber.Ctx) (string, error) {
-	s := c.Request().Header.Cookie("session_id")
-	if len(s) == 0 {
+	s := c.Request().Header.Cookie(db.SessionCookie)
+	if len(s) == 0 && c.Locals(db.AccessTokenLocal) == nil {
 		return "", errors.New("Session Cookie was not present")
 	}
 
-	username, err := db.ValidateLoginSession(c)
+	user, err := db.GetLoginUser(c)
 	if err != nil {
 		log.Err(err)
 		return "", err
 	}
-	return username, nil
+	return user.Username, nil
 }
 
 func NewLoginRedirect() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		s := c.Request().Header.Cookie("session_id")
-		if len(s) == 0 {
+		s := c.Request().Header.Cookie(db.SessionCookie)
+		if len(s) == 0 && c.Locals(db.AccessTokenLocal) == nil {
 			return c.Redirect("/login", 302)
 		}
-		_, err := db.ValidateLoginSession(c)
+		_, err := db.GetLoginUser(c)
 		if err != nil {
 			log.Printf("failed to validate login: %v", err)
 			return c.Redirect("/login", 302)
@@ -134,3 +282,64 @@ func NewLoginRedirect() fiber.Handler {
 		return c.Next()
 	}
 }
+
+// Returns a handler rejecting users that are not logged in with one of
+// the input roles
+func NewRoleGuard(userDb db.UserDb, roles ...db.Role) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, err := db.GetLoginUser(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		for _, role := range roles {
+			if user.Role == role {
+				return c.Next()
+			}
+		}
+		audit.Record(c, audit.Entry{
+			Action:  "access_denied",
+			Actor:   user.Username,
+			Outcome: audit.OutcomeDenied,
+			Details: map[string]string{"method": c.Method(), "path": c.Path()},
+		})
+		return c.SendStatus(403)
+	}
+}
+
+// Returns a handler requiring that the session performed a WebAuthn
+// assertion within AUTH_STEP_UP_MAX_AGE. Stale sessions get a 401 with a stepUpRequired
+// HX-Trigger event, which makes the UI re-authenticate and retry the request.
+// Access tokens cannot perform an assertion, so the routes behind it are
+// only available to sessions.
+func NewStepUpGuard() fiber.Handler {
+	maxAge := viper.GetDuration("AUTH_STEP_UP_MAX_AGE")
+	return func(c *fiber.Ctx) error {
+		if token, ok := c.Locals(db.AccessTokenLocal).(*db.AccessToken); ok {
+			audit.Record(c, audit.Entry{
+				Action:  "access_denied",
+				Actor:   token.Username,
+				Outcome: audit.OutcomeDenied,
+				Details: map[string]string{"method": c.Method(), "path": c.Path(), "token": token.ID},
+			})
+			return c.Status(403).SendString("requires a login with a passkey, access tokens are not accepted")
+		}
+		authTime, assurance, err := db.GetAuthenticated(c)
+		if err == nil && time.Since(authTime) <= maxAge {
+			return c.Next()
+		}
+
+		log.Info().Str("path", c.Path()).Str("assurance", assurance).
+			Time("authTime", authTime).Msg("step-up authentication required")
+		trigger, err := json.Marshal(fiber.Map{
+			"stepUpRequired": fiber.Map{
+				"method": c.Method(),
+				"path":   c.OriginalURL(),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		c.Set("HX-Trigger", string(trigger))
+		return c.Status(401).SendString("re-authentication required")
+	}
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Routes for approving admin actions with a WebAuthn assertion whose
+// challenge is derived from the action
+func RegisterConfirmationRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Post("/", func(c *fiber.Ctx) error {
+		actor, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		op := auth.Operation{
+			Action:  c.FormValue("action"),
+			Target:  c.FormValue("target"),
+			Details: c.FormValue("details"),
+			Actor:   actor,
+		}
+		if len(op.Action) == 0 {
+			return c.Status(400).SendString("no action")
+		}
+		id, canonical, options, err := authSvc.BeginConfirmation(op)
+		if err != nil {
+			log.Err(err).Msg("failed to begin confirmation")
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"id":        id,
+			"canonical": canonical,
+			"publicKey": options.Response,
+		})
+	})
+	router.Post("/:id", func(c *fiber.Ctx) error {
+		actor, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		body := new(protocol.CredentialAssertionResponse)
+		if err := c.BodyParser(body); err != nil {
+			log.Err(err)
+			return err
+		}
+		response, err := body.Parse()
+		if err != nil {
+			log.Err(err)
+			return err
+		}
+		credential, err := authSvc.FinishConfirmation(actor, c.Params("id"), *response)
+		recordCeremony(c, "confirmation_signed", actor, err)
+		if err != nil {
+			if errors.Is(err, db.ErrNoResults) {
+				return c.SendStatus(404)
+			}
+			return c.Status(400).SendString(err.Error())
+		}
+		// The confirmation is a fresh assertion, so it also satisfies step-up
+		err = db.SetAuthenticated(c, credential.Flags)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.SendStatus(204)
+	})
+	router.Get("/:id", NewRoleGuard(userDb, db.Admin), func(c *fiber.Ctx) error {
+		confirmation, err := authSvc.VerifyConfirmation(c.Params("id"))
+		// Admins only see the confirmations of their own tenant
+		if confirmation == nil || db.TenantOf(confirmation.Actor) != db.RequestTenant(c) {
+			return c.SendStatus(404)
+		}
+		result := fiber.Map{
+			"id":          confirmation.ID,
+			"actor":       confirmation.Actor,
+			"action":      confirmation.Action,
+			"target":      confirmation.Target,
+			"details":     confirmation.Details,
+			"canonical":   confirmation.Canonical,
+			"confirmedAt": confirmation.ConfirmedAt,
+			"usedAt":      confirmation.UsedAt,
+			"valid":       err == nil,
+		}
+		if err != nil {
+			result["error"] = err.Error()
+		}
+		return c.JSON(result)
+	})
+}
+
+func confirmationRequired(action string) bool {
+	for _, a := range strings.Split(viper.GetString("AUTH_CONFIRM_ACTIONS"), ",") {
+		if strings.TrimSpace(a) == action {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a handler requiring a signed confirmation of the action when it
+// is listed in AUTH_CONFIRM_ACTIONS. The id of the confirmation is read from
+// the X-Confirmation header, describe returns the target and details of the
+// operation from the request.
+func NewConfirmationGuard(action string, describe func(*fiber.Ctx) (string, string)) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if !confirmationRequired(action) {
+			return c.Next()
+		}
+		actor, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		target, details := describe(c)
+		op := auth.Operation{Action: action, Target: target, Details: details, Actor: actor}
+
+		id := c.Get("X-Confirmation")
+		if len(id) == 0 {
+			return requireConfirmation(c, op)
+		}
+		err = authSvc.ConsumeConfirmation(id, op)
+		if err != nil {
+			log.Warn().Err(err).Str("confirmation", id).Msg("rejected confirmation")
+			return requireConfirmation(c, op)
+		}
+		c.Locals("confirmation", id)
+		return c.Next()
+	}
+}
+
+// Responds with a confirmationRequired HX-Trigger event, which makes the UI
+// sign the operation and retry the request with the confirmation id
+func requireConfirmation(c *fiber.Ctx, op auth.Operation) error {
+	trigger, err := json.Marshal(fiber.Map{
+		"confirmationRequired": fiber.Map{
+			"method":  c.Method(),
+			"path":    c.OriginalURL(),
+			"action":  op.Action,
+			"target":  op.Target,
+			"details": op.Details,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	c.Set("HX-Trigger", string(trigger))
+	return c.Status(428).SendString("confirmation required")
+}
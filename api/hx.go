@@ -3,9 +3,15 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/url"
+	"time"
 
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
 	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/mds"
+	"github.com/a19simma/go-webauthn-htmx/pkg/middleware"
+	"github.com/a19simma/go-webauthn-htmx/pkg/policy"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
 )
@@ -29,7 +35,7 @@ func RegisterHXRoutes(hx fiber.Router) {
 	hx.Get("/login", func(c *fiber.Ctx) error {
 		username, err := CheckLoginStatus(c)
 		if err != nil {
-			return c.Render("login", struct{ Status bool }{Status: false})
+			return c.Render("login", fiber.Map{"Status": false})
 		}
 		c.Response().Header.Set("HX-Redirect", "/")
 		return c.Render("components/loginCard",
@@ -41,6 +47,105 @@ func RegisterHXRoutes(hx fiber.Router) {
 				Username: username,
 			})
 	})
+	hx.Get("/recover", func(c *fiber.Ctx) error {
+		return c.Render("components/recoveryCard", nil)
+	})
+	hx.Post("/account/recovery-codes", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/account/recovery-codes", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+
+		var codes struct {
+			RecoveryCodes []string `json:"recoveryCodes"`
+		}
+		err := json.Unmarshal(body, &codes)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/recoveryCodes", codes)
+	})
+	hx.Post("/account/sessions/revoke-others", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/account/sessions/revoke-others", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+
+		url = fmt.Sprintf("%s/api/account/sessions", c.BaseURL())
+		agent = fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var sessions struct {
+			Current  string             `json:"current"`
+			Sessions []db.ActiveSession `json:"sessions"`
+		}
+		err := json.Unmarshal(body, &sessions)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/sessionTable", SessionTable{
+			Sessions:  sessions.Sessions,
+			Current:   sessions.Current,
+			RevokeURL: "/api/account/sessions",
+		})
+	})
+	hx.Get("/users/:username/sessions", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/users/%s/sessions", c.BaseURL(), c.Params("username"))
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		table := SessionTable{
+			RevokeURL: fmt.Sprintf("/api/users/%s/sessions", c.Params("username")),
+		}
+		err := json.Unmarshal(body, &table.Sessions)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/userSessions", struct {
+			Username string
+			Table    SessionTable
+		}{c.Params("username"), table})
+	})
+	hx.Delete("/users/:username/sessions", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/users/%s/sessions", c.BaseURL(), c.Params("username"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		return c.Render("components/userSessions", struct {
+			Username string
+			Table    SessionTable
+		}{c.Params("username"), SessionTable{}})
+	})
 	hx.Delete("/users/:id", func(c *fiber.Ctx) error {
 		url := fmt.Sprintf("/api/users/%s", c.Params("id"))
 		agent := fiber.Delete(url)
@@ -58,7 +163,7 @@ func RegisterHXRoutes(hx fiber.Router) {
 		url := fmt.Sprintf("%s/api/users/%s/block", c.BaseURL(), c.Params("username"))
 		log.Print(url)
 		agent := fiber.Post(url)
-		agent.Cookie("session_id", c.Cookies("session_id"))
+		forwardCredentials(c, agent)
 		status, body, errs := agent.Bytes()
 		log.Print(status, body, errs)
 		if len(errs) > 0 {
@@ -89,7 +194,7 @@ func RegisterHXRoutes(hx fiber.Router) {
 	hx.Post("/users/:username/unblock", func(c *fiber.Ctx) error {
 		url := fmt.Sprintf("%s/api/users/%s/unblock", c.BaseURL(), c.Params("username"))
 		agent := fiber.Post(url)
-		agent.Cookie("session_id", c.Cookies("session_id"))
+		forwardCredentials(c, agent)
 		status, body, errs := agent.Bytes()
 		log.Print(status)
 		if len(errs) > 0 {
@@ -117,10 +222,501 @@ func RegisterHXRoutes(hx fiber.Router) {
 				Role:     user.Role,
 			})
 	})
+	hx.Post("/users/:username/role", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/users/%s/role", c.BaseURL(), c.Params("username"))
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		agent.Set("X-Confirmation", c.Get("X-Confirmation"))
+		args := fiber.AcquireArgs()
+		args.Set("role", c.FormValue("role"))
+		agent.Form(args)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status == 428 {
+			target, details := describeRoleOperation(c)
+			return requireConfirmation(c, auth.Operation{
+				Action: "change-role", Target: target, Details: details,
+			})
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var user db.User
+		err := json.Unmarshal(body, &user)
+		if err != nil {
+			log.Err(err)
+		}
+
+		return c.Render("components/userTableRow",
+			struct {
+				ID       string
+				Status   db.RegistrationStatus
+				Username string
+				Role     db.Role
+			}{
+				ID:       string(user.ID),
+				Status:   user.Status,
+				Username: user.Username,
+				Role:     user.Role,
+			})
+	})
+	hx.Get("/users/:username/access-pass", func(c *fiber.Ctx) error {
+		return c.Render("components/accessPassForm", struct{ Username string }{
+			Username: c.Params("username"),
+		})
+	})
+	hx.Post("/users/:username/access-pass", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/users/%s/access-pass", c.BaseURL(), c.Params("username"))
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		args := fiber.AcquireArgs()
+		args.Set("ttl", c.FormValue("ttl"))
+		args.Set("singleUse", c.FormValue("singleUse"))
+		args.Set("revoke", c.FormValue("revoke"))
+		agent.Form(args)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+
+		pass := struct {
+			Username string
+			Code     string    `json:"code"`
+			Expires  time.Time `json:"expires"`
+			Error    string
+		}{Username: c.Params("username")}
+		if status > 299 {
+			pass.Error = string(body)
+			if len(pass.Error) == 0 {
+				pass.Error = fmt.Sprintf("Failed to issue access pass (%d)", status)
+			}
+			return c.Render("components/accessPass", pass)
+		}
+		err := json.Unmarshal(body, &pass)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/accessPass", pass)
+	})
+	hx.Get("/audit", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/audit?%s", c.BaseURL(), c.Request().URI().QueryString())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.Status(status).SendString(string(body))
+		}
+		var events []db.AuditEvent
+		err := json.Unmarshal(body, &events)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/auditRows", events)
+	})
+	hx.Get("/audit/verify", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/audit/verify", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		result := struct {
+			Valid  bool   `json:"valid"`
+			Events int    `json:"events"`
+			Error  string `json:"error"`
+		}{}
+		err := json.Unmarshal(body, &result)
+		if err != nil {
+			log.Err(err)
+			result.Error = fmt.Sprintf("Failed to verify the audit log (%d)", status)
+		}
+		return c.Render("components/auditVerify", result)
+	})
+	hx.Get("/tenants", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tenants", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var tenants []db.Tenant
+		err := json.Unmarshal(body, &tenants)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/tenantList", tenants)
+	})
+	hx.Post("/tenants", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tenants", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		args := fiber.AcquireArgs()
+		for _, key := range []string{"id", "name", "rpId", "origins", "logo", "theme", "adminEmail", "emailDomain",
+			"senderName", "senderEmail", "smtpHost", "smtpPort", "smtpUsername", "smtpPassword"} {
+			args.Set(key, c.FormValue(key))
+		}
+		agent.Form(args)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return errorToast(c, fmt.Sprintf("Failed to create tenant: %s", body))
+		}
+		c.Set("HX-Trigger", "tenantsChanged")
+		return c.SendStatus(200)
+	})
+	hx.Post("/tenants/:id/:action<regex(^(suspend|resume)$)>", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tenants/%s/%s", c.BaseURL(), c.Params("id"), c.Params("action"))
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		c.Set("HX-Trigger", "tenantsChanged")
+		return c.SendStatus(200)
+	})
+	hx.Post("/tenants/:id/scim-token", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tenants/%s/scim-token", c.BaseURL(), c.Params("id"))
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		created := struct {
+			Tenant db.Tenant `json:"tenant"`
+			Token  string    `json:"token"`
+			Error  string
+		}{}
+		if status > 299 {
+			created.Error = fmt.Sprintf("Failed to issue the SCIM token (%d)", status)
+			return c.Render("components/scimTokenCreated", created)
+		}
+		err := json.Unmarshal(body, &created)
+		if err != nil {
+			log.Err(err)
+		}
+		c.Set("HX-Trigger", "tenantsChanged")
+		return c.Render("components/scimTokenCreated", created)
+	})
+	hx.Delete("/tenants/:id/scim-token", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tenants/%s/scim-token", c.BaseURL(), c.Params("id"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return errorToast(c, fmt.Sprintf("Failed to disable SCIM (%d)", status))
+		}
+		c.Set("HX-Trigger", "tenantsChanged")
+		return c.SendStatus(200)
+	})
+	hx.Get("/tokens", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var tokens []db.AccessToken
+		err := json.Unmarshal(body, &tokens)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/tokenList", tokens)
+	})
+	hx.Post("/tokens", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens", c.BaseURL())
+		return proxyTokenCreation(c, url, "tokensChanged")
+	})
+	hx.Delete("/tokens/:id", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens/%s", c.BaseURL(), c.Params("id"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		return c.SendStatus(200)
+	})
+	hx.Get("/service-accounts", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens/service-accounts", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var accounts []ServiceAccount
+		err := json.Unmarshal(body, &accounts)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/serviceAccountList", accounts)
+	})
+	hx.Post("/service-accounts", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens/service-accounts", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		args := fiber.AcquireArgs()
+		args.Set("name", c.FormValue("name"))
+		args.Set("role", c.FormValue("role"))
+		agent.Form(args)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return errorToast(c, fmt.Sprintf("Failed to add service account: %s", body))
+		}
+		c.Set("HX-Trigger", "serviceAccountsChanged")
+		return c.SendStatus(200)
+	})
+	hx.Post("/service-accounts/tokens", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens/service-accounts/%s/tokens", c.BaseURL(),
+			url.PathEscape(c.FormValue("account")))
+		return proxyTokenCreation(c, url, "serviceAccountsChanged")
+	})
+	hx.Delete("/service-accounts/:username", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/tokens/service-accounts/%s", c.BaseURL(), c.Params("username"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		c.Set("HX-Trigger", "serviceAccountsChanged")
+		return c.SendStatus(200)
+	})
+	hx.Get("/webhooks", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/webhooks", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var hooks []db.Webhook
+		err := json.Unmarshal(body, &hooks)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/webhookList", hooks)
+	})
+	hx.Post("/webhooks", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/webhooks", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		args := fiber.AcquireArgs()
+		args.Set("url", c.FormValue("url"))
+		args.Set("secret", c.FormValue("secret"))
+		for _, event := range c.Request().PostArgs().PeekMulti("events") {
+			args.Add("events", string(event))
+		}
+		agent.Form(args)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		created := struct {
+			Webhook db.Webhook `json:"webhook"`
+			Secret  string     `json:"secret"`
+			Error   string
+		}{}
+		if status > 299 {
+			created.Error = string(body)
+			return c.Render("components/webhookCreated", created)
+		}
+		err := json.Unmarshal(body, &created)
+		if err != nil {
+			log.Err(err)
+		}
+		c.Set("HX-Trigger", "webhooksChanged")
+		return c.Render("components/webhookCreated", created)
+	})
+	hx.Delete("/webhooks/:id", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/webhooks/%s", c.BaseURL(), c.Params("id"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		return c.SendStatus(200)
+	})
+	hx.Get("/webhooks/:id/deliveries", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/webhooks/%s/deliveries", c.BaseURL(), c.Params("id"))
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var deliveries []db.WebhookDelivery
+		err := json.Unmarshal(body, &deliveries)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/webhookDeliveries", deliveries)
+	})
+	hx.Post("/webhooks/deliveries/:id/redeliver", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/webhooks/deliveries/%s/redeliver", c.BaseURL(), c.Params("id"))
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var delivery db.WebhookDelivery
+		err := json.Unmarshal(body, &delivery)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/webhookDelivery", delivery)
+	})
+	hx.Get("/lockouts", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/lockouts", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var lockouts []db.Lockout
+		err := json.Unmarshal(body, &lockouts)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/lockoutList", lockouts)
+	})
+	hx.Delete("/lockouts/:identifier", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/lockouts/%s", c.BaseURL(), c.Params("identifier"))
+		agent := fiber.Delete(url)
+		forwardCredentials(c, agent)
+		status, _, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		return c.SendStatus(200)
+	})
+	hx.Get("/metadata", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/metadata", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 && status != 404 {
+			return c.SendStatus(status)
+		}
+		return renderMetadataStatus(c, status, body)
+	})
+	hx.Post("/metadata", func(c *fiber.Ctx) error {
+		file, err := c.FormFile("blob")
+		if err != nil {
+			return c.Render("components/metadataStatus", fiber.Map{"Error": "Choose a metadata blob to upload"})
+		}
+		f, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		url := fmt.Sprintf("%s/api/metadata", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		agent.ContentType("application/jwt")
+		agent.Body(data)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		return renderMetadataStatus(c, status, body)
+	})
+	hx.Post("/metadata/reload", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/metadata/reload", c.BaseURL())
+		agent := fiber.Post(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		return renderMetadataStatus(c, status, body)
+	})
+	hx.Get("/policy/violations", func(c *fiber.Ctx) error {
+		url := fmt.Sprintf("%s/api/policy/violations", c.BaseURL())
+		agent := fiber.Get(url)
+		forwardCredentials(c, agent)
+		status, body, errs := agent.Bytes()
+		if len(errs) > 0 {
+			log.Err(errs[0])
+		}
+		if status > 299 {
+			return c.SendStatus(status)
+		}
+		var violations []policy.Violation
+		err := json.Unmarshal(body, &violations)
+		if err != nil {
+			log.Err(err)
+		}
+		return c.Render("components/policyViolations", violations)
+	})
 	hx.Post("/users", func(c *fiber.Ctx) error {
 		url := fmt.Sprintf("%s/api/users", c.BaseURL())
 		agent := fiber.Post(url)
-		agent.Cookie("session_id", c.Cookies("session_id"))
+		forwardCredentials(c, agent)
 		args := fiber.AcquireArgs()
 		args.Set("username", c.FormValue("username"))
 		agent.Form(args)
@@ -150,3 +746,72 @@ func RegisterHXRoutes(hx fiber.Router) {
 			})
 	})
 }
+
+// Renders the metadata blob returned by the api, or the error message of
+// a failed request
+func renderMetadataStatus(c *fiber.Ctx, status int, body []byte) error {
+	if status == 404 {
+		return c.Render("components/metadataStatus", fiber.Map{})
+	}
+	if status > 299 {
+		return c.Render("components/metadataStatus", fiber.Map{"Error": string(body)})
+	}
+	var blob mds.BLOB
+	err := json.Unmarshal(body, &blob)
+	if err != nil {
+		log.Err(err)
+	}
+	return c.Render("components/metadataStatus", fiber.Map{"Blob": blob})
+}
+
+// Posts the name, lifetime and scopes of a new access token to the api
+// and shows the created token, triggering event on success
+func proxyTokenCreation(c *fiber.Ctx, url string, event string) error {
+	agent := fiber.Post(url)
+	forwardCredentials(c, agent)
+	args := fiber.AcquireArgs()
+	args.Set("name", c.FormValue("name"))
+	args.Set("ttl", c.FormValue("ttl"))
+	for _, scope := range c.Request().PostArgs().PeekMulti("scopes") {
+		args.Add("scopes", string(scope))
+	}
+	agent.Form(args)
+	status, body, errs := agent.Bytes()
+	if len(errs) > 0 {
+		log.Err(errs[0])
+	}
+	created := struct {
+		Token       string         `json:"token"`
+		AccessToken db.AccessToken `json:"accessToken"`
+		Error       string
+	}{}
+	if status > 299 {
+		created.Error = string(body)
+		if len(created.Error) == 0 {
+			created.Error = fmt.Sprintf("Failed to create access token (%d)", status)
+		}
+		return c.Render("components/tokenCreated", created)
+	}
+	err := json.Unmarshal(body, &created)
+	if err != nil {
+		log.Err(err)
+	}
+	c.Set("HX-Trigger", event)
+	return c.Render("components/tokenCreated", created)
+}
+
+// Shows the error of a failed request as a toast
+func errorToast(c *fiber.Ctx, message string) error {
+	c.Set("HX-Retarget", "#toast")
+	c.Set("HX-Reswap", "outerHTML")
+	return c.Render("components/errorToast", message)
+}
+
+// Passes the session and the CSRF token of the htmx request on to the
+// proxied api request
+func forwardCredentials(c *fiber.Ctx, agent *fiber.Agent) {
+	agent.Cookie(auth.TenantCookie, db.RequestTenant(c))
+	agent.Cookie(db.SessionCookie, c.Cookies(db.SessionCookie))
+	agent.Cookie(middleware.CSRFCookie, c.Cookies(middleware.CSRFCookie))
+	agent.Set(middleware.CSRFHeader, c.Get(middleware.CSRFHeader))
+}
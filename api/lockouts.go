@@ -0,0 +1,37 @@
+package api
+
+import (
+	"errors"
+	"net/url"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/ratelimit"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin routes listing and lifting lockouts after failed authentications
+func RegisterLockoutRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewSuperAdminGuard(userDb))
+	router.Get("/", func(c *fiber.Ctx) error {
+		return c.JSON(ratelimit.Lockouts())
+	})
+	router.Delete("/:identifier", func(c *fiber.Ctx) error {
+		identifier, err := url.PathUnescape(c.Params("identifier"))
+		if err != nil {
+			return c.SendStatus(400)
+		}
+		err = ratelimit.Unlock(identifier)
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		recordAdminAction(c, "lockout_cleared", identifier, nil)
+		return nil
+	})
+}
@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/mds"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin routes showing and replacing the FIDO metadata blob
+func RegisterMetadataRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewSuperAdminGuard(userDb))
+	router.Get("/", func(c *fiber.Ctx) error {
+		blob := mds.Status()
+		if blob == nil {
+			return c.Status(404).SendString(mds.ErrNotLoaded.Error())
+		}
+		return c.JSON(blob)
+	})
+	// Takes the blob as the body or as the blob file of a multipart form
+	router.Post("/", func(c *fiber.Ctx) error {
+		data := c.Body()
+		if file, err := c.FormFile("blob"); err == nil {
+			f, err := file.Open()
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			data, err = io.ReadAll(f)
+			if err != nil {
+				return err
+			}
+		}
+		blob, err := mds.Load(data)
+		if err != nil {
+			log.Err(err).Msg("failed to load uploaded metadata blob")
+			switch {
+			case errors.Is(err, mds.ErrInvalidBLOB), errors.Is(err, mds.ErrOutdatedBLOB):
+				return c.Status(400).SendString(err.Error())
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		recordAdminAction(c, "metadata_updated", "mds",
+			map[string]string{"number": strconv.Itoa(blob.Number)})
+		return c.JSON(blob)
+	})
+	router.Post("/reload", func(c *fiber.Ctx) error {
+		err := mds.Reload()
+		if err != nil {
+			log.Err(err).Msg("failed to reload metadata blob")
+			return c.Status(400).SendString(err.Error())
+		}
+		blob := mds.Status()
+		recordAdminAction(c, "metadata_updated", "mds",
+			map[string]string{"number": strconv.Itoa(blob.Number)})
+		return c.JSON(blob)
+	})
+}
@@ -0,0 +1,23 @@
+package api
+
+import (
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/policy"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Admin routes showing the authenticator policies and the credentials
+// violating them
+func RegisterPolicyRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewRoleGuard(userDb, db.Admin))
+	router.Get("/", func(c *fiber.Ctx) error {
+		policies := map[string]policy.Policy{}
+		for _, role := range []db.Role{db.Admin, db.Member, db.Helpdesk} {
+			policies[role.String()] = policy.For(role)
+		}
+		return c.JSON(policies)
+	})
+	router.Get("/violations", func(c *fiber.Ctx) error {
+		return c.JSON(policy.Report(userDb, db.RequestTenant(c)))
+	})
+}
@@ -0,0 +1,609 @@
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/scim"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Actor of the changes made by the provisioning client
+const scimActor = "scim"
+
+// SCIM 2.0 provisioning of the users of the request's tenant, RFC 7644.
+// Users are deactivated by blocking them, groups are the roles.
+func RegisterScimRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewScimTokenGuard())
+	router.Get("/ServiceProviderConfig", func(c *fiber.Ctx) error {
+		return scimJSON(c, 200, scim.ServiceProviderConfig(
+			"https://github.com/a19simma/go-webauthn-htmx#scim-provisioning"))
+	})
+	router.Get("/ResourceTypes", func(c *fiber.Ctx) error {
+		return scimList(c, scim.ResourceTypes(scimBase(c)))
+	})
+	router.Get("/Schemas", func(c *fiber.Ctx) error {
+		return scimList(c, scim.Schemas(scimBase(c)))
+	})
+
+	router.Get("/Users", func(c *fiber.Ctx) error {
+		filter, err := scimFilter(c)
+		if err != nil {
+			return scimError(c, 400, scim.InvalidFilter, err.Error())
+		}
+		users := tenantUsers(userDb, c)
+		resources := []any{}
+		for _, user := range users {
+			if filter == nil || filter.Matches(userAttributes(user)) {
+				resources = append(resources, scimUser(c, user))
+			}
+		}
+		return scimList(c, resources)
+	})
+	router.Post("/Users", func(c *fiber.Ctx) error {
+		var resource scim.User
+		if err := json.Unmarshal(c.Body(), &resource); err != nil {
+			return scimError(c, 400, scim.InvalidSyntax, err.Error())
+		}
+		if resource.UserName == "" {
+			return scimError(c, 400, scim.InvalidValue, "userName is required")
+		}
+		if !tenantAllows(c, resource.UserName) {
+			return scimError(c, 400, scim.InvalidValue, "userName is not in the email domain of the tenant")
+		}
+		username, err := db.QualifyUsername(c, resource.UserName)
+		if err != nil {
+			return scimError(c, 400, scim.InvalidValue, err.Error())
+		}
+		if _, err := userDb.GetUser(username); err == nil {
+			return scimError(c, 409, scim.Uniqueness, "user already exists")
+		}
+		id := make([]byte, 32)
+		_, err = rand.Read(id)
+		if err != nil {
+			return err
+		}
+
+		user := db.User{ID: id, Username: username, Status: db.Open, Role: db.Member}
+		if resource.Active != nil && !*resource.Active {
+			user.Status = db.Blocked
+		}
+		err = userDb.CreateUser(user)
+		if err != nil {
+			return err
+		}
+		recordScimAction(c, "user_created", username, nil)
+		webhooks.Emit(webhooks.UserCreated, scimActor, webhooks.NewUser(user))
+		created := scimUser(c, user)
+		c.Location(created.Meta.Location)
+		return scimJSON(c, 201, created)
+	})
+	router.Get("/Users/:id", func(c *fiber.Ctx) error {
+		user, err := scimUserParam(c, userDb)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		return scimJSON(c, 200, scimUser(c, *user))
+	})
+	router.Put("/Users/:id", func(c *fiber.Ctx) error {
+		user, err := scimUserParam(c, userDb)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		var resource scim.User
+		if err := json.Unmarshal(c.Body(), &resource); err != nil {
+			return scimError(c, 400, scim.InvalidSyntax, err.Error())
+		}
+		if !strings.EqualFold(resource.UserName, db.LocalUsername(user.Username)) {
+			return scimError(c, 400, scim.Mutability, "userName cannot be changed")
+		}
+		if resource.Active != nil {
+			err = setActive(c, userDb, user, *resource.Active)
+			if err != nil {
+				return err
+			}
+		}
+		return scimJSON(c, 200, scimUser(c, *user))
+	})
+	router.Patch("/Users/:id", func(c *fiber.Ctx) error {
+		user, err := scimUserParam(c, userDb)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		var patch scim.PatchRequest
+		if err := json.Unmarshal(c.Body(), &patch); err != nil {
+			return scimError(c, 400, scim.InvalidSyntax, err.Error())
+		}
+		for _, op := range patch.Operations {
+			attrs := map[string]json.RawMessage{}
+			path, filter, sub, err := scim.ParseValuePath(op.Path)
+			if err != nil {
+				return scimError(c, 400, scim.InvalidPath, err.Error())
+			}
+			if filter != nil || sub != "" {
+				if path == "active" || path == "username" {
+					return scimError(c, 400, scim.InvalidPath, path+" is not multi-valued")
+				}
+				// Value paths like emails[type eq "work"].value target
+				// attributes that are not stored
+				continue
+			}
+			switch {
+			case path == "":
+				if err := json.Unmarshal(op.Value, &attrs); err != nil {
+					return scimError(c, 400, scim.InvalidValue, "value without path must be an object")
+				}
+			case strings.EqualFold(op.Op, "remove"):
+				if path == "active" || path == "username" {
+					return scimError(c, 400, scim.Mutability, path+" cannot be removed")
+				}
+			default:
+				attrs[path] = op.Value
+			}
+			for attr, value := range attrs {
+				switch strings.ToLower(attr) {
+				case "active":
+					active, err := scim.ParseBool(value)
+					if err != nil {
+						return scimError(c, 400, scim.InvalidValue, err.Error())
+					}
+					err = setActive(c, userDb, user, active)
+					if err != nil {
+						return err
+					}
+				case "username":
+					var username string
+					if json.Unmarshal(value, &username) != nil ||
+						!strings.EqualFold(username, db.LocalUsername(user.Username)) {
+						return scimError(c, 400, scim.Mutability, "userName cannot be changed")
+					}
+				}
+			}
+		}
+		return scimJSON(c, 200, scimUser(c, *user))
+	})
+	router.Delete("/Users/:id", func(c *fiber.Ctx) error {
+		user, err := scimUserParam(c, userDb)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		err = userDb.DeleteUser(user.Username)
+		if err != nil {
+			log.Err(err).Str("username", user.Username).Msg("failed to delete provisioned user")
+			return c.SendStatus(500)
+		}
+		recordScimAction(c, "user_deleted", user.Username, nil)
+		webhooks.Emit(webhooks.UserDeleted, scimActor, webhooks.User{Username: user.Username})
+		return c.SendStatus(204)
+	})
+
+	router.Get("/Groups", func(c *fiber.Ctx) error {
+		filter, err := scimFilter(c)
+		if err != nil {
+			return scimError(c, 400, scim.InvalidFilter, err.Error())
+		}
+		users := tenantUsers(userDb, c)
+		resources := []any{}
+		for _, role := range scimRoles {
+			group := scimGroup(c, role, users)
+			if filter == nil || filter.Matches(groupAttributes(group)) {
+				if strings.Contains(strings.ToLower(c.Query("excludedAttributes")), "members") {
+					group.Members = nil
+				}
+				resources = append(resources, group)
+			}
+		}
+		return scimList(c, resources)
+	})
+	router.Get("/Groups/:id", func(c *fiber.Ctx) error {
+		role, err := scimRoleParam(c)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		return scimJSON(c, 200, scimGroup(c, role, tenantUsers(userDb, c)))
+	})
+	router.Put("/Groups/:id", func(c *fiber.Ctx) error {
+		role, err := scimRoleParam(c)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		var resource scim.Group
+		if err := json.Unmarshal(c.Body(), &resource); err != nil {
+			return scimError(c, 400, scim.InvalidSyntax, err.Error())
+		}
+		if resource.DisplayName != "" && resource.DisplayName != role.String() {
+			return scimError(c, 400, scim.Mutability, "displayName cannot be changed")
+		}
+		err = replaceMembers(c, userDb, role, resource.Members)
+		if err != nil {
+			return scimMembersError(c, err)
+		}
+		return scimJSON(c, 200, scimGroup(c, role, tenantUsers(userDb, c)))
+	})
+	router.Patch("/Groups/:id", func(c *fiber.Ctx) error {
+		role, err := scimRoleParam(c)
+		if err != nil {
+			return scimNotFound(c, err)
+		}
+		var patch scim.PatchRequest
+		if err := json.Unmarshal(c.Body(), &patch); err != nil {
+			return scimError(c, 400, scim.InvalidSyntax, err.Error())
+		}
+		for _, op := range patch.Operations {
+			path, filter, err := scim.ParsePath(op.Path)
+			if err != nil {
+				return scimError(c, 400, scim.InvalidPath, err.Error())
+			}
+			var members []scim.Reference
+			switch path {
+			case "":
+				var value struct {
+					DisplayName string           `json:"displayName"`
+					Members     []scim.Reference `json:"members"`
+				}
+				if err := json.Unmarshal(op.Value, &value); err != nil {
+					return scimError(c, 400, scim.InvalidValue, "value without path must be an object")
+				}
+				if value.DisplayName != "" && value.DisplayName != role.String() {
+					return scimError(c, 400, scim.Mutability, "displayName cannot be changed")
+				}
+				members = value.Members
+			case "members":
+				if len(op.Value) > 0 && json.Unmarshal(op.Value, &members) != nil {
+					return scimError(c, 400, scim.InvalidValue, "members must be an array")
+				}
+			case "displayname":
+				return scimError(c, 400, scim.Mutability, "displayName cannot be changed")
+			default:
+				continue
+			}
+
+			switch strings.ToLower(op.Op) {
+			case "add":
+				err = addMembers(c, userDb, role, members)
+			case "replace":
+				err = replaceMembers(c, userDb, role, members)
+			case "remove":
+				// Without a value or filter every member is removed
+				if filter == nil && len(members) == 0 {
+					err = replaceMembers(c, userDb, role, nil)
+					break
+				}
+				for _, user := range tenantUsers(userDb, c) {
+					if user.Role != role {
+						continue
+					}
+					id := scimID(user)
+					removed := filter != nil && filter.Matches(scim.Attributes{"value": {id}})
+					for _, member := range members {
+						removed = removed || member.Value == id
+					}
+					if removed {
+						err = setRole(c, userDb, user.Username, db.Member)
+						if err != nil {
+							break
+						}
+					}
+				}
+			default:
+				return scimError(c, 400, scim.InvalidSyntax, "unknown op "+op.Op)
+			}
+			if err != nil {
+				return scimMembersError(c, err)
+			}
+		}
+		return scimJSON(c, 200, scimGroup(c, role, tenantUsers(userDb, c)))
+	})
+	router.Post("/Groups", scimUnsupported)
+	router.Delete("/Groups/:id", scimUnsupported)
+}
+
+// Returns a handler accepting requests with the SCIM token of the
+// request's tenant, AUTH_SCIM_TOKEN for the default tenant. SCIM is
+// disabled for tenants without a token.
+func NewScimTokenGuard() fiber.Handler {
+	defaultTenant := db.Tenant{}
+	defaultTenant.SetSCIMToken(viper.GetString("AUTH_SCIM_TOKEN"))
+	return func(c *fiber.Ctx) error {
+		tenant := &defaultTenant
+		if id := db.RequestTenant(c); id != "" {
+			var err error
+			tenant, err = db.TenantDbImpl{}.GetTenant(id)
+			if err != nil {
+				return c.SendStatus(404)
+			}
+		}
+		if !tenant.SCIMEnabled {
+			return c.SendStatus(404)
+		}
+		bearer, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found || !tenant.SCIMTokenMatches(bearer) {
+			audit.Record(c, audit.Entry{
+				Action:  "access_denied",
+				Actor:   scimActor,
+				Outcome: audit.OutcomeDenied,
+				Details: map[string]string{"method": c.Method(), "path": c.Path(), "tenant": tenant.ID},
+			})
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="scim"`)
+			return scimError(c, 401, "", "invalid bearer token")
+		}
+		return c.Next()
+	}
+}
+
+// Groups of the roles, in the order they are listed
+var scimRoles = []db.Role{db.Admin, db.Member, db.Helpdesk}
+
+func scimJSON(c *fiber.Ctx, status int, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.Set(fiber.HeaderContentType, scim.ContentType)
+	return c.Status(status).Send(data)
+}
+
+func scimError(c *fiber.Ctx, status int, scimType string, detail string) error {
+	return scimJSON(c, status, scim.NewError(status, scimType, detail))
+}
+
+func scimNotFound(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, db.ErrNoResults):
+		return scimError(c, 404, "", "resource not found")
+	default:
+		log.Err(err).Msg("failed to load scim resource")
+		return c.SendStatus(500)
+	}
+}
+
+// Responds to a failed change of the members of a group, unknown members
+// are the client's fault
+func scimMembersError(c *fiber.Ctx, err error) error {
+	var scimErr scim.Error
+	if errors.As(err, &scimErr) {
+		return scimJSON(c, 400, scimErr)
+	}
+	return err
+}
+
+func scimUnsupported(c *fiber.Ctx) error {
+	return scimError(c, 501, "", "groups are the roles and cannot be created or deleted")
+}
+
+// Returns the page selected by startIndex and count of the resources
+func scimList(c *fiber.Ctx, resources []any) error {
+	startIndex := c.QueryInt("startIndex", 1)
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	start, end := scim.Page(len(resources), startIndex, c.QueryInt("count", scim.MaxResults))
+	return scimJSON(c, 200, scim.ListResponse{
+		Schemas:      []string{scim.ListResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: end - start,
+		Resources:    resources[start:end],
+	})
+}
+
+func scimFilter(c *fiber.Ctx) (scim.Filter, error) {
+	if c.Query("filter") == "" {
+		return nil, nil
+	}
+	return scim.ParseFilter(c.Query("filter"))
+}
+
+// Returns the URL of the SCIM endpoint as requested, with the tenant prefix
+func scimBase(c *fiber.Ctx) string {
+	prefix, _, _ := strings.Cut(c.OriginalURL(), "/scim/v2")
+	return c.BaseURL() + prefix + "/scim/v2"
+}
+
+func scimID(user db.User) string {
+	return base64.RawURLEncoding.EncodeToString(user.ID)
+}
+
+// Returns the users of the request's tenant, sorted so that pages are
+// stable
+func tenantUsers(userDb db.UserDb, c *fiber.Ctx) []db.User {
+	users := userDb.GetTenantUsers(db.RequestTenant(c))
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+// Returns the user of the request's tenant with the id in the path
+func scimUserParam(c *fiber.Ctx, userDb db.UserDb) (*db.User, error) {
+	id, err := base64.RawURLEncoding.DecodeString(c.Params("id"))
+	if err != nil {
+		return nil, db.ErrNoResults
+	}
+	for _, user := range tenantUsers(userDb, c) {
+		if bytes.Equal(user.ID, id) {
+			return userDb.GetUser(user.Username)
+		}
+	}
+	return nil, db.ErrNoResults
+}
+
+func scimRoleParam(c *fiber.Ctx) (db.Role, error) {
+	for _, role := range scimRoles {
+		if c.Params("id") == strings.ToLower(role.String()) {
+			return role, nil
+		}
+	}
+	return 0, db.ErrNoResults
+}
+
+func scimUser(c *fiber.Ctx, user db.User) scim.User {
+	id := scimID(user)
+	active := user.Status != db.Blocked
+	group := strings.ToLower(user.Role.String())
+	return scim.User{
+		Schemas:  []string{scim.UserSchema},
+		ID:       id,
+		UserName: db.LocalUsername(user.Username),
+		Active:   &active,
+		Groups: []scim.Reference{{
+			Value:   group,
+			Ref:     scimBase(c) + "/Groups/" + group,
+			Display: user.Role.String(),
+		}},
+		Meta: &scim.Meta{ResourceType: "User", Location: scimBase(c) + "/Users/" + id},
+	}
+}
+
+func userAttributes(user db.User) scim.Attributes {
+	return scim.Attributes{
+		"id":           {scimID(user)},
+		"username":     {db.LocalUsername(user.Username)},
+		"active":       {user.Status != db.Blocked},
+		"groups.value": {strings.ToLower(user.Role.String())},
+		"groups":       {strings.ToLower(user.Role.String())},
+	}
+}
+
+func scimGroup(c *fiber.Ctx, role db.Role, users []db.User) scim.Group {
+	id := strings.ToLower(role.String())
+	members := []scim.Reference{}
+	for _, user := range users {
+		if user.Role == role {
+			members = append(members, scim.Reference{
+				Value:   scimID(user),
+				Ref:     scimBase(c) + "/Users/" + scimID(user),
+				Display: db.LocalUsername(user.Username),
+			})
+		}
+	}
+	return scim.Group{
+		Schemas:     []string{scim.GroupSchema},
+		ID:          id,
+		DisplayName: role.String(),
+		Members:     members,
+		Meta:        &scim.Meta{ResourceType: "Group", Location: scimBase(c) + "/Groups/" + id},
+	}
+}
+
+func groupAttributes(group scim.Group) scim.Attributes {
+	members := []any{}
+	for _, member := range group.Members {
+		members = append(members, member.Value)
+	}
+	return scim.Attributes{
+		"id":            {group.ID},
+		"displayname":   {group.DisplayName},
+		"members.value": members,
+		"members":       members,
+	}
+}
+
+// Blocks or unblocks the user, blocking revokes their sessions
+func setActive(c *fiber.Ctx, userDb db.UserDb, user *db.User, active bool) error {
+	if active == (user.Status != db.Blocked) {
+		return nil
+	}
+	event, action := webhooks.UserBlocked, "user_blocked"
+	if active {
+		event, action = webhooks.UserUnblocked, "user_unblocked"
+		user.Status = db.Open
+		if len(userDb.GetUserCredentials(*user)) > 0 {
+			user.Status = db.Registered
+		}
+	} else {
+		user.Status = db.Blocked
+	}
+	err := userDb.CreateUser(*user)
+	if err != nil {
+		return err
+	}
+	if !active {
+		_, err = userDb.RevokeSessions(user.Username, "")
+		if err != nil {
+			log.Err(err).Msg("failed to revoke sessions of deprovisioned user")
+		}
+	}
+	recordScimAction(c, action, user.Username, nil)
+	webhooks.Emit(event, scimActor, webhooks.NewUser(*user))
+	return nil
+}
+
+func setRole(c *fiber.Ctx, userDb db.UserDb, username string, role db.Role) error {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return err
+	}
+	if user.Role == role {
+		return nil
+	}
+	user.Role = role
+	err = userDb.CreateUser(*user)
+	if err != nil {
+		return err
+	}
+	recordScimAction(c, "role_changed", user.Username, map[string]string{"role": role.String()})
+	webhooks.Emit(webhooks.UserRoleChanged, scimActor, webhooks.NewUser(*user))
+	return nil
+}
+
+// Gives the members the role of the group
+func addMembers(c *fiber.Ctx, userDb db.UserDb, role db.Role, members []scim.Reference) error {
+	users := map[string]string{}
+	for _, user := range tenantUsers(userDb, c) {
+		users[scimID(user)] = user.Username
+	}
+	for _, member := range members {
+		username, ok := users[member.Value]
+		if !ok {
+			return scim.NewError(400, scim.InvalidValue, "unknown member "+member.Value)
+		}
+		err := setRole(c, userDb, username, role)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Makes the members the only users with the role of the group, users
+// removed from a group become members
+func replaceMembers(c *fiber.Ctx, userDb db.UserDb, role db.Role, members []scim.Reference) error {
+	err := addMembers(c, userDb, role, members)
+	if err != nil {
+		return err
+	}
+	keep := map[string]bool{}
+	for _, member := range members {
+		keep[member.Value] = true
+	}
+	for _, user := range tenantUsers(userDb, c) {
+		if user.Role == role && !keep[scimID(user)] {
+			err = setRole(c, userDb, user.Username, db.Member)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Records an action the provisioning client performed on the target user
+func recordScimAction(c *fiber.Ctx, action string, target string, details map[string]string) {
+	audit.Record(c, audit.Entry{
+		Action:  action,
+		Actor:   scimActor,
+		Target:  target,
+		Details: details,
+	})
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/scim"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/spf13/viper"
+)
+
+const testScimToken = "scim-secret"
+
+// Runs the tests against fresh databases in a temporary directory
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	dir, err := os.MkdirTemp("", "scim-test")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		panic(err)
+	}
+	viper.Set("AUTH_SCIM_TOKEN", testScimToken)
+	viper.Set("AUTH_AUDIT_CHECKPOINT", "audit-head.json")
+	db.InitUsers()
+	db.Init()
+	db.InitTenants()
+	db.InitAccessTokens()
+	audit.Init(db.InitAudit())
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Returns an app serving SCIM for the default tenant at /scim/v2 and for
+// the tenant acme at /t/acme/scim/v2
+func newScimApp(t *testing.T) *fiber.App {
+	t.Helper()
+	app := fiber.New()
+	RegisterScimRoutes(app.Group("/scim/v2"), db.UserDbImpl{})
+	tenant := app.Group("/t/acme", func(c *fiber.Ctx) error {
+		c.Locals(db.TenantLocal, "acme")
+		return c.Next()
+	})
+	RegisterScimRoutes(tenant.Group("/scim/v2"), db.UserDbImpl{})
+	return app
+}
+
+func scimRequest(t *testing.T, app *fiber.App, method string, path string, body any, token string) (int, map[string]any) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	req.Header.Set(fiber.HeaderContentType, scim.ContentType)
+	req.Header.Set(fiber.HeaderAuthorization, "Bearer "+token)
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Bodies of other content types, like the plain 404 of a tenant
+	// without SCIM, are left out
+	if resp.Header.Get(fiber.HeaderContentType) != scim.ContentType {
+		return resp.StatusCode, nil
+	}
+	payload := map[string]any{}
+	err = json.Unmarshal(b, &payload)
+	if err != nil {
+		t.Fatalf("%s %s: %v: %s", method, path, err, b)
+	}
+	return resp.StatusCode, payload
+}
+
+// JSON types of the attributes of a resource, RFC 7643 section 2.3.
+// Optional attributes end with ?.
+type shape map[string]string
+
+var (
+	userShape = shape{
+		"schemas": "array", "id": "string", "userName": "string", "active": "boolean",
+		"groups": "array", "meta": "object",
+	}
+	groupShape = shape{
+		"schemas": "array", "id": "string", "displayName": "string", "members": "array?", "meta": "object",
+	}
+	referenceShape = shape{"value": "string", "$ref": "string", "display": "string"}
+	metaShape      = shape{"resourceType": "string", "location": "string"}
+	listShape      = shape{
+		"schemas": "array", "totalResults": "number", "startIndex": "number", "itemsPerPage": "number",
+		"Resources": "array",
+	}
+	errorShape = shape{"schemas": "array", "status": "string", "scimType": "string?", "detail": "string"}
+)
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "null"
+}
+
+// Checks that the payload has the attributes of the shape and the schema
+// URN, and nothing else
+func checkShape(t *testing.T, name string, payload map[string]any, s shape, schema string) {
+	t.Helper()
+	for attr, typ := range s {
+		value, ok := payload[attr]
+		typ, optional := strings.CutSuffix(typ, "?")
+		if got := jsonType(value); got != typ && !(optional && !ok) {
+			t.Errorf("%s: %s is %s, expected %s", name, attr, got, typ)
+		}
+	}
+	for attr := range payload {
+		if _, ok := s[attr]; !ok {
+			t.Errorf("%s: unexpected attribute %s", name, attr)
+		}
+	}
+	if schema == "" {
+		return
+	}
+	schemas, _ := payload["schemas"].([]any)
+	if !slices.Contains(schemas, any(schema)) {
+		t.Errorf("%s: schemas %v do not contain %s", name, schemas, schema)
+	}
+}
+
+func checkUser(t *testing.T, payload map[string]any) {
+	t.Helper()
+	checkShape(t, "user", payload, userShape, scim.UserSchema)
+	meta, _ := payload["meta"].(map[string]any)
+	checkShape(t, "user meta", meta, metaShape, "")
+	if meta["resourceType"] != "User" {
+		t.Errorf("user: resourceType %v", meta["resourceType"])
+	}
+	groups, _ := payload["groups"].([]any)
+	for _, group := range groups {
+		reference, _ := group.(map[string]any)
+		checkShape(t, "user group", reference, referenceShape, "")
+	}
+}
+
+func checkGroup(t *testing.T, payload map[string]any) {
+	t.Helper()
+	checkShape(t, "group", payload, groupShape, scim.GroupSchema)
+	meta, _ := payload["meta"].(map[string]any)
+	checkShape(t, "group meta", meta, metaShape, "")
+	if meta["resourceType"] != "Group" {
+		t.Errorf("group: resourceType %v", meta["resourceType"])
+	}
+	members, _ := payload["members"].([]any)
+	for _, member := range members {
+		reference, _ := member.(map[string]any)
+		checkShape(t, "group member", reference, referenceShape, "")
+	}
+}
+
+func checkError(t *testing.T, status int, payload map[string]any, expectedStatus int, scimType string) {
+	t.Helper()
+	if status != expectedStatus {
+		t.Errorf("status %d, expected %d: %v", status, expectedStatus, payload)
+	}
+	checkShape(t, "error", payload, errorShape, scim.ErrorSchema)
+	if payload["status"] != strconv.Itoa(expectedStatus) {
+		t.Errorf("error: status %v, expected %d", payload["status"], expectedStatus)
+	}
+	if scimType != "" && payload["scimType"] != scimType {
+		t.Errorf("error: scimType %v, expected %s", payload["scimType"], scimType)
+	}
+}
+
+func TestScimTokenGuard(t *testing.T) {
+	app := newScimApp(t)
+	tenantDb := db.TenantDbImpl{}
+	acme := db.Tenant{ID: "acme", Name: "Acme"}
+	acme.SetSCIMToken("acme-secret")
+	err := tenantDb.CreateTenant(acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.TenantDbImpl{}.SaveTenant(db.Tenant{ID: "acme", Name: "Acme"}) })
+
+	tests := []struct {
+		path   string
+		token  string
+		status int
+	}{
+		{"/scim/v2/Users", testScimToken, 200},
+		{"/scim/v2/Users", "acme-secret", 401},
+		{"/scim/v2/Users", "", 401},
+		{"/t/acme/scim/v2/Users", "acme-secret", 200},
+		{"/t/acme/scim/v2/Users", testScimToken, 401},
+		{"/t/acme/scim/v2/Users", "wrong", 401},
+	}
+	for _, test := range tests {
+		t.Run(test.path+" "+test.token, func(t *testing.T) {
+			status, payload := scimRequest(t, app, "GET", test.path, nil, test.token)
+			if test.status == 401 {
+				checkError(t, status, payload, 401, "")
+			} else if status != test.status {
+				t.Errorf("status %d, expected %d", status, test.status)
+			}
+		})
+	}
+
+	acme.SetSCIMToken("")
+	err = tenantDb.SaveTenant(acme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, _ := scimRequest(t, app, "GET", "/t/acme/scim/v2/Users", nil, "acme-secret")
+	if status != 404 {
+		t.Errorf("disabled tenant: status %d, expected 404", status)
+	}
+}
+
+func TestScimPayloads(t *testing.T) {
+	app := newScimApp(t)
+	do := func(method string, path string, body any) (int, map[string]any) {
+		t.Helper()
+		return scimRequest(t, app, method, path, body, testScimToken)
+	}
+
+	status, user := do("POST", "/scim/v2/Users", map[string]any{
+		"schemas":  []string{scim.UserSchema},
+		"userName": "payload@example.com",
+		"name":     map[string]any{"givenName": "Pay"},
+	})
+	if status != 201 {
+		t.Fatalf("create: status %d: %v", status, user)
+	}
+	checkUser(t, user)
+	id, _ := user["id"].(string)
+	t.Cleanup(func() { db.UserDbImpl{}.DeleteUser("payload@example.com") })
+
+	t.Run("user", func(t *testing.T) {
+		status, payload := do("GET", "/scim/v2/Users/"+id, nil)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		checkUser(t, payload)
+		if payload["userName"] != "payload@example.com" || payload["active"] != true {
+			t.Errorf("unexpected user %v", payload)
+		}
+	})
+	t.Run("list response", func(t *testing.T) {
+		status, payload := do("GET", "/scim/v2/Users?filter="+
+			url.QueryEscape(`userName eq "payload@example.com"`), nil)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		checkShape(t, "list", payload, listShape, scim.ListResponseSchema)
+		resources, _ := payload["Resources"].([]any)
+		if payload["totalResults"] != 1.0 || payload["startIndex"] != 1.0 ||
+			payload["itemsPerPage"] != 1.0 || len(resources) != 1 {
+			t.Fatalf("unexpected list %v", payload)
+		}
+		resource, _ := resources[0].(map[string]any)
+		checkUser(t, resource)
+	})
+	t.Run("empty list response", func(t *testing.T) {
+		_, payload := do("GET", "/scim/v2/Users?filter="+url.QueryEscape(`userName eq "nobody"`), nil)
+		checkShape(t, "list", payload, listShape, scim.ListResponseSchema)
+		if payload["totalResults"] != 0.0 {
+			t.Errorf("unexpected list %v", payload)
+		}
+	})
+	t.Run("group", func(t *testing.T) {
+		status, payload := do("GET", "/scim/v2/Groups/member", nil)
+		if status != 200 {
+			t.Fatalf("status %d", status)
+		}
+		checkGroup(t, payload)
+		_, list := do("GET", "/scim/v2/Groups", nil)
+		checkShape(t, "list", list, listShape, scim.ListResponseSchema)
+		resources, _ := list["Resources"].([]any)
+		if len(resources) != 3 {
+			t.Fatalf("expected the 3 roles, got %v", list)
+		}
+		for _, resource := range resources {
+			group, _ := resource.(map[string]any)
+			checkGroup(t, group)
+		}
+	})
+	t.Run("patch op", func(t *testing.T) {
+		status, payload := do("PATCH", "/scim/v2/Users/"+id, map[string]any{
+			"schemas":    []string{scim.PatchOpSchema},
+			"Operations": []map[string]any{{"op": "replace", "path": "active", "value": false}},
+		})
+		if status != 200 {
+			t.Fatalf("status %d: %v", status, payload)
+		}
+		checkUser(t, payload)
+		if payload["active"] != false {
+			t.Errorf("user not deactivated: %v", payload)
+		}
+
+		// Attributes that are not stored are ignored
+		status, payload = do("PATCH", "/scim/v2/Users/"+id, map[string]any{
+			"schemas":    []string{scim.PatchOpSchema},
+			"Operations": []map[string]any{{"op": "replace", "path": `emails[type eq "work"].value`, "value": "x@example.com"}},
+		})
+		if status != 200 {
+			t.Fatalf("status %d: %v", status, payload)
+		}
+
+		status, payload = do("PATCH", "/scim/v2/Groups/helpdesk", map[string]any{
+			"schemas": []string{scim.PatchOpSchema},
+			"Operations": []map[string]any{{"op": "add", "path": "members",
+				"value": []map[string]string{{"value": id}}}},
+		})
+		if status != 200 {
+			t.Fatalf("status %d: %v", status, payload)
+		}
+		checkGroup(t, payload)
+		members, _ := payload["members"].([]any)
+		if len(members) != 1 {
+			t.Errorf("member not added: %v", payload)
+		}
+	})
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			method   string
+			path     string
+			body     any
+			status   int
+			scimType string
+		}{
+			{"invalid filter", "GET", "/scim/v2/Users?filter=" + url.QueryEscape(`userName bogus "x"`), nil, 400, scim.InvalidFilter},
+			{"unterminated filter", "GET", "/scim/v2/Users?filter=" + url.QueryEscape(`userName eq "x`), nil, 400, scim.InvalidFilter},
+			{"invalid group filter", "GET", "/scim/v2/Groups?filter=" + url.QueryEscape(`not displayName pr`), nil, 400, scim.InvalidFilter},
+			{"unknown user", "GET", "/scim/v2/Users/nope", nil, 404, ""},
+			{"unknown group", "GET", "/scim/v2/Groups/nope", nil, 404, ""},
+			{"duplicate user", "POST", "/scim/v2/Users", map[string]any{"userName": "payload@example.com"}, 409, scim.Uniqueness},
+			{"missing userName", "POST", "/scim/v2/Users", map[string]any{"active": true}, 400, scim.InvalidValue},
+			{"invalid syntax", "POST", "/scim/v2/Users", "not an object", 400, scim.InvalidSyntax},
+			{"rename", "PATCH", "/scim/v2/Users/" + id, map[string]any{
+				"Operations": []map[string]any{{"op": "replace", "path": "userName", "value": "other@example.com"}},
+			}, 400, scim.Mutability},
+			{"invalid path", "PATCH", "/scim/v2/Groups/admin", map[string]any{
+				"Operations": []map[string]any{{"op": "remove", "path": `members[value bogus "x"]`}},
+			}, 400, scim.InvalidPath},
+			{"invalid user path", "PATCH", "/scim/v2/Users/" + id, map[string]any{
+				"Operations": []map[string]any{{"op": "replace", "path": `emails[type bogus "work"].value`, "value": "x"}},
+			}, 400, scim.InvalidPath},
+			{"user value path", "PATCH", "/scim/v2/Users/" + id, map[string]any{
+				"Operations": []map[string]any{{"op": "replace", "path": `active[value eq true]`, "value": false}},
+			}, 400, scim.InvalidPath},
+			{"unknown op", "PATCH", "/scim/v2/Groups/admin", map[string]any{
+				"Operations": []map[string]any{{"op": "move", "path": "members"}},
+			}, 400, scim.InvalidSyntax},
+			{"group create", "POST", "/scim/v2/Groups", map[string]any{"displayName": "x"}, 501, ""},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				status, payload := do(test.method, test.path, test.body)
+				checkError(t, status, payload, test.status, test.scimType)
+			})
+		}
+	})
+}
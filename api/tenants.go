@@ -0,0 +1,154 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Super admin routes creating, configuring and suspending tenants
+func RegisterTenantRoutes(router fiber.Router, userDb db.UserDb, tenantDb db.TenantDb) {
+	router.Use(NewSuperAdminGuard(userDb))
+	router.Get("/", func(c *fiber.Ctx) error {
+		return c.JSON(tenantDb.GetTenants())
+	})
+	router.Post("/", func(c *fiber.Ctx) error {
+		tenant := db.Tenant{ID: c.FormValue("id")}
+		applyTenantSettings(c, &tenant)
+		err := tenantDb.CreateTenant(tenant)
+		if err != nil {
+			log.Err(err).Str("tenant", tenant.ID).Msg("failed to create tenant")
+			switch {
+			case errors.Is(err, db.ErrInvalidTenant):
+				return c.Status(400).SendString(err.Error())
+			case errors.Is(err, db.ErrTenantExists):
+				return c.Status(409).SendString(err.Error())
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		recordAdminAction(c, "tenant_created", tenant.ID, nil)
+		return c.JSON(tenant)
+	})
+	// Replaces the settings of the tenant with the posted ones
+	router.Post("/:id", func(c *fiber.Ctx) error {
+		return updateTenant(c, tenantDb, "tenant_updated", func(tenant *db.Tenant) {
+			applyTenantSettings(c, tenant)
+		})
+	})
+	router.Post("/:id/suspend", func(c *fiber.Ctx) error {
+		return updateTenant(c, tenantDb, "tenant_suspended", func(tenant *db.Tenant) {
+			tenant.Status = db.TenantSuspended
+		})
+	})
+	router.Post("/:id/resume", func(c *fiber.Ctx) error {
+		return updateTenant(c, tenantDb, "tenant_resumed", func(tenant *db.Tenant) {
+			tenant.Status = db.TenantActive
+		})
+	})
+	// Issues a new SCIM token for the tenant, replacing the previous one.
+	// Only its hash is stored, so it is returned once.
+	router.Post("/:id/scim-token", func(c *fiber.Ctx) error {
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		token := base64.RawURLEncoding.EncodeToString(secret)
+		tenant, err := tenantDb.GetTenant(c.Params("id"))
+		if err != nil {
+			if errors.Is(err, db.ErrNoResults) {
+				return c.SendStatus(404)
+			}
+			return c.SendStatus(500)
+		}
+		tenant.SetSCIMToken(token)
+		err = tenantDb.SaveTenant(*tenant)
+		if err != nil {
+			log.Err(err).Str("tenant", tenant.ID).Msg("failed to save tenant")
+			return c.SendStatus(500)
+		}
+		recordAdminAction(c, "tenant_scim_token_issued", tenant.ID, nil)
+		return c.JSON(fiber.Map{"token": token, "tenant": tenant})
+	})
+	router.Delete("/:id/scim-token", func(c *fiber.Ctx) error {
+		return updateTenant(c, tenantDb, "tenant_scim_token_revoked", func(tenant *db.Tenant) {
+			tenant.SetSCIMToken("")
+		})
+	})
+}
+
+func applyTenantSettings(c *fiber.Ctx, tenant *db.Tenant) {
+	tenant.Name = c.FormValue("name")
+	tenant.RPID = c.FormValue("rpId")
+	tenant.Origins = c.FormValue("origins")
+	tenant.Logo = c.FormValue("logo")
+	tenant.Theme = c.FormValue("theme")
+	tenant.AdminEmail = c.FormValue("adminEmail")
+	tenant.EmailDomain = c.FormValue("emailDomain")
+	tenant.SenderName = c.FormValue("senderName")
+	tenant.SenderEmail = c.FormValue("senderEmail")
+	tenant.SMTPHost = c.FormValue("smtpHost")
+	tenant.SMTPPort, _ = strconv.Atoi(c.FormValue("smtpPort"))
+	tenant.SMTPUsername = c.FormValue("smtpUsername")
+	// The password is not returned, so it is kept unless a new one is posted
+	if password := c.FormValue("smtpPassword"); len(password) > 0 {
+		tenant.SMTPPassword = password
+	}
+}
+
+func updateTenant(c *fiber.Ctx, tenantDb db.TenantDb, action string, update func(*db.Tenant)) error {
+	tenant, err := tenantDb.GetTenant(c.Params("id"))
+	if err != nil {
+		switch {
+		case errors.Is(err, db.ErrNoResults):
+			return c.SendStatus(404)
+		default:
+			log.Err(err).Msg("failed to load tenant")
+			return c.SendStatus(500)
+		}
+	}
+	update(tenant)
+	err = tenantDb.SaveTenant(*tenant)
+	if err != nil {
+		log.Err(err).Str("tenant", tenant.ID).Msg("failed to save tenant")
+		return c.SendStatus(500)
+	}
+	recordAdminAction(c, action, tenant.ID, nil)
+	return c.JSON(tenant)
+}
+
+// Returns a handler rejecting everyone but the admins of the default
+// tenant, who operate the service. Tenant admins only manage their users.
+func NewSuperAdminGuard(userDb db.UserDb) fiber.Handler {
+	guard := NewRoleGuard(userDb, db.Admin)
+	return func(c *fiber.Ctx) error {
+		if tenant := db.RequestTenant(c); tenant != "" {
+			actor, _ := db.ValidateLoginSession(c)
+			audit.Record(c, audit.Entry{
+				Action:  "access_denied",
+				Actor:   actor,
+				Outcome: audit.OutcomeDenied,
+				Details: map[string]string{"method": c.Method(), "path": c.Path(), "tenant": tenant},
+			})
+			return c.SendStatus(403)
+		}
+		return guard(c)
+	}
+}
+
+// Reports whether the tenant of the request accepts the username
+func tenantAllows(c *fiber.Ctx, username string) bool {
+	id := db.RequestTenant(c)
+	if id == "" {
+		return true
+	}
+	tenant, err := db.TenantDbImpl{}.GetTenant(id)
+	return err == nil && tenant.AllowsUsername(username)
+}
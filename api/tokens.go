@@ -0,0 +1,265 @@
+package api
+
+import (
+	"crypto/rand"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// A service account of the tenant together with its tokens
+type ServiceAccount struct {
+	Username string           `json:"username"`
+	Role     db.Role          `json:"role"`
+	Tokens   []db.AccessToken `json:"tokens"`
+}
+
+// Routes managing the personal access tokens of the logged in user and,
+// for admins, the service accounts of the tenant and their tokens
+func RegisterAccessTokenRoutes(router fiber.Router, userDb db.UserDb, tokenDb db.AccessTokenDb) {
+	router.Get("/", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		return c.JSON(tokenDb.GetAccessTokens(username))
+	})
+	router.Post("/", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		user, err := db.GetLoginUser(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		return issueAccessToken(c, *user, user.Username)
+	})
+	router.Delete("/:id", func(c *fiber.Ctx) error {
+		username, err := CheckLoginStatus(c)
+		if err != nil {
+			return c.SendStatus(401)
+		}
+		token, err := tokenDb.GetAccessToken(c.Params("id"))
+		if err == nil && token.Username != username && !managesServiceAccount(c, userDb, token.Username) {
+			err = db.ErrNoResults
+		}
+		if err == nil {
+			err = tokenDb.RevokeAccessToken(token.ID)
+		}
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		recordAdminAction(c, "access_token_revoked", token.Username,
+			map[string]string{"token": token.ID, "name": token.Name})
+		return nil
+	})
+
+	accounts := router.Group("/service-accounts", NewRoleGuard(userDb, db.Admin))
+	accounts.Get("/", func(c *fiber.Ctx) error {
+		list := []ServiceAccount{}
+		for _, user := range userDb.GetTenantUsers(db.RequestTenant(c)) {
+			if user.ServiceAccount {
+				list = append(list, ServiceAccount{
+					Username: db.LocalUsername(user.Username),
+					Role:     user.Role,
+					Tokens:   tokenDb.GetAccessTokens(user.Username),
+				})
+			}
+		}
+		return c.JSON(list)
+	})
+	accounts.Post("/", func(c *fiber.Ctx) error {
+		name := strings.TrimSpace(c.FormValue("name"))
+		if len(name) == 0 {
+			return c.Status(400).SendString("no name")
+		}
+		role, err := strconv.Atoi(c.FormValue("role", strconv.Itoa(int(db.Member))))
+		if err != nil || role < int(db.Admin) || role > int(db.Helpdesk) {
+			return c.Status(400).SendString("invalid role")
+		}
+		username, err := db.QualifyUsername(c, name)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
+		if _, err := userDb.GetUser(username); err == nil {
+			return c.Status(409).SendString("a user with this name already exists")
+		}
+		id := make([]byte, 32)
+		_, err = rand.Read(id)
+		if err != nil {
+			return err
+		}
+
+		user := db.User{ID: id, Username: username, Status: db.Registered, Role: db.Role(role),
+			ServiceAccount: true}
+		err = userDb.CreateUser(user)
+		if err != nil {
+			return err
+		}
+		recordAdminAction(c, "service_account_created", username,
+			map[string]string{"role": user.Role.String()})
+		emitUserEvent(c, webhooks.UserCreated, webhooks.NewUser(user))
+		return c.JSON(ServiceAccount{Username: name, Role: user.Role, Tokens: []db.AccessToken{}})
+	})
+	accounts.Delete("/:username", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		username, err := usernameParam(c)
+		if err != nil {
+			return err
+		}
+		if !managesServiceAccount(c, userDb, username) {
+			return c.SendStatus(404)
+		}
+		err = userDb.DeleteUser(username)
+		if err != nil {
+			log.Err(err)
+			return c.SendStatus(500)
+		}
+		recordAdminAction(c, "service_account_deleted", username, nil)
+		emitUserEvent(c, webhooks.UserDeleted, webhooks.User{Username: username})
+		return nil
+	})
+	accounts.Post("/:username/tokens", NewStepUpGuard(), func(c *fiber.Ctx) error {
+		username, err := usernameParam(c)
+		if err != nil {
+			return err
+		}
+		if !managesServiceAccount(c, userDb, username) {
+			return c.SendStatus(404)
+		}
+		account, err := userDb.GetUser(username)
+		if err != nil {
+			return c.SendStatus(404)
+		}
+		actor, _ := CheckLoginStatus(c)
+		return issueAccessToken(c, *account, actor)
+	})
+}
+
+// Issues a token for the user from the name, scopes and ttl in days of
+// the form, scopes beyond the role of the user are forbidden
+func issueAccessToken(c *fiber.Ctx, user db.User, createdBy string) error {
+	days, err := strconv.Atoi(c.FormValue("ttl", "90"))
+	if err != nil {
+		return c.Status(400).SendString("invalid lifetime")
+	}
+	name := strings.TrimSpace(c.FormValue("name"))
+	if len(name) == 0 {
+		return c.Status(400).SendString("no name")
+	}
+	scopes := []string{}
+	for _, scope := range c.Request().PostArgs().PeekMulti("scopes") {
+		scopes = append(scopes, string(scope))
+	}
+
+	token, record, err := auth.IssueAccessToken(user, createdBy, name, scopes,
+		time.Duration(days)*24*time.Hour)
+	if err != nil {
+		log.Err(err).Msg("failed to issue access token")
+		switch {
+		case errors.Is(err, auth.ErrInvalidAccessTokenTTL), errors.Is(err, auth.ErrInvalidScope),
+			errors.Is(err, auth.ErrNoScope):
+			return c.Status(400).SendString(err.Error())
+		case errors.Is(err, auth.ErrScopeNotAllowed):
+			return c.Status(403).SendString(err.Error())
+		default:
+			return c.SendStatus(500)
+		}
+	}
+	recordAdminAction(c, "access_token_created", user.Username, map[string]string{
+		"token":   record.ID,
+		"name":    record.Name,
+		"scopes":  record.Scopes,
+		"expires": record.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	// The token is only returned when it is created
+	return c.JSON(fiber.Map{"token": token, "accessToken": record})
+}
+
+// Reports whether the logged in user is an admin of the tenant of the
+// service account
+func managesServiceAccount(c *fiber.Ctx, userDb db.UserDb, username string) bool {
+	admin, err := db.GetLoginUser(c)
+	if err != nil || admin.Role != db.Admin {
+		return false
+	}
+	user, err := userDb.GetUser(username)
+	return err == nil && user.ServiceAccount && user.Tenant == db.RequestTenant(c)
+}
+
+// Returns a handler authenticating requests that carry an access token in
+// the Authorization header as the token's user. Requests without one are
+// passed on to the session checks.
+func NewAccessTokenAuth(userDb db.UserDb, tokenDb db.AccessTokenDb) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		bearer, found := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !found {
+			return c.Next()
+		}
+		token, err := auth.AuthenticateAccessToken(bearer)
+		if err == nil && db.TenantOf(token.Username) != db.RequestTenant(c) {
+			err = db.ErrWrongTenant
+		}
+		var user *db.User
+		if err == nil {
+			user, err = userDb.GetIdentity(token.Username)
+		}
+		if err == nil && user.Status == db.Blocked {
+			err = auth.ErrLoginBlocked
+		}
+		if err != nil {
+			log.Info().Err(err).Str("path", c.Path()).Msg("rejected access token")
+			entry := audit.Entry{
+				Action:  "access_denied",
+				Outcome: audit.OutcomeDenied,
+				Details: map[string]string{"method": c.Method(), "path": c.Path(), "error": err.Error()},
+			}
+			if token != nil {
+				entry.Actor = token.Username
+				entry.Details["token"] = token.ID
+			}
+			audit.Record(c, entry)
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return c.Status(401).SendString(auth.ErrInvalidAccessToken.Error())
+		}
+
+		// Uses are recorded at most once a minute
+		if token.LastUsedAt == nil || time.Since(*token.LastUsedAt) > time.Minute {
+			err = tokenDb.TouchAccessToken(token.ID, c.IP())
+			if err != nil {
+				log.Err(err).Msg("failed to record access token use")
+			}
+		}
+		c.Locals(db.AccessTokenLocal, token)
+		c.Locals(db.UserLocal, user)
+		return c.Next()
+	}
+}
+
+// Returns a handler rejecting requests authenticated by an access token
+// without the scope, sessions are only limited by their role
+func NewScopeGuard(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		token, ok := c.Locals(db.AccessTokenLocal).(*db.AccessToken)
+		if !ok || token.HasScope(scope) {
+			return c.Next()
+		}
+		audit.Record(c, audit.Entry{
+			Action:  "access_denied",
+			Actor:   token.Username,
+			Outcome: audit.OutcomeDenied,
+			Details: map[string]string{"method": c.Method(), "path": c.Path(), "token": token.ID, "scope": scope},
+		})
+		return c.Status(403).SendString("access token lacks the " + scope + " scope")
+	}
+}
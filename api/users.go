@@ -4,34 +4,69 @@ import (
 	"crypto/rand"
 	"errors"
 	"net/url"
+	"strconv"
+	"time"
 
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
 	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
 )
 
 func RegisterUserRoutes(router fiber.Router, userDb db.UserDb) {
-	router.Delete("/:username", func(c *fiber.Ctx) error {
-		username, err := url.QueryUnescape(c.Params("username"))
-		log.Print(username)
-		if err != nil {
-			log.Err(err)
-			return err
+	// Takes a JSON array of the U2F keys registered with a previous system
+	router.Post("/import/u2f", NewScopeGuard(db.ScopeUsersAdmin), NewRoleGuard(userDb, db.Admin), func(c *fiber.Ctx) error {
+		var keys []auth.U2FKey
+		if err := c.BodyParser(&keys); err != nil {
+			return c.Status(400).SendString(err.Error())
 		}
-		err = userDb.DeleteUser(username)
+		for i := range keys {
+			username, err := db.QualifyUsername(c, keys[i].Username)
+			if err != nil {
+				return c.Status(400).SendString(err.Error())
+			}
+			keys[i].Username = username
+		}
+		imported, err := auth.ImportU2FKeys(userDb, keys)
 		if err != nil {
-			log.Err(err)
+			log.Err(err).Msg("failed to import U2F keys")
 			switch {
-			case errors.Is(err, db.ErrNoResults):
-				return c.SendStatus(404)
+			case errors.Is(err, auth.ErrInvalidU2FKey):
+				return c.Status(400).SendString(err.Error())
 			default:
 				return c.SendStatus(500)
 			}
 		}
-		return nil
+		recordAdminAction(c, "u2f_keys_imported", "users",
+			map[string]string{"imported": strconv.Itoa(imported), "keys": strconv.Itoa(len(keys))})
+		return c.JSON(fiber.Map{"imported": imported})
 	})
-	router.Post("/:username/block", func(c *fiber.Ctx) error {
-		username, err := url.QueryUnescape(c.Params("username"))
+	router.Delete("/:username", NewScopeGuard(db.ScopeUsersAdmin), NewRoleGuard(userDb, db.Admin), NewStepUpGuard(),
+		NewConfirmationGuard("delete-user", describeUserOperation), func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			log.Print(username)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			err = userDb.DeleteUser(username)
+			if err != nil {
+				log.Err(err)
+				switch {
+				case errors.Is(err, db.ErrNoResults):
+					return c.SendStatus(404)
+				default:
+					return c.SendStatus(500)
+				}
+			}
+			recordAdminAction(c, "user_deleted", username, nil)
+			emitUserEvent(c, webhooks.UserDeleted, webhooks.User{Username: username})
+			return nil
+		})
+	router.Post("/:username/block", NewScopeGuard(db.ScopeUsersWrite), NewRoleGuard(userDb, db.Admin), func(c *fiber.Ctx) error {
+		username, err := usernameParam(c)
 		if err != nil {
 			log.Err(err)
 			return err
@@ -51,12 +86,18 @@ func RegisterUserRoutes(router fiber.Router, userDb db.UserDb) {
 		if err != nil {
 			return err
 		}
+		_, err = userDb.RevokeSessions(user.Username, "")
+		if err != nil {
+			log.Err(err).Msg("failed to revoke sessions of blocked user")
+		}
 		user.Credentials = nil
 		log.Printf("blocked user: %s", user.Username)
+		recordAdminAction(c, "user_blocked", user.Username, nil)
+		emitUserEvent(c, webhooks.UserBlocked, webhooks.NewUser(*user))
 		return c.JSON(user)
 	})
-	router.Post("/:username/unblock", func(c *fiber.Ctx) error {
-		username, err := url.QueryUnescape(c.Params("username"))
+	router.Post("/:username/unblock", NewScopeGuard(db.ScopeUsersWrite), NewRoleGuard(userDb, db.Admin), func(c *fiber.Ctx) error {
+		username, err := usernameParam(c)
 		if err != nil {
 			log.Err(err)
 			return err
@@ -83,18 +124,149 @@ func RegisterUserRoutes(router fiber.Router, userDb db.UserDb) {
 		}
 		user.Credentials = nil
 		log.Printf("unblocked user: %s", user.Username)
+		recordAdminAction(c, "user_unblocked", user.Username, nil)
+		emitUserEvent(c, webhooks.UserUnblocked, webhooks.NewUser(*user))
 		return c.JSON(user)
 	})
+	router.Post("/:username/role", NewScopeGuard(db.ScopeUsersAdmin), NewRoleGuard(userDb, db.Admin),
+		NewStepUpGuard(),
+		NewConfirmationGuard("change-role", describeRoleOperation), func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			role, err := strconv.Atoi(c.FormValue("role"))
+			if err != nil || role < int(db.Admin) || role > int(db.Helpdesk) {
+				return c.Status(400).SendString("invalid role")
+			}
+			user, err := userDb.GetUser(username)
+			if err != nil {
+				log.Err(err)
+				switch {
+				case errors.Is(err, db.ErrNoResults):
+					return c.SendStatus(404)
+				default:
+					return c.SendStatus(500)
+				}
+			}
+			user.Role = db.Role(role)
+			err = userDb.CreateUser(*user)
+			if err != nil {
+				return err
+			}
+			user.Credentials = nil
+			recordAdminAction(c, "role_changed", user.Username,
+				map[string]string{"role": user.Role.String()})
+			emitUserEvent(c, webhooks.UserRoleChanged, webhooks.NewUser(*user))
+			return c.JSON(user)
+		})
+	router.Get("/:username/sessions", NewScopeGuard(db.ScopeUsersRead), NewRoleGuard(userDb, db.Admin, db.Helpdesk),
+		func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			return c.JSON(userDb.GetActiveSessions(username))
+		})
+	router.Delete("/:username/sessions", NewScopeGuard(db.ScopeUsersWrite), NewRoleGuard(userDb, db.Admin, db.Helpdesk),
+		func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			count, err := userDb.RevokeSessions(username, "")
+			if err != nil {
+				log.Err(err)
+				return c.SendStatus(500)
+			}
+			recordAdminAction(c, "sessions_revoked", username,
+				map[string]string{"count": strconv.FormatInt(count, 10)})
+			return c.JSON(fiber.Map{"revoked": count})
+		})
+	router.Delete("/:username/sessions/:id", NewScopeGuard(db.ScopeUsersWrite),
+		NewRoleGuard(userDb, db.Admin, db.Helpdesk),
+		func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			err = userDb.RevokeSession(username, c.Params("id"))
+			if err != nil {
+				log.Err(err)
+				switch {
+				case errors.Is(err, db.ErrNoResults):
+					return c.SendStatus(404)
+				default:
+					return c.SendStatus(500)
+				}
+			}
+			recordAdminAction(c, "session_revoked", username,
+				map[string]string{"session": c.Params("id")})
+			return nil
+		})
+	router.Post("/:username/access-pass", NewScopeGuard(db.ScopeUsersWrite),
+		NewRoleGuard(userDb, db.Admin, db.Helpdesk), NewStepUpGuard(),
+		func(c *fiber.Ctx) error {
+			username, err := usernameParam(c)
+			if err != nil {
+				log.Err(err)
+				return err
+			}
+			minutes, err := strconv.Atoi(c.FormValue("ttl", "60"))
+			if err != nil {
+				return c.Status(400).SendString("invalid lifetime")
+			}
+			issuer, err := CheckLoginStatus(c)
+			if err != nil {
+				return c.SendStatus(401)
+			}
 
-	router.Post("/", func(c *fiber.Ctx) error {
+			code, expires, err := authSvc.IssueAccessPass(username, issuer, auth.AccessPassOptions{
+				TTL:               time.Duration(minutes) * time.Minute,
+				SingleUse:         c.FormValue("singleUse") == "on",
+				RevokeCredentials: c.FormValue("revoke") == "on",
+			})
+			if err != nil {
+				log.Err(err)
+				switch {
+				case errors.Is(err, db.ErrNoResults):
+					return c.SendStatus(404)
+				case errors.Is(err, auth.ErrInvalidAccessPassTTL):
+					return c.Status(400).SendString(err.Error())
+				case errors.Is(err, auth.ErrAccessPassNotAllowed):
+					return c.Status(403).SendString(err.Error())
+				default:
+					return c.SendStatus(500)
+				}
+			}
+			recordAdminAction(c, "access_pass_issued", username, map[string]string{
+				"expires":           expires.UTC().Format(time.RFC3339),
+				"singleUse":         strconv.FormatBool(c.FormValue("singleUse") == "on"),
+				"revokeCredentials": strconv.FormatBool(c.FormValue("revoke") == "on"),
+			})
+			return c.JSON(fiber.Map{"code": code, "expires": expires})
+		})
+
+	router.Post("/", NewScopeGuard(db.ScopeUsersWrite), NewRoleGuard(userDb, db.Admin), func(c *fiber.Ctx) error {
 		username := c.FormValue("username")
 		log.Printf("username: %s", username)
 
 		if len(username) == 0 {
 			return c.Status(400).SendString("no username")
 		}
+		if !tenantAllows(c, username) {
+			return c.Status(400).SendString("username is not in the email domain of the tenant")
+		}
+		username, err := db.QualifyUsername(c, username)
+		if err != nil {
+			return c.Status(400).SendString(err.Error())
+		}
 		id := make([]byte, 32)
-		_, err := rand.Read(id)
+		_, err = rand.Read(id)
 		if err != nil {
 			return err
 		}
@@ -104,7 +276,49 @@ func RegisterUserRoutes(router fiber.Router, userDb db.UserDb) {
 		if err != nil {
 			return err
 		}
+		recordAdminAction(c, "user_created", username, nil)
+		emitUserEvent(c, webhooks.UserCreated, webhooks.NewUser(user))
 
 		return nil
 	})
 }
+
+// Notifies the webhooks of a change the logged in user made to the user
+func emitUserEvent(c *fiber.Ctx, event string, user webhooks.User) {
+	actor, _ := db.ValidateLoginSession(c)
+	webhooks.Emit(event, actor, user)
+}
+
+// Records an action the logged in user performed on the target user
+func recordAdminAction(c *fiber.Ctx, action string, target string, details map[string]string) {
+	actor, _ := db.ValidateLoginSession(c)
+	audit.Record(c, audit.Entry{
+		Action:  action,
+		Actor:   actor,
+		Target:  target,
+		Details: details,
+	})
+}
+
+// Returns the username in the path, as a user of the request's tenant
+func usernameParam(c *fiber.Ctx) (string, error) {
+	username, err := url.QueryUnescape(c.Params("username"))
+	if err != nil {
+		return "", fiber.NewError(400, err.Error())
+	}
+	username, err = db.QualifyUsername(c, username)
+	if err != nil {
+		return "", fiber.NewError(400, err.Error())
+	}
+	return username, nil
+}
+
+func describeUserOperation(c *fiber.Ctx) (string, string) {
+	username, _ := usernameParam(c)
+	return username, ""
+}
+
+func describeRoleOperation(c *fiber.Ctx) (string, string) {
+	username, _ := usernameParam(c)
+	return username, "role=" + c.FormValue("role")
+}
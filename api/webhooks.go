@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin routes managing the webhooks notified of user lifecycle events
+func RegisterWebhookRoutes(router fiber.Router, userDb db.UserDb) {
+	router.Use(NewSuperAdminGuard(userDb))
+	router.Get("/", func(c *fiber.Ctx) error {
+		return c.JSON(webhooks.Webhooks())
+	})
+	router.Post("/", func(c *fiber.Ctx) error {
+		actor, _ := CheckLoginStatus(c)
+		events := []string{}
+		for _, event := range c.Request().PostArgs().PeekMulti("events") {
+			events = append(events, string(event))
+		}
+		webhook, err := webhooks.Create(c.FormValue("url"), c.FormValue("secret"), events, actor)
+		if err != nil {
+			log.Err(err).Msg("failed to create webhook")
+			return c.Status(400).SendString(err.Error())
+		}
+		recordAdminAction(c, "webhook_created", webhook.URL, map[string]string{
+			"events": webhook.Events,
+		})
+		// The secret is only returned when the webhook is created
+		return c.JSON(fiber.Map{
+			"webhook": webhook,
+			"secret":  webhook.Secret,
+		})
+	})
+	router.Delete("/:id", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.SendStatus(400)
+		}
+		err = webhooks.Delete(uint(id))
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		recordAdminAction(c, "webhook_deleted", c.Params("id"), nil)
+		return nil
+	})
+	router.Get("/:id/deliveries", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.SendStatus(400)
+		}
+		return c.JSON(webhooks.Deliveries(uint(id)))
+	})
+	router.Post("/deliveries/:id/redeliver", func(c *fiber.Ctx) error {
+		id, err := strconv.ParseUint(c.Params("id"), 10, 64)
+		if err != nil {
+			return c.SendStatus(400)
+		}
+		delivery, err := webhooks.Redeliver(uint(id))
+		if err != nil {
+			log.Err(err)
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.SendStatus(404)
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		return c.JSON(delivery)
+	})
+}
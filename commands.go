@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks/webhookstest"
+)
+
+const usage = `usage:
+  go-webauthn-htmx                 start the server
+  go-webauthn-htmx audit verify    verify the hash chain of the audit log
+  go-webauthn-htmx audit export    write the audit log to stdout as JSON lines
+  go-webauthn-htmx audit head      print the signed checkpoint of the audit log
+  go-webauthn-htmx webhooks listen <addr> <secret>
+                                   run a receiver printing verified webhook deliveries
+  go-webauthn-htmx u2f import <file>
+                                   import legacy U2F keys from a JSON array of
+                                   {"username", "keyHandle", "publicKey", "counter"}`
+
+// Runs a maintenance command instead of the server and returns the exit code
+func runCommand(args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	switch args[0] {
+	case "audit":
+		return runAuditCommand(args[1:])
+	case "webhooks":
+		return runWebhooksCommand(args[1:])
+	case "u2f":
+		return runU2FCommand(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+func runAuditCommand(args []string) int {
+	switch args[0] {
+	case "verify":
+		count, err := audit.Verify()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "audit log verification failed after %d events: %v\n", count, err)
+			return 1
+		}
+		fmt.Printf("audit log intact, verified %d events\n", count)
+		return 0
+	case "head":
+		checkpoint, err := audit.ReadCheckpoint()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read audit checkpoint: %v\n", err)
+			return 1
+		}
+		b, err := json.Marshal(checkpoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to read audit checkpoint: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(b))
+		return 0
+	case "export":
+		err := audit.Export(db.AuditFilter{}, func(b []byte) error {
+			_, err := os.Stdout.Write(b)
+			return err
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to export audit log: %v\n", err)
+			return 1
+		}
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+func runWebhooksCommand(args []string) int {
+	if args[0] != "listen" || len(args) != 3 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	receiver := webhookstest.NewReceiver(args[2])
+	receiver.OnDelivery = func(d webhookstest.Delivery) {
+		fmt.Printf("%s %s\n", d.ID, d.Body)
+	}
+	fmt.Printf("listening for webhook deliveries on %s\n", args[1])
+	err := http.ListenAndServe(args[1], receiver)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func runU2FCommand(args []string) int {
+	if args[0] != "import" || len(args) != 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var keys []auth.U2FKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid key file: %v\n", err)
+		return 1
+	}
+	imported, err := auth.ImportU2FKeys(db.UserDbImpl{}, keys)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to import U2F keys after %d keys: %v\n", imported, err)
+		return 1
+	}
+	fmt.Printf("imported %d of %d U2F keys\n", imported, len(keys))
+	return 0
+}
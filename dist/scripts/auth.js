@@ -1,36 +1,36 @@
 (function () {
     'use strict';
 
-    /******************************************************************************
-    Copyright (c) Microsoft Corporation.
-
-    Permission to use, copy, modify, and/or distribute this software for any
-    purpose with or without fee is hereby granted.
-
-    THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
-    REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
-    AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
-    INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
-    LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
-    OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
-    PERFORMANCE OF THIS SOFTWARE.
-    ***************************************************************************** */
-    /* global Reflect, Promise, SuppressedError, Symbol */
-
-
-    function __awaiter(thisArg, _arguments, P, generator) {
-        function adopt(value) { return value instanceof P ? value : new P(function (resolve) { resolve(value); }); }
-        return new (P || (P = Promise))(function (resolve, reject) {
-            function fulfilled(value) { try { step(generator.next(value)); } catch (e) { reject(e); } }
-            function rejected(value) { try { step(generator["throw"](value)); } catch (e) { reject(e); } }
-            function step(result) { result.done ? resolve(result.value) : adopt(result.value).then(fulfilled, rejected); }
-            step((generator = generator.apply(thisArg, _arguments || [])).next());
-        });
-    }
-
-    typeof SuppressedError === "function" ? SuppressedError : function (error, suppressed, message) {
-        var e = new Error(message);
-        return e.name = "SuppressedError", e.error = error, e.suppressed = suppressed, e;
+    /******************************************************************************
+    Copyright (c) Microsoft Corporation.
+
+    Permission to use, copy, modify, and/or distribute this software for any
+    purpose with or without fee is hereby granted.
+
+    THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES WITH
+    REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF MERCHANTABILITY
+    AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY SPECIAL, DIRECT,
+    INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES WHATSOEVER RESULTING FROM
+    LOSS OF USE, DATA OR PROFITS, WHETHER IN AN ACTION OF CONTRACT, NEGLIGENCE OR
+    OTHER TORTIOUS ACTION, ARISING OUT OF OR IN CONNECTION WITH THE USE OR
+    PERFORMANCE OF THIS SOFTWARE.
+    ***************************************************************************** */
+    /* global Reflect, Promise, SuppressedError, Symbol */
+
+
+    function __awaiter(thisArg, _arguments, P, generator) {
+        function adopt(value) { return value instanceof P ? value : new P(function (resolve) { resolve(value); }); }
+        return new (P || (P = Promise))(function (resolve, reject) {
+            function fulfilled(value) { try { step(generator.next(value)); } catch (e) { reject(e); } }
+            function rejected(value) { try { step(generator["throw"](value)); } catch (e) { reject(e); } }
+            function step(result) { result.done ? resolve(result.value) : adopt(result.value).then(fulfilled, rejected); }
+            step((generator = generator.apply(thisArg, _arguments || [])).next());
+        });
+    }
+
+    typeof SuppressedError === "function" ? SuppressedError : function (error, suppressed, message) {
+        var e = new Error(message);
+        return e.name = "SuppressedError", e.error = error, e.suppressed = suppressed, e;
     };
 
     /* [@simplewebauthn/browser@8.2.1] */
@@ -406,22 +406,109 @@
         };
     }
 
-    /** This function begins the registration process
-     *  @param {string} usernameEl - username of user to register
-     *  @param {string} statusEl - status element
+    /** Returns the CSRF token of the page, it has to be sent in the
+     *  X-CSRF-Token header of every state changing request */
+    function csrfToken() {
+        const meta = document.querySelector('meta[name="csrf-token"]');
+        return meta ? meta.content : "";
+    }
+    /** Key the PRF output of the last login is kept under in sessionStorage */
+    const prfStorageKey = "webauthn-prf";
+    function base64URLToBuffer(value) {
+        const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+        const binary = atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, "="));
+        return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer;
+    }
+    function bufferToBase64URL(buffer) {
+        const binary = String.fromCharCode(...new Uint8Array(buffer));
+        return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=/g, "");
+    }
+    /** Runs an authentication ceremony with the extensions the server asked
+     *  for. Their binary outputs stay in the browser, the PRF output is kept in
+     *  sessionStorage and dispatched as a webauthnPRF event for application
+     *  level encryption, the server only learns what the authenticator did.
+     *  @param {any} publicKey - request options returned by the server
+     *  @param {BufferSource} blob - data to write when a large blob write was requested
+     *  @returns the response for the server and the large blob that was read
      */
-    function register(usernameEl, statusEl, btnId) {
+    function authenticate(publicKey, blob) {
         return __awaiter(this, void 0, void 0, function* () {
-            const usernameInput = document.getElementById(usernameEl);
-            const statusLabel = document.getElementById(statusEl);
-            document.getElementById(btnId);
-            const resp = yield fetch(`/auth/register/begin/${usernameInput.value}`);
+            const extensions = publicKey.extensions || {};
+            if (extensions.prf && extensions.prf.eval) {
+                extensions.prf.eval.first = base64URLToBuffer(extensions.prf.eval.first);
+            }
+            if (extensions.largeBlob && "write" in extensions.largeBlob) {
+                extensions.largeBlob.write = blob;
+            }
+            const response = yield startAuthentication(publicKey);
+            const results = response.clientExtensionResults;
+            let read = null;
+            if (results.prf) {
+                if (results.prf.results) {
+                    const output = results.prf.results.first;
+                    sessionStorage.setItem(prfStorageKey, bufferToBase64URL(output));
+                    document.dispatchEvent(new CustomEvent("webauthnPRF", { detail: output }));
+                }
+                results.prf = { enabled: !!results.prf.results };
+            }
+            if (results.largeBlob) {
+                read = results.largeBlob.blob || null;
+                results.largeBlob = { written: !!results.largeBlob.written };
+            }
+            return { response, blob: read };
+        });
+    }
+    /** Runs a login ceremony for the logged in user that reads or writes the
+     *  large blob of the credential
+     *  @param {string} op - read or write
+     *  @param {BufferSource} data - data to write
+     */
+    function largeBlob(op, data) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const status = yield fetch("/auth/status");
+            const username = yield status.text();
+            if (!status.ok || username.length === 0) {
+                throw new Error("not logged in");
+            }
+            const resp = yield fetch(`/auth/generate-authentication-options/${username}?largeBlob=${op}`);
             if (!resp.ok) {
-                clearClasslist([usernameInput, statusLabel]);
-                usernameInput.classList.add("input-error");
-                statusLabel.classList.add("text-error");
-                statusLabel.innerHTML = yield resp.text();
-                return;
+                throw new Error(yield resp.text());
+            }
+            const options = (yield resp.json());
+            const { response, blob } = yield authenticate(options.publicKey, data);
+            const result = yield fetch(`/auth/verify-authentication/${username}`, {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: JSON.stringify(response),
+            });
+            if (!result.ok) {
+                throw new Error(yield result.text());
+            }
+            const results = response.clientExtensionResults;
+            return { blob, written: !!results.largeBlob && results.largeBlob.written };
+        });
+    }
+    /** Reads the large blob stored on the authenticator of the logged in user
+     *  @returns the blob, null when the authenticator has none
+     */
+    window.readLargeBlob = () => __awaiter(void 0, void 0, void 0, function* () { return (yield largeBlob("read")).blob; });
+    /** Stores data in the large blob of the authenticator of the logged in user
+     *  @param {BufferSource} data - data to store
+     *  @returns whether the authenticator stored it
+     */
+    window.writeLargeBlob = (data) => __awaiter(void 0, void 0, void 0, function* () { return (yield largeBlob("write", data)).written; });
+    /** Runs the registration ceremony for the user and returns the response
+     *  of the request that failed or the final verification request
+     *  @param {string} username - username of user to register
+     */
+    function registerCredential(username) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const resp = yield fetch(`/auth/register/begin/${username}`);
+            if (!resp.ok) {
+                return resp;
             }
             const registrationOptions = (yield resp.json()).publicKey;
             let attResp;
@@ -439,13 +526,26 @@
                 }
                 throw error;
             }
-            const result = yield fetch(`/auth/verify-registration/${usernameInput.value}`, {
+            return fetch(`/auth/verify-registration/${username}`, {
                 method: "POST",
                 headers: {
                     "Content-Type": "application/json",
+                    "X-CSRF-Token": csrfToken(),
                 },
                 body: JSON.stringify(attResp),
             });
+        });
+    }
+    /** This function begins the registration process
+     *  @param {string} usernameEl - username of user to register
+     *  @param {string} statusEl - status element
+     */
+    function register(usernameEl, statusEl, btnId) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const usernameInput = document.getElementById(usernameEl);
+            const statusLabel = document.getElementById(statusEl);
+            document.getElementById(btnId);
+            const result = yield registerCredential(usernameInput.value);
             if (!result.ok) {
                 clearClasslist([usernameInput, statusLabel]);
                 usernameInput.classList.add("input-error");
@@ -457,21 +557,26 @@
                 usernameInput.classList.add("input-success");
                 statusLabel.classList.add("text-success");
                 statusLabel.innerHTML = "Success! You can now login.";
+                showRecoveryCodes(statusLabel, (yield result.json()).recoveryCodes);
             }
         });
     }
     window.registerClick = register;
     function login(usernameEl, statusEl, btnId) {
+        var _a;
         return __awaiter(this, void 0, void 0, function* () {
             const usernameInput = document.getElementById(usernameEl);
             const statusLabel = document.getElementById(statusEl);
             const btn = document.getElementById(btnId);
+            const rememberInput = document.getElementById("rememberInput");
+            const remember = rememberInput !== null && rememberInput.checked;
             const fetchLoginOptions = (username) => __awaiter(this, void 0, void 0, function* () { return fetch(`/auth/generate-authentication-options/${username}`); });
             const verifyLogin = (attResp, username) => __awaiter(this, void 0, void 0, function* () {
-                return fetch(`/auth/verify-authentication/${username}`, {
+                return fetch(`/auth/verify-authentication/${username}?remember=${remember}`, {
                     method: "POST",
                     headers: {
                         "Content-Type": "application/json",
+                        "X-CSRF-Token": csrfToken(),
                     },
                     body: JSON.stringify(attResp),
                 });
@@ -485,7 +590,20 @@
                 return;
             }
             const options = (yield resp.json());
-            let loginResp = yield startAuthentication(options.publicKey);
+            let loginResp;
+            try {
+                loginResp = (yield authenticate(options.publicKey)).response;
+            }
+            catch (error) {
+                // Unknown usernames get credentials no authenticator has, so this is
+                // reported like any other failed login
+                console.log(error);
+                clearClasslist([usernameInput, statusLabel]);
+                usernameInput.classList.add("input-error");
+                statusLabel.classList.add("text-error");
+                statusLabel.innerHTML = "Authentication failed";
+                return;
+            }
             let result = yield verifyLogin(loginResp, usernameInput.value);
             if (!result.ok) {
                 clearClasslist([usernameInput, statusLabel]);
@@ -500,10 +618,185 @@
                 statusLabel.classList.add("text-success");
                 statusLabel.innerHTML = "Success! Redirecting...";
             }
+            // Logins with legacy U2F keys are sent on to replace the key
+            if ((_a = result.headers.get("Content-Type")) === null || _a === void 0 ? void 0 : _a.startsWith("application/json")) {
+                window.location.href = (yield result.json()).upgrade;
+                return;
+            }
             btn.dispatchEvent(new Event("refreshModal"));
         });
     }
     window.loginClick = login;
+    /** Registers a passkey replacing the legacy U2F keys of the logged in user
+     *  @param {string} statusEl - status element
+     */
+    function upgrade(statusEl, btnId) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const statusLabel = document.getElementById(statusEl);
+            const btn = document.getElementById(btnId);
+            const resp = yield fetch("/api/account/upgrade/begin");
+            if (!resp.ok) {
+                statusLabel.innerHTML = yield resp.text();
+                return;
+            }
+            let attResp;
+            try {
+                attResp = yield startRegistration((yield resp.json()).publicKey);
+            }
+            catch (error) {
+                console.log(error);
+                statusLabel.innerHTML = "Registration was cancelled";
+                return;
+            }
+            const result = yield fetch("/api/account/upgrade/finish", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: JSON.stringify(attResp),
+            });
+            if (!result.ok) {
+                statusLabel.innerHTML = yield result.text();
+                return;
+            }
+            btn.disabled = true;
+            window.location.reload();
+        });
+    }
+    window.upgradeClick = upgrade;
+    /** Re-authenticates the logged in user when the server requires a recent
+     *  assertion for a sensitive operation and then retries the original request
+     *  @param {Event} evt - stepUpRequired event triggered by the server
+     */
+    function stepUp(evt) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const detail = evt.detail;
+            const status = yield fetch("/auth/status");
+            const username = yield status.text();
+            if (!status.ok || username.length === 0) {
+                window.location.href = "/login";
+                return;
+            }
+            const resp = yield fetch(`/auth/generate-authentication-options/${username}`);
+            if (!resp.ok) {
+                console.log(yield resp.text());
+                return;
+            }
+            const options = (yield resp.json());
+            const loginResp = (yield authenticate(options.publicKey)).response;
+            const result = yield fetch(`/auth/verify-authentication/${username}`, {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: JSON.stringify(loginResp),
+            });
+            if (!result.ok) {
+                console.log(yield result.text());
+                return;
+            }
+            htmx.ajax(detail.method, detail.path, { source: evt.target });
+        });
+    }
+    document.addEventListener("stepUpRequired", stepUp);
+    /** Signs the operation described by the server with the passkey of the
+     *  logged in user and retries the original request with the confirmation
+     *  @param {Event} evt - confirmationRequired event triggered by the server
+     */
+    function confirmOperation(evt) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const detail = evt.detail;
+            const resp = yield fetch("/api/confirmations", {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: new URLSearchParams({
+                    action: detail.action,
+                    target: detail.target,
+                    details: detail.details,
+                }),
+            });
+            if (!resp.ok) {
+                console.log(yield resp.text());
+                return;
+            }
+            const confirmation = (yield resp.json());
+            const assertion = yield startAuthentication(confirmation.publicKey);
+            const result = yield fetch(`/api/confirmations/${confirmation.id}`, {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/json",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: JSON.stringify(assertion),
+            });
+            if (!result.ok) {
+                console.log(yield result.text());
+                return;
+            }
+            htmx.ajax(detail.method, detail.path, {
+                source: evt.target,
+                headers: { "X-Confirmation": confirmation.id },
+            });
+        });
+    }
+    document.addEventListener("confirmationRequired", confirmOperation);
+    /** Redeems a recovery code and registers a new passkey for the account
+     *  @param {string} usernameEl - username of the account to recover
+     *  @param {string} codeEl - recovery code element
+     *  @param {string} statusEl - status element
+     */
+    function recover(usernameEl, codeEl, statusEl, btnId) {
+        return __awaiter(this, void 0, void 0, function* () {
+            const usernameInput = document.getElementById(usernameEl);
+            const codeInput = document.getElementById(codeEl);
+            const statusLabel = document.getElementById(statusEl);
+            const btn = document.getElementById(btnId);
+            const resp = yield fetch(`/auth/recover/${usernameInput.value}`, {
+                method: "POST",
+                headers: {
+                    "Content-Type": "application/x-www-form-urlencoded",
+                    "X-CSRF-Token": csrfToken(),
+                },
+                body: new URLSearchParams({ code: codeInput.value }),
+            });
+            if (!resp.ok) {
+                clearClasslist([usernameInput, codeInput, statusLabel]);
+                codeInput.classList.add("input-error");
+                statusLabel.classList.add("text-error");
+                statusLabel.innerHTML = yield resp.text();
+                return;
+            }
+            const result = yield registerCredential(usernameInput.value);
+            if (!result.ok) {
+                clearClasslist([usernameInput, codeInput, statusLabel]);
+                statusLabel.classList.add("text-error");
+                statusLabel.innerHTML = yield result.text();
+                return;
+            }
+            clearClasslist([usernameInput, codeInput, statusLabel]);
+            codeInput.classList.add("input-success");
+            statusLabel.classList.add("text-success");
+            statusLabel.innerHTML =
+                'Success! A new passkey has been registered. <a class="link" href="/">Continue</a>';
+            btn.disabled = true;
+            showRecoveryCodes(statusLabel, (yield result.json()).recoveryCodes);
+        });
+    }
+    window.recoverClick = recover;
+    function showRecoveryCodes(statusLabel, codes) {
+        if (!codes || codes.length === 0) {
+            return;
+        }
+        const list = codes.map((code) => `<li>${code}</li>`).join("");
+        statusLabel.innerHTML +=
+            "<br/>Save these recovery codes somewhere safe, they will not be shown again:" +
+                `<ul class="font-mono">${list}</ul>`;
+    }
     function clearClasslist(elements) {
         elements.forEach((x) => (x.classList.value = x.classList.value
             .split(" ")
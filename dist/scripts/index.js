@@ -5,5 +5,28 @@
         el.outerHTML = `<div id="${el.id}" class="hidden transition ease-out"></div>`;
     }
     window.removeClick = removeClick;
+    /** htmx does not swap error responses, except those the server retargets
+     *  to the toast, like requests rejected by the CSRF check */
+    document.addEventListener("htmx:beforeSwap", (evt) => {
+        const xhr = evt.detail.xhr;
+        if (xhr.status >= 400 && xhr.getResponseHeader("HX-Retarget") === "#toast") {
+            evt.detail.shouldSwap = true;
+            evt.detail.isError = false;
+        }
+    });
+    /** Inline event handlers are blocked by the Content Security Policy, so
+     *  elements name the window function to call on click in data-click and
+     *  the ids of its elements in data-click-args, without args the element
+     *  itself is passed */
+    document.addEventListener("click", (evt) => {
+        const el = evt.target.closest("[data-click]");
+        if (!el)
+            return;
+        const handler = window[el.dataset.click];
+        if (typeof handler !== "function")
+            return;
+        const args = el.dataset.clickArgs ? el.dataset.clickArgs.split(" ") : [el];
+        handler(...args);
+    });
 
 })();
@@ -2,7 +2,15 @@ package internal
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"mime"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
 
 	brevo "github.com/getbrevo/brevo-go/lib"
 	"github.com/rs/zerolog/log"
@@ -11,27 +19,100 @@ import (
 	"github.com/spf13/viper"
 )
 
+var ErrEmailNotConfigured = errors.New("no email provider has been configured")
+
+// Sender of emails. With an SMTP host the emails are sent through that
+// server, otherwise through the configured providers under the sender's
+// name and address.
+type Sender struct {
+	Name         string
+	Email        string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+}
+
+var DefaultSender = Sender{Name: "emailsender", Email: "emailsender@simonmalm.com"}
+
 func SendEmail(recipientEmail string, recipientName string, link string) error {
-	apiKey := viper.Get("SENDGRID_API_KEY").(string)
+	content := fmt.Sprintf("To complete the registration go to link: %v", link)
+	return send(DefaultSender, recipientEmail, recipientName, "Registration", content)
+}
 
-	from := mail.NewEmail("emailsender", "emailsender@simonmalm.com")
-	subject := "Registration"
+// Sends a security notification, e.g. when a recovery code has been used,
+// to the input recipient
+func SendNotification(sender Sender, recipientEmail string, subject string, content string) error {
+	if len(sender.Email) == 0 {
+		sender.Email = DefaultSender.Email
+	}
+	if len(sender.Name) == 0 {
+		sender.Name = DefaultSender.Name
+	}
+	if len(sender.SMTPHost) > 0 {
+		return sendSMTP(sender, recipientEmail, subject, content)
+	}
+	return send(sender, recipientEmail, recipientEmail, subject, content)
+}
+
+// Sends the email through the SMTP server of the sender, upgrading the
+// connection with STARTTLS when the server offers it
+func sendSMTP(sender Sender, recipientEmail string, subject string, content string) error {
+	port := sender.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	var auth smtp.Auth
+	if len(sender.SMTPUsername) > 0 {
+		auth = smtp.PlainAuth("", sender.SMTPUsername, sender.SMTPPassword, sender.SMTPHost)
+	}
+	from := (&netmail.Address{Name: sender.Name, Address: sender.Email}).String()
+	message := strings.Join([]string{
+		"From: " + from,
+		"To: " + recipientEmail,
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		content,
+	}, "\r\n")
+	err := smtp.SendMail(net.JoinHostPort(sender.SMTPHost, strconv.Itoa(port)), auth,
+		sender.Email, []string{recipientEmail}, []byte(message))
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("host", sender.SMTPHost).Msg("Succeeded in sending email over smtp")
+	return nil
+}
+
+func send(sender Sender, recipientEmail string, recipientName string, subject string, content string) error {
+	apiKey := viper.GetString("SENDGRID_API_KEY")
+	if len(apiKey) == 0 {
+		return brevoFallback(sender, recipientEmail, recipientName, subject, content,
+			ErrEmailNotConfigured)
+	}
+
+	from := mail.NewEmail(sender.Name, sender.Email)
 	to := mail.NewEmail(recipientName, recipientEmail)
-	plainTextContent := fmt.Sprintf("To complete the registration go to link: %v", link)
 	htmlContent := ""
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
+	message := mail.NewSingleEmail(from, subject, to, content, htmlContent)
 	client := sendgrid.NewSendClient(apiKey)
 	response, err := client.Send(message)
 	if err != nil {
-		return brevoFallback(recipientEmail, recipientName, link, err)
+		return brevoFallback(sender, recipientEmail, recipientName, subject, content, err)
 	}
 
 	log.Debug().Msgf("Succeeded in sending email: %v", response)
 	return nil
 }
 
-func brevoFallback(recipientEmail string, recipientName string, link string, incomingErr error) error {
-	apiKey := viper.Get("BREVO_API_KEY").(string)
+func brevoFallback(sender Sender, recipientEmail string, recipientName string, subject string,
+	content string, incomingErr error) error {
+	apiKey := viper.GetString("BREVO_API_KEY")
+	if len(apiKey) == 0 {
+		return incomingErr
+	}
 	var ctx context.Context
 	cfg := brevo.NewConfiguration()
 
@@ -41,16 +122,16 @@ func brevoFallback(recipientEmail string, recipientName string, link string, inc
 
 	message := brevo.SendSmtpEmail{
 		Sender: &brevo.SendSmtpEmailSender{
-			Name:  "emailsender",
-			Email: "emailsender@simonmalm.com",
+			Name:  sender.Name,
+			Email: sender.Email,
 		},
 		To: []brevo.SendSmtpEmailTo{{
 			Email: recipientEmail,
 			Name:  recipientName,
 		}},
-		HtmlContent: fmt.Sprintf("To complete the registration go to link: %v", link),
+		HtmlContent: content,
 		TextContent: "",
-		Subject:     "Registration",
+		Subject:     subject,
 		ReplyTo: &brevo.SendSmtpEmailReplyTo{
 			Email: "no-reply@simonmalm.com",
 			Name:  "no-reply",
@@ -2,17 +2,27 @@ package main
 
 import (
 	"embed"
+	"encoding/base64"
 	"io/fs"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/a19simma/go-webauthn-htmx/api"
+	auth "github.com/a19simma/go-webauthn-htmx/pkg"
+	"github.com/a19simma/go-webauthn-htmx/pkg/aaguid"
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
 	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/mds"
 	"github.com/a19simma/go-webauthn-htmx/pkg/middleware"
+	"github.com/a19simma/go-webauthn-htmx/pkg/policy"
+	"github.com/a19simma/go-webauthn-htmx/pkg/ratelimit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/filesystem"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/gofiber/template/html/v2"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -33,13 +43,46 @@ type Config struct {
 	AdminEmail  string `mapstructure:"AUTH_ADMIN_EMAIL"`
 	LogLevel    string `mapstructure:"AUTH_LOGLEVEL"`
 	Env         string `mapstructure:"AUTH_ENV"`
-	Origin      string `mapstructure: "AUTH_ORIGIN"`
+	Origin      string `mapstructure:"AUTH_ORIGIN"`
 }
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
 	viper.SetDefault("Env", "Dev")
+	viper.SetDefault("AUTH_CONFIRM_ACTIONS", "delete-user")
+	viper.SetDefault("AUTH_RPID", "localhost")
+	viper.SetDefault("AUTH_RP_DISPLAY_NAME", "Go Webauthn")
+	viper.SetDefault("AUTH_SESSION_IDLE_TIMEOUT", "1h")
+	viper.SetDefault("AUTH_SESSION_ABSOLUTE_TIMEOUT", "12h")
+	viper.SetDefault("AUTH_SESSION_REMEMBER_IDLE_TIMEOUT", "168h")
+	viper.SetDefault("AUTH_SESSION_REMEMBER_ABSOLUTE_TIMEOUT", "720h")
+	viper.SetDefault("AUTH_STORAGE", "sqlite")
+	viper.SetDefault("AUTH_SESSION_MODE", "store")
+	viper.SetDefault("AUTH_IDENTITY_CACHE_TTL", "30s")
+	viper.SetDefault("AUTH_STEP_UP_MAX_AGE", "5m")
+	viper.SetDefault("AUTH_SESSION_REVOCATION_SYNC", "10s")
+	viper.SetDefault("AUTH_RATELIMIT_IP", "30/1m")
+	viper.SetDefault("AUTH_RATELIMIT_USERNAME", "10/1m")
+	viper.SetDefault("AUTH_RATELIMIT_GLOBAL", "600/1m")
+	viper.SetDefault("AUTH_LOCKOUT_THRESHOLD", 5)
+	viper.SetDefault("AUTH_LOCKOUT_IP_THRESHOLD", 20)
+	viper.SetDefault("AUTH_LOCKOUT_WINDOW", "15m")
+	viper.SetDefault("AUTH_LOCKOUT_DURATION", "5m")
+	viper.SetDefault("AUTH_ENUMERATION_PROTECTION", false)
+	viper.SetDefault("AUTH_ENUMERATION_MIN_LATENCY", "250ms")
+	viper.SetDefault("AUTH_HSTS_MAX_AGE", 31536000)
+	viper.SetDefault("AUTH_MDS_BLOB", "mds.jwt")
+	viper.SetDefault("AUTH_MDS_RELOAD_INTERVAL", "10m")
+	viper.SetDefault("AUTH_MDS_REQUIRE_ATTESTATION", false)
+	viper.SetDefault("AUTH_EXTENSIONS_CRED_PROPS", true)
+	viper.SetDefault("AUTH_EXTENSIONS_PRF", false)
+	viper.SetDefault("AUTH_EXTENSIONS_LARGE_BLOB", false)
+	viper.SetDefault("AUTH_AUDIT_BUFFER", 1000)
+	viper.SetDefault("AUTH_AUDIT_RETRIES", 5)
+	viper.SetDefault("AUTH_AUDIT_CHECKPOINT", "audit-head.json")
+	viper.SetDefault("AUTH_AUDIT_FILE_MAX_SIZE", 100)
+	viper.SetDefault("AUTH_AUDIT_FILE_MAX_BACKUPS", 10)
 	viper.SetConfigFile("dev.env")
 	err := viper.ReadInConfig()
 	if err != nil {
@@ -61,8 +104,26 @@ func main() {
 
 	}
 
-	db.Init()
 	userDb := db.InitUsers()
+	db.Init()
+	audit.Init(db.InitAudit())
+	webhooks.Init(db.InitWebhooks())
+	ratelimit.Init(db.InitLockouts())
+	tenantDb := db.InitTenants()
+	tokenDb := db.InitAccessTokens()
+	auth.InitAccessTokens(tokenDb)
+	mds.Init()
+	policy.Init()
+	aaguid.Init()
+
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+	audit.ConfigureSinks()
+	if len(viper.GetString("AUTH_AUDIT_CHECKPOINT_KEY")) == 0 {
+		log.Warn().Msg("AUTH_AUDIT_CHECKPOINT_KEY is not set, the audit log cannot be verified")
+	}
+
 	files, err := fs.Sub(viewsFilesystem, "views")
 	if err != nil {
 		log.Error().Msg("Failed to open subdir of filesystem")
@@ -74,16 +135,66 @@ func main() {
 		engine.Debug(true)
 	}
 	engine.AddFuncMap(sprig.FuncMap())
+	engine.AddFunc("base64url", base64.RawURLEncoding.EncodeToString)
+	engine.AddFunc("authenticatorIcon", aaguid.IconURL)
+	engine.AddFunc("localUsername", db.LocalUsername)
 
 	app := fiber.New(fiber.Config{
 		Views: engine,
+		// Behind a load balancer the client IP is taken from this header
+		ProxyHeader: viper.GetString("AUTH_PROXY_HEADER"),
+		// Makes the CSRF token and the brand available to the templates
+		PassLocalsToViews: true,
 	})
 
+	// Read through viper, as Unmarshal does not see variables only set in the
+	// environment
+	origin := viper.GetString("AUTH_ORIGIN")
+
+	app.Use(requestid.New())
 	app.Use(middleware.NewLoggerMiddleWare())
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*",
-		AllowHeaders: "*",
+	app.Use(auth.NewTenantMiddleware(tenantDb))
+	app.Use(middleware.NewSecurityHeadersMiddleware(middleware.SecurityHeadersConfig{
+		Secure:         strings.HasPrefix(origin, "https://"),
+		HSTSMaxAge:     viper.GetInt("AUTH_HSTS_MAX_AGE"),
+		FrameAncestors: strings.Fields(viper.GetString("AUTH_FRAME_ANCESTORS")),
 	}))
+	corsOrigins := []string{}
+	for _, origin := range strings.Split(viper.GetString("AUTH_CORS_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			corsOrigins = append(corsOrigins, origin)
+		}
+	}
+	if len(corsOrigins) > 0 {
+		app.Use(cors.New(cors.Config{
+			AllowOrigins:     strings.Join(corsOrigins, ","),
+			AllowHeaders:     "Content-Type, HX-Request, HX-Target, HX-Trigger, HX-Current-URL, X-Confirmation, " + middleware.CSRFHeader,
+			AllowCredentials: true,
+		}))
+	}
+	trustedOrigins := append([]string{}, corsOrigins...)
+	if origin != "" {
+		trustedOrigins = append(trustedOrigins, origin)
+	}
+	app.Use(middleware.NewCSRFMiddleware(middleware.CSRFConfig{
+		TrustedOrigins: trustedOrigins,
+		Secure:         strings.HasPrefix(origin, "https://"),
+		// Browsers do not attach bearer tokens on their own, so clients
+		// sending them cannot be forged
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		},
+		ErrorHandler: func(c *fiber.Ctx) error {
+			if c.Get("HX-Request") != "true" {
+				return c.SendString("Forbidden, the request did not pass the CSRF check")
+			}
+			c.Set("HX-Retarget", "#toast")
+			c.Set("HX-Reswap", "outerHTML")
+			return c.Render("components/errorToast", "Your session has expired, reload the page and try again")
+		},
+	}))
+
+	app.Use(auth.NewBrandMiddleware())
 
 	dist, err := fs.Sub(dist, "dist")
 	if err != nil {
@@ -103,6 +214,9 @@ func main() {
 		log.Err(err)
 	}
 
+	app.Get("/.well-known/webauthn", auth.RelatedOriginsHandler)
+	// Icons of the aaguid catalogue, served as files so browsers cache them
+	app.Get("/assets/authenticators/:aaguid", aaguid.IconHandler)
 	app.Use("/assets", filesystem.New(filesystem.Config{
 		Root: http.FS(assets),
 	}))
@@ -115,19 +229,16 @@ func main() {
 
 	app.Get("/login", func(c *fiber.Ctx) error {
 		username, err := api.CheckLoginStatus(c)
-		status := struct {
-			Status   bool
-			Username string
-		}{
-			Status: false,
+		status := fiber.Map{
+			"Status": false,
 		}
 		if err != nil {
 			log.Print(err)
 			log.Printf("login status: %v", status)
 			return c.Render("login", status)
 		}
-		status.Username = username
-		status.Status = true
+		status["Username"] = username
+		status["Status"] = true
 
 		return c.Render("login", status)
 	})
@@ -135,23 +246,102 @@ func main() {
 	api.RegisterHXRoutes(app.Group("/hx"))
 
 	api.RegisterAuthRoutes(app.Group("/auth"), &userDb)
+	api.RegisterScimRoutes(app.Group("/scim/v2"), &userDb)
 
+	// Lets API clients call the user routes with an access token in place
+	// of a session
+	app.Use("/api/users", api.NewAccessTokenAuth(&userDb, tokenDb))
 	app.Use(api.NewLoginRedirect())
 
 	api.RegisterUserRoutes(app.Group("/api/users"), &userDb)
+	api.RegisterAccountRoutes(app.Group("/api/account"), &userDb)
+	api.RegisterConfirmationRoutes(app.Group("/api/confirmations"), &userDb)
+	api.RegisterAuditRoutes(app.Group("/api/audit"), &userDb)
+	api.RegisterWebhookRoutes(app.Group("/api/webhooks"), &userDb)
+	api.RegisterLockoutRoutes(app.Group("/api/lockouts"), &userDb)
+	api.RegisterMetadataRoutes(app.Group("/api/metadata"), &userDb)
+	api.RegisterPolicyRoutes(app.Group("/api/policy"), &userDb)
+	api.RegisterTenantRoutes(app.Group("/api/tenants"), &userDb, tenantDb)
+	api.RegisterAccessTokenRoutes(app.Group("/api/tokens"), &userDb, tokenDb)
 
-	app.Get("/", func(c *fiber.Ctx) error {
-		users := userDb.GetUsers()
-		for _, v := range users {
-			log.Print(v.ID)
-			log.Print(v.Status)
-			log.Print(v.Username)
-			log.Print(v.Role)
+	app.Get("/account", func(c *fiber.Ctx) error {
+		username, err := api.CheckLoginStatus(c)
+		if err != nil {
+			return c.Redirect("/login", 302)
+		}
+		user, err := userDb.GetUser(username)
+		if err != nil {
+			return err
+		}
+		legacy := false
+		for _, credential := range user.Credentials {
+			legacy = legacy || auth.IsLegacyCredential(credential)
 		}
-		return c.Render("layout", struct {
-			Accounts []db.User
-			Title    string
-		}{users, "Manage Accounts"})
+		return c.Render("account", fiber.Map{
+			"Title":         "Account",
+			"Username":      user.Username,
+			"Legacy":        legacy,
+			"RecoveryCodes": len(userDb.GetRecoveryCodes(*user)),
+			"Credentials":   user.Credentials,
+			"Sessions": api.SessionTable{
+				Sessions:  userDb.GetActiveSessions(username),
+				Current:   db.CurrentSessionID(c),
+				RevokeURL: "/api/account/sessions",
+			},
+		})
+	})
+
+	app.Get("/audit", api.NewSuperAdminGuard(&userDb), func(c *fiber.Ctx) error {
+		return c.Render("audit", fiber.Map{"Title": "Audit Log"})
+	})
+
+	app.Get("/webhooks", api.NewSuperAdminGuard(&userDb), func(c *fiber.Ctx) error {
+		return c.Render("webhooks", fiber.Map{
+			"Title":  "Webhooks",
+			"Events": webhooks.Events,
+		})
+	})
+
+	app.Get("/lockouts", api.NewSuperAdminGuard(&userDb), func(c *fiber.Ctx) error {
+		return c.Render("lockouts", fiber.Map{"Title": "Lockouts"})
+	})
+
+	app.Get("/metadata", api.NewSuperAdminGuard(&userDb), func(c *fiber.Ctx) error {
+		return c.Render("metadata", fiber.Map{"Title": "Authenticator Metadata"})
+	})
+
+	app.Get("/policy", api.NewRoleGuard(&userDb, db.Admin), func(c *fiber.Ctx) error {
+		return c.Render("policy", fiber.Map{
+			"Title":    "Authenticator Policy",
+			"Policies": []policy.Policy{policy.For(db.Admin), policy.For(db.Member), policy.For(db.Helpdesk)},
+		})
+	})
+
+	app.Get("/tenants", api.NewSuperAdminGuard(&userDb), func(c *fiber.Ctx) error {
+		return c.Render("tenants", fiber.Map{"Title": "Tenants"})
+	})
+
+	app.Get("/tokens", func(c *fiber.Ctx) error {
+		user, err := db.GetLoginUser(c)
+		if err != nil {
+			return c.Redirect("/login", 302)
+		}
+		return c.Render("tokens", fiber.Map{
+			"Title": "Access Tokens",
+			"Admin": user.Role == db.Admin,
+			// Personal tokens are limited to the scopes of the role, the
+			// tokens of service accounts to those of the account's role
+			"Scopes":        db.RoleScopes(user.Role),
+			"AccountScopes": db.AccessTokenScopes,
+		})
+	})
+
+	app.Get("/", func(c *fiber.Ctx) error {
+		users := userDb.GetTenantUsers(db.RequestTenant(c))
+		return c.Render("layout", fiber.Map{
+			"Accounts": users,
+			"Title":    "Manage Accounts",
+		})
 	})
 
 	log.Fatal().Err(app.Listen(":4200"))
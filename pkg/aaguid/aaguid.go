@@ -0,0 +1,159 @@
+package aaguid
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Path of the generic icon shown for authenticators without one
+const DefaultIcon = "/assets/authenticator.svg"
+
+var (
+	ErrInvalidIcon = errors.New("invalid authenticator icon")
+
+	//go:embed aaguids.json
+	embedded []byte
+
+	mu        sync.RWMutex
+	catalogue = map[string]Authenticator{}
+)
+
+// An entry of the catalogue, in the format of the community passkey
+// provider list at https://github.com/passkeydeveloper/passkey-authenticator-aaguids
+type Authenticator struct {
+	Name string `json:"name"`
+	// Icons as data URLs, for dark and light backgrounds
+	IconDark  string `json:"icon_dark,omitempty"`
+	IconLight string `json:"icon_light,omitempty"`
+}
+
+// Loads the embedded catalogue and the one at AUTH_AAGUID_CATALOGUE, whose
+// entries take precedence. The community list can be downloaded to the path
+// to keep the names and icons up to date.
+func Init() {
+	entries, err := parse(embedded)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid embedded aaguid catalogue")
+	}
+	if path := viper.GetString("AUTH_AAGUID_CATALOGUE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("failed to read aaguid catalogue")
+		}
+		updates, err := parse(data)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("invalid aaguid catalogue")
+		}
+		for aaguid, authenticator := range updates {
+			entries[aaguid] = authenticator
+		}
+	}
+	mu.Lock()
+	catalogue = entries
+	mu.Unlock()
+	log.Info().Int("authenticators", len(entries)).Msg("aaguid catalogue loaded")
+}
+
+func parse(data []byte) (map[string]Authenticator, error) {
+	entries := map[string]Authenticator{}
+	err := json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+	for aaguid, authenticator := range entries {
+		if lower := strings.ToLower(aaguid); lower != aaguid {
+			delete(entries, aaguid)
+			entries[lower] = authenticator
+		}
+	}
+	return entries, nil
+}
+
+// Looks up the authenticator model of a raw AAGUID
+func Lookup(aaguid []byte) (Authenticator, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	authenticator, ok := catalogue[Format(aaguid)]
+	return authenticator, ok
+}
+
+// Returns the name of the authenticator model, empty when it is unknown
+func Name(aaguid []byte) string {
+	authenticator, _ := Lookup(aaguid)
+	return authenticator.Name
+}
+
+// Returns the path the icon of the authenticator model is served from
+func IconURL(aaguid []byte) string {
+	authenticator, ok := Lookup(aaguid)
+	if !ok || (authenticator.IconDark == "" && authenticator.IconLight == "") {
+		return DefaultIcon
+	}
+	return "/assets/authenticators/" + Format(aaguid)
+}
+
+// Serves the icon of the authenticator with the AAGUID in the path, the
+// light variant when ?theme=light is passed
+func IconHandler(c *fiber.Ctx) error {
+	mu.RLock()
+	authenticator, ok := catalogue[strings.ToLower(c.Params("aaguid"))]
+	mu.RUnlock()
+	icon := authenticator.IconDark
+	if icon == "" || c.Query("theme") == "light" && authenticator.IconLight != "" {
+		icon = authenticator.IconLight
+	}
+	if !ok || icon == "" {
+		return c.Redirect(DefaultIcon, 302)
+	}
+	contentType, data, err := decodeDataURL(icon)
+	if err != nil {
+		log.Err(err).Str("aaguid", c.Params("aaguid")).Msg("failed to decode authenticator icon")
+		return c.Redirect(DefaultIcon, 302)
+	}
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=86400")
+	return c.Send(data)
+}
+
+// Decodes a data URL like data:image/svg+xml;base64,PHN2Zy...
+func decodeDataURL(s string) (string, []byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(s, "data:"), ",")
+	if !ok || !strings.HasPrefix(s, "data:") {
+		return "", nil, ErrInvalidIcon
+	}
+	contentType, _, _ := strings.Cut(header, ";")
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", nil, fmt.Errorf("%w: %s", ErrInvalidIcon, contentType)
+	}
+	if strings.HasSuffix(header, ";base64") {
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrInvalidIcon, err)
+		}
+		return contentType, data, nil
+	}
+	data, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %w", ErrInvalidIcon, err)
+	}
+	return contentType, []byte(data), nil
+}
+
+// Formats a raw AAGUID like 00000000-0000-0000-0000-000000000000
+func Format(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
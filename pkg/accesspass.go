@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/rs/zerolog/log"
+)
+
+const MaxAccessPassTTL = time.Hour * 24
+
+var (
+	ErrInvalidAccessPassTTL = errors.New("access pass lifetime must be between 1 minute and 24 hours")
+	ErrAccessPassNotAllowed = errors.New("access passes can not be issued for users with a higher role")
+)
+
+type AccessPassOptions struct {
+	TTL               time.Duration
+	SingleUse         bool
+	RevokeCredentials bool
+}
+
+// Issues a temporary access pass for the user which can be redeemed in
+// place of a recovery code. The issuer needs at least the role of the
+// user. The returned code is not stored and can not be retrieved again.
+func (authImpl AuthImpl) IssueAccessPass(username string, issuedBy string,
+	opts AccessPassOptions) (string, time.Time, error) {
+	if opts.TTL < time.Minute || opts.TTL > MaxAccessPassTTL {
+		return "", time.Time{}, ErrInvalidAccessPassTTL
+	}
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	issuer, err := userDb.GetUser(issuedBy)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if !issuer.Role.Includes(user.Role) {
+		return "", time.Time{}, ErrAccessPassNotAllowed
+	}
+
+	code, err := newAccessPassCode()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expires := time.Now().Add(opts.TTL)
+	err = userDb.CreateAccessPass(db.AccessPass{
+		UserID:            user.ID,
+		Hash:              hashRecoveryCode(code),
+		ExpiresAt:         expires,
+		SingleUse:         opts.SingleUse,
+		RevokeCredentials: opts.RevokeCredentials,
+		IssuedBy:          issuedBy,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return code, expires, nil
+}
+
+// Redeems an access pass for the user, revoking the existing credentials
+// and sessions of the user if the issuer requested it
+func redeemAccessPass(user db.User, code string) error {
+	pass, err := userDb.UseAccessPass(user, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+
+	if pass.RevokeCredentials {
+		err = userDb.DeleteUserCredentials(user)
+		if err != nil {
+			return err
+		}
+		// Whoever holds a lost device must not stay logged in
+		_, err = userDb.RevokeSessions(user.Username, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info().Str("username", user.Username).Str("issuedBy", pass.IssuedBy).
+		Bool("revokedCredentials", pass.RevokeCredentials).Msg("access pass redeemed")
+	go notifyAccessPassUsed(user.Username, pass.RevokeCredentials)
+	return nil
+}
+
+func notifyAccessPassUsed(username string, revoked bool) {
+	content := fmt.Sprintf("A temporary access pass was used to regain access to your account %s.",
+		db.LocalUsername(username))
+	if revoked {
+		content += " Your previously registered passkeys have been revoked."
+	}
+	err := notifyUser(username, "Temporary access pass used", content)
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("failed to send access pass notification")
+	}
+}
+
+func newAccessPassCode() (string, error) {
+	b := make([]byte, 15)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+	groups := []string{}
+	for i := 0; i < len(code); i += 6 {
+		groups = append(groups, code[i:i+6])
+	}
+	return strings.Join(groups, "-"), nil
+}
@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+)
+
+const (
+	// Prefix of every access token, so that leaked tokens are easy to
+	// recognise and to find with secret scanners
+	AccessTokenPrefix = "gwa_"
+	MaxAccessTokenTTL = 365 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidAccessToken    = errors.New("invalid access token")
+	ErrInvalidAccessTokenTTL = errors.New("access token lifetime must be between 1 day and 365 days")
+	ErrInvalidScope          = errors.New("unknown access token scope")
+	ErrNoScope               = errors.New("access tokens need at least one scope")
+	ErrScopeNotAllowed       = errors.New("the role of the user does not allow this scope")
+
+	accessTokenDb db.AccessTokenDb
+)
+
+func InitAccessTokens(tDb db.AccessTokenDb) {
+	accessTokenDb = tDb
+}
+
+// Issues an access token acting as the user, with scopes the role of the
+// user allows. The returned token is only stored as a hash and can not be
+// retrieved again.
+func IssueAccessToken(user db.User, createdBy string, name string, scopes []string,
+	ttl time.Duration) (string, *db.AccessToken, error) {
+	if ttl < 24*time.Hour || ttl > MaxAccessTokenTTL {
+		return "", nil, ErrInvalidAccessTokenTTL
+	}
+	if len(scopes) == 0 {
+		return "", nil, ErrNoScope
+	}
+	for _, scope := range scopes {
+		if !db.ValidScope(scope) {
+			return "", nil, ErrInvalidScope
+		}
+		if !slices.Contains(db.RoleScopes(user.Role), scope) {
+			return "", nil, ErrScopeNotAllowed
+		}
+	}
+
+	id := make([]byte, 12)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	token := AccessTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	record := db.AccessToken{
+		ID:        base64.RawURLEncoding.EncodeToString(id),
+		Username:  user.Username,
+		Name:      name,
+		Hint:      token[:len(AccessTokenPrefix)+4],
+		Hash:      hashAccessToken(token),
+		Scopes:    strings.Join(scopes, ","),
+		CreatedBy: createdBy,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	err := accessTokenDb.CreateAccessToken(record)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &record, nil
+}
+
+// Returns the unexpired access token, ErrInvalidAccessToken when it is
+// unknown
+func AuthenticateAccessToken(token string) (*db.AccessToken, error) {
+	if !strings.HasPrefix(token, AccessTokenPrefix) {
+		return nil, ErrInvalidAccessToken
+	}
+	record, err := accessTokenDb.FindAccessToken(hashAccessToken(token))
+	if err != nil {
+		if errors.Is(err, db.ErrNoResults) {
+			return nil, ErrInvalidAccessToken
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,238 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Attempts after the first to append an event before it is given up
+const appendRetries = 5
+
+// Orders the checkpoint writes of this process, appends are serialised by
+// the database
+var (
+	checkpointMu sync.Mutex
+	checkpointID uint
+)
+
+var (
+	auditDb     db.AuditDb
+	ErrTampered = errors.New("audit log has been tampered with")
+	// Returned by Verify when the checkpoint is not signed, anyone who can
+	// write the log could rewrite an unsigned checkpoint along with it
+	ErrUnverifiable = errors.New("audit log cannot be verified")
+)
+
+// An event to record, the request metadata is filled in by Record
+type Entry struct {
+	Action  string
+	Actor   string
+	Target  string
+	Outcome string
+	Details map[string]string
+}
+
+func Init(aDb db.AuditDb) {
+	auditDb = aDb
+}
+
+// Records the entry together with the IP, user agent, request id and
+// confirmation of the request
+func Record(c *fiber.Ctx, entry Entry) {
+	event := newEvent(entry)
+	event.IP = c.IP()
+	event.UserAgent = c.Get(fiber.HeaderUserAgent)
+	if id, ok := c.Locals("requestid").(string); ok {
+		event.RequestID = id
+	}
+	if id, ok := c.Locals("confirmation").(string); ok {
+		event.Confirmation = id
+	}
+	appendEvent(event)
+}
+
+// Records an entry that did not originate from a request
+func Log(entry Entry) {
+	appendEvent(newEvent(entry))
+}
+
+func newEvent(entry Entry) db.AuditEvent {
+	details := ""
+	if len(entry.Details) > 0 {
+		b, err := json.Marshal(entry.Details)
+		if err != nil {
+			log.Err(err).Msg("failed to marshal audit details")
+		}
+		details = string(b)
+	}
+	outcome := entry.Outcome
+	if len(outcome) == 0 {
+		outcome = OutcomeSuccess
+	}
+	return db.AuditEvent{
+		Time:    time.Now().UTC().Truncate(time.Microsecond),
+		Action:  entry.Action,
+		Actor:   entry.Actor,
+		Target:  entry.Target,
+		Outcome: outcome,
+		Details: details,
+	}
+}
+
+func appendEvent(event db.AuditEvent) {
+	log.Info().Str("action", event.Action).Str("actor", event.Actor).
+		Str("target", event.Target).Str("outcome", event.Outcome).
+		Str("details", event.Details).Msg("audit")
+	if auditDb != nil {
+		stored, err := store(event)
+		if err != nil {
+			log.Err(err).Str("action", event.Action).Msg("failed to record audit event")
+		} else {
+			event = stored
+		}
+	}
+	dispatch(event)
+}
+
+// Appends the event and moves the checkpoint to it. The database rejects
+// an event linked to an event that already has a successor, so an append
+// that raced with another writer, or found sqlite locked, is retried with
+// backoff.
+func store(event db.AuditEvent) (db.AuditEvent, error) {
+	var stored db.AuditEvent
+	var err error
+	for attempt := 0; attempt <= appendRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<attempt)*10*time.Millisecond +
+				time.Duration(rand.Int63n(int64(10*time.Millisecond))))
+		}
+		stored, err = auditDb.AppendAuditEvent(event, Hash)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return event, err
+	}
+	checkpointMu.Lock()
+	defer checkpointMu.Unlock()
+	if stored.ID < checkpointID {
+		return stored, nil
+	}
+	err = writeCheckpoint(stored)
+	if err != nil {
+		log.Err(err).Uint("id", stored.ID).Msg("failed to write audit checkpoint")
+		return stored, nil
+	}
+	checkpointID = stored.ID
+	return stored, nil
+}
+
+// Returns the hash of the event, covering every field except the id and
+// the hash itself
+func Hash(event db.AuditEvent) string {
+	b, err := json.Marshal(struct {
+		Time         string `json:"time"`
+		Actor        string `json:"actor"`
+		Target       string `json:"target"`
+		Action       string `json:"action"`
+		Outcome      string `json:"outcome"`
+		IP           string `json:"ip"`
+		UserAgent    string `json:"userAgent"`
+		RequestID    string `json:"requestId"`
+		Confirmation string `json:"confirmation"`
+		Details      string `json:"details"`
+		PrevHash     string `json:"prevHash"`
+	}{
+		Time:         event.Time.UTC().Format(time.RFC3339Nano),
+		Actor:        event.Actor,
+		Target:       event.Target,
+		Action:       event.Action,
+		Outcome:      event.Outcome,
+		IP:           event.IP,
+		UserAgent:    event.UserAgent,
+		RequestID:    event.RequestID,
+		Confirmation: event.Confirmation,
+		Details:      event.Details,
+		PrevHash:     event.PrevHash,
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to marshal audit event")
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Walks the whole log and checks that every event links to the previous
+// one and matches its hash, and that the log still reaches the signed
+// checkpoint. Returns the number of verified events.
+func Verify() (int, error) {
+	checkpoint, err := ReadCheckpoint()
+	if err != nil {
+		return 0, err
+	}
+	if checkpoint != nil && len(checkpoint.Signature) == 0 {
+		return 0, fmt.Errorf("%w: the checkpoint is not signed, set AUTH_AUDIT_CHECKPOINT_KEY", ErrUnverifiable)
+	}
+	count := 0
+	prev := ""
+	reached := false
+	err = auditDb.IterateAuditEvents(db.AuditFilter{}, func(event db.AuditEvent) error {
+		if event.PrevHash != prev {
+			return fmt.Errorf("%w: event %d does not link to the previous event", ErrTampered, event.ID)
+		}
+		if Hash(event) != event.Hash {
+			return fmt.Errorf("%w: event %d does not match its hash", ErrTampered, event.ID)
+		}
+		if checkpoint != nil && event.ID == checkpoint.ID {
+			if event.Hash != checkpoint.Hash {
+				return fmt.Errorf("%w: event %d does not match the checkpoint", ErrTampered, event.ID)
+			}
+			reached = true
+		}
+		prev = event.Hash
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	switch {
+	case checkpoint == nil && count > 0:
+		return count, fmt.Errorf("%w: the checkpoint of the log is missing", ErrTampered)
+	case checkpoint != nil && !reached:
+		return count, fmt.Errorf("%w: the log ends before checkpoint event %d", ErrTampered, checkpoint.ID)
+	}
+	return count, nil
+}
+
+func Events(filter db.AuditFilter) []db.AuditEvent {
+	return auditDb.GetAuditEvents(filter)
+}
+
+// Writes every event matching the filter as a JSON line
+func Export(filter db.AuditFilter, write func([]byte) error) error {
+	return auditDb.IterateAuditEvents(filter, func(event db.AuditEvent) error {
+		b, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		return write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,83 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/spf13/viper"
+)
+
+// The head of the chain, written outside of the database after every
+// append so that deleting the newest events can be detected
+type Checkpoint struct {
+	ID        uint      `json:"id"`
+	Hash      string    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+}
+
+// Signs the checkpoint with AUTH_AUDIT_CHECKPOINT_KEY, empty without a key
+func (cp Checkpoint) sign() string {
+	key := viper.GetString("AUTH_AUDIT_CHECKPOINT_KEY")
+	if len(key) == 0 {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strconv.FormatUint(uint64(cp.ID), 10) + "." + cp.Hash + "." +
+		cp.Time.UTC().Format(time.RFC3339Nano)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the stored checkpoint, nil when none has been written yet
+func ReadCheckpoint() (*Checkpoint, error) {
+	b, err := os.ReadFile(viper.GetString("AUTH_AUDIT_CHECKPOINT"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cp := Checkpoint{}
+	err = json.Unmarshal(b, &cp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unreadable checkpoint: %v", ErrTampered, err)
+	}
+	if !hmac.Equal([]byte(cp.sign()), []byte(cp.Signature)) {
+		return nil, fmt.Errorf("%w: checkpoint signature is invalid", ErrTampered)
+	}
+	return &cp, nil
+}
+
+// Replaces the checkpoint with the event, the file is renamed into place
+// so that readers never see a partial checkpoint
+func writeCheckpoint(event db.AuditEvent) error {
+	cp := Checkpoint{ID: event.ID, Hash: event.Hash, Time: time.Now().UTC()}
+	cp.Signature = cp.sign()
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	path := viper.GetString("AUTH_AUDIT_CHECKPOINT")
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".audit-head-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
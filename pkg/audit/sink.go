@@ -0,0 +1,203 @@
+package audit
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const maxRetryDelay = time.Second * 30
+
+// A destination audit events are streamed to in addition to the database
+type Sink interface {
+	Name() string
+	Write(db.AuditEvent) error
+	Close() error
+}
+
+// Selects the events streamed to a sink, empty lists match everything
+type Filter struct {
+	Actions  []string
+	Outcomes []string
+}
+
+func (f Filter) Match(event db.AuditEvent) bool {
+	return matchAny(f.Actions, event.Action) && matchAny(f.Outcomes, event.Outcome)
+}
+
+// Matches the value against the patterns, a trailing * matches any suffix
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if p == value || p == "*" ||
+			(strings.HasSuffix(p, "*") && strings.HasPrefix(value, strings.TrimSuffix(p, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// How events are delivered to a sink
+type Delivery struct {
+	// Events buffered before new events are dropped
+	Buffer int
+	// Retries per event with exponential backoff
+	Retries int
+}
+
+// Delivers events to a sink from its own goroutine so a slow or failing
+// sink never blocks the request that recorded the event. Events are
+// dropped when the buffer is full.
+type worker struct {
+	sink    Sink
+	filter  Filter
+	queue   chan db.AuditEvent
+	retries int
+	done    chan struct{}
+}
+
+var (
+	workers   []*worker
+	workersMu sync.Mutex
+)
+
+// Streams the events matching the filter to the sink
+func AddSink(sink Sink, filter Filter, delivery Delivery) {
+	w := &worker{
+		sink:    sink,
+		filter:  filter,
+		queue:   make(chan db.AuditEvent, delivery.Buffer),
+		retries: delivery.Retries,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+
+	workersMu.Lock()
+	workers = append(workers, w)
+	workersMu.Unlock()
+	log.Info().Str("sink", sink.Name()).Msg("streaming audit events")
+}
+
+// Flushes the buffered events and closes every sink
+func Close() {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for _, w := range workers {
+		close(w.queue)
+		<-w.done
+	}
+	workers = nil
+}
+
+func dispatch(event db.AuditEvent) {
+	workersMu.Lock()
+	defer workersMu.Unlock()
+	for _, w := range workers {
+		if !w.filter.Match(event) {
+			continue
+		}
+		select {
+		case w.queue <- event:
+		default:
+			log.Warn().Str("sink", w.sink.Name()).Str("action", event.Action).
+				Msg("audit sink buffer full, dropping event")
+		}
+	}
+}
+
+func (w *worker) run() {
+	defer close(w.done)
+	for event := range w.queue {
+		w.deliver(event)
+	}
+	err := w.sink.Close()
+	if err != nil {
+		log.Err(err).Str("sink", w.sink.Name()).Msg("failed to close audit sink")
+	}
+}
+
+// Writes the event to the sink, retrying with exponential backoff
+func (w *worker) deliver(event db.AuditEvent) {
+	delay := time.Second
+	for attempt := 0; ; attempt++ {
+		err := w.sink.Write(event)
+		if err == nil {
+			return
+		}
+		if attempt >= w.retries {
+			log.Err(err).Str("sink", w.sink.Name()).Uint("id", event.ID).
+				Msg("failed to deliver audit event, giving up")
+			return
+		}
+		log.Warn().Err(err).Str("sink", w.sink.Name()).Uint("id", event.ID).
+			Dur("retryIn", delay).Msg("failed to deliver audit event")
+		time.Sleep(delay)
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// Configures the sinks from the AUTH_AUDIT_* environment, see the readme
+// for the available settings
+func ConfigureSinks() {
+	if addr := viper.GetString("AUTH_AUDIT_SYSLOG_ADDR"); len(addr) > 0 {
+		sink, err := NewSyslogSink(addr, viper.GetString("AUTH_AUDIT_SYSLOG_CA"))
+		if err != nil {
+			log.Err(err).Msg("failed to configure syslog audit sink")
+		} else {
+			AddSink(sink, filterFromConfig("SYSLOG"), deliveryFromConfig("SYSLOG"))
+		}
+	}
+	if path := viper.GetString("AUTH_AUDIT_FILE_PATH"); len(path) > 0 {
+		sink, err := NewFileSink(path, viper.GetInt64("AUTH_AUDIT_FILE_MAX_SIZE")*1024*1024,
+			viper.GetInt("AUTH_AUDIT_FILE_MAX_BACKUPS"))
+		if err != nil {
+			log.Err(err).Msg("failed to configure file audit sink")
+		} else {
+			AddSink(sink, filterFromConfig("FILE"), deliveryFromConfig("FILE"))
+		}
+	}
+	if url := viper.GetString("AUTH_AUDIT_WEBHOOK_URL"); len(url) > 0 {
+		AddSink(NewWebhookSink(url, viper.GetString("AUTH_AUDIT_WEBHOOK_SECRET")),
+			filterFromConfig("WEBHOOK"), deliveryFromConfig("WEBHOOK"))
+	}
+}
+
+func filterFromConfig(sink string) Filter {
+	return Filter{
+		Actions:  splitList(viper.GetString("AUTH_AUDIT_" + sink + "_ACTIONS")),
+		Outcomes: splitList(viper.GetString("AUTH_AUDIT_" + sink + "_OUTCOMES")),
+	}
+}
+
+// Reads the buffer and retries of the sink, falling back to the values
+// shared by every sink
+func deliveryFromConfig(sink string) Delivery {
+	return Delivery{
+		Buffer:  sinkInt(sink, "BUFFER"),
+		Retries: sinkInt(sink, "RETRIES"),
+	}
+}
+
+func sinkInt(sink string, name string) int {
+	if key := "AUTH_AUDIT_" + sink + "_" + name; viper.IsSet(key) {
+		return viper.GetInt(key)
+	}
+	return viper.GetInt("AUTH_AUDIT_" + name)
+}
+
+func splitList(value string) []string {
+	list := []string{}
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+)
+
+const (
+	syslogFacilityAuthPriv = 10
+	syslogSeverityWarning  = 4
+	syslogSeverityInfo     = 6
+	syslogAppName          = "go-webauthn-htmx"
+	// Private enterprise number reserved for documentation, RFC 5612
+	syslogEnterpriseID = "32473"
+)
+
+var ErrUnsupportedSyslogNetwork = errors.New("syslog address must use udp, tcp or tls")
+
+// Sends events as RFC 5424 messages. Messages over tcp and tls are framed
+// with octet counting, RFC 6587, udp sends one message per datagram.
+type SyslogSink struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	hostname string
+	conn     net.Conn
+}
+
+// Creates a sink for an address like udp://host:514 or tls://host:6514,
+// caFile optionally holds the PEM certificates trusted for tls
+func NewSyslogSink(addr string, caFile string) (*SyslogSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	sink := &SyslogSink{network: u.Scheme, address: u.Host}
+	switch u.Scheme {
+	case "udp", "tcp":
+	case "tls":
+		sink.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if len(caFile) > 0 {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return nil, err
+			}
+			sink.tls.RootCAs = x509.NewCertPool()
+			if !sink.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", caFile)
+			}
+		}
+	default:
+		return nil, ErrUnsupportedSyslogNetwork
+	}
+	sink.hostname, err = os.Hostname()
+	if err != nil {
+		sink.hostname = "-"
+	}
+	return sink, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return "syslog " + s.network + "://" + s.address
+}
+
+func (s *SyslogSink) Write(event db.AuditEvent) error {
+	msg, err := s.format(event)
+	if err != nil {
+		return err
+	}
+	if s.network != "udp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+
+	if s.conn == nil {
+		err = s.connect()
+		if err != nil {
+			return err
+		}
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+	_, err = s.conn.Write(msg)
+	if err != nil {
+		// Reconnect on the next attempt
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *SyslogSink) connect() error {
+	dialer := &net.Dialer{Timeout: time.Second * 10}
+	var err error
+	if s.tls != nil {
+		s.conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tls)
+	} else {
+		s.conn, err = dialer.Dial(s.network, s.address)
+	}
+	return err
+}
+
+// Formats the event as an RFC 5424 message, the structured data holds the
+// main fields and the message the whole event as JSON
+func (s *SyslogSink) format(event db.AuditEvent) ([]byte, error) {
+	severity := syslogSeverityInfo
+	if event.Outcome != OutcomeSuccess {
+		severity = syslogSeverityWarning
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	sd := fmt.Sprintf(`[audit@%s id="%d" action="%s" actor="%s" target="%s" outcome="%s" ip="%s" hash="%s"]`,
+		syslogEnterpriseID, event.ID, sdEscape(event.Action), sdEscape(event.Actor),
+		sdEscape(event.Target), sdEscape(event.Outcome), sdEscape(event.IP), event.Hash)
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		syslogFacilityAuthPriv*8+severity,
+		event.Time.UTC().Format(time.RFC3339Nano),
+		s.hostname, syslogAppName, os.Getpid(), headerValue(event.Action), sd, body)
+	return []byte(msg), nil
+}
+
+// Escapes a structured data parameter value
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// Header fields are printable US-ASCII without spaces, at most 32 characters
+func headerValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= 32 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(value) == 0 {
+		return "-"
+	}
+	if len(value) > 32 {
+		return value[:32]
+	}
+	return value
+}
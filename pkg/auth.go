@@ -3,9 +3,15 @@ package pkg
 import (
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/a19simma/go-webauthn-htmx/pkg/aaguid"
 	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/mds"
+	"github.com/a19simma/go-webauthn-htmx/pkg/policy"
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/rs/zerolog/log"
@@ -18,24 +24,44 @@ var (
 	ErrAlreadyExists          = errors.New("already exists")
 	ErrRegistrationNotAllowed = errors.New("registration not allowed")
 	ErrLoginBlocked           = errors.New("login has been blocked for this user")
+	// Wraps the reason an authenticator was rejected during registration
+	ErrAuthenticatorNotAllowed = errors.New("authenticator not allowed")
 )
 
 type Auth interface {
-	BeginLogin(string) (*protocol.CredentialAssertion, error)
-	FinishLogin(string, protocol.ParsedCredentialAssertionData) error
-	BeginRegistration(string) (*protocol.CredentialCreation, error)
+	BeginLogin(string, LargeBlobOperation) (*protocol.CredentialAssertion, error)
+	FinishLogin(string, protocol.ParsedCredentialAssertionData) (*webauthn.Credential, error)
+	BeginRegistration(string, string) (*protocol.CredentialCreation, error)
 	FinishRegistration(protocol.ParsedCredentialCreationData,
 		string) error
+	BeginUpgrade(string, string) (*protocol.CredentialCreation, error)
+	FinishUpgrade(protocol.ParsedCredentialCreationData, string) (int, error)
+	GenerateRecoveryCodes(string) ([]string, error)
+	RemainingRecoveryCodes(string) int
+	RecoverAccount(string, string) (string, error)
+	IssueAccessPass(string, string, AccessPassOptions) (string, time.Time, error)
+	BeginConfirmation(Operation) (string, string, *protocol.CredentialAssertion, error)
+	FinishConfirmation(string, string, protocol.ParsedCredentialAssertionData) (*webauthn.Credential, error)
+	ConsumeConfirmation(string, Operation) error
+	VerifyConfirmation(string) (*db.Confirmation, error)
 }
 
 type AuthImpl struct{}
 
-func (authimpl AuthImpl) FinishLogin(username string, data protocol.ParsedCredentialAssertionData) error {
+func (authimpl AuthImpl) FinishLogin(username string, data protocol.ParsedCredentialAssertionData) (*webauthn.Credential, error) {
 	user, err := userDb.GetUser(username)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if user.Status == db.Blocked {
+		return nil, ErrLoginBlocked
 	}
 	session := userDb.GetUserSession(*user)
+	// A challenge can only be answered once
+	err = userDb.DeleteSessions(*user)
+	if err != nil {
+		return nil, err
+	}
 	user.Credentials = userDb.GetUserCredentials(*user)
 	wSession := webauthn.SessionData{
 		Challenge:            session.Challenge,
@@ -43,41 +69,87 @@ func (authimpl AuthImpl) FinishLogin(username string, data protocol.ParsedCreden
 		AllowedCredentialIDs: [][]byte{},
 		Expires:              session.Expires,
 		UserVerification:     session.UserVerificationRequirement,
-		Extensions:           map[string]interface{}{},
+		Extensions:           session.Extensions,
 	}
 
 	if err != nil {
 		log.Error().Err(err).Msg("")
-		return err
+		return nil, err
 	}
-	_, err = webAuthn.ValidateLogin(user, wSession, &data)
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := rp.ValidateLogin(user, wSession, &data)
 	if err != nil {
 		log.Err(err)
-		return err
+		return nil, err
+	}
+	attested := false
+	for _, c := range user.Credentials {
+		if string(c.ID) == string(credential.ID) {
+			attested = c.Attested
+		}
+	}
+	err = policy.For(user.Role).Check(*credential, attested)
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("login with credential outside of policy")
+		return nil, fmt.Errorf("%w: %w", ErrAuthenticatorNotAllowed, err)
+	}
+	for _, c := range user.Credentials {
+		if string(c.ID) == string(credential.ID) && applyLoginResults(&c, data.ClientExtensionResults) {
+			err = userDb.CreateCredentials(c)
+			if err != nil {
+				log.Err(err).Msg("failed to save extension results")
+			}
+		}
 	}
 
-	return nil
+	return credential, nil
 }
 
-func (authimpl AuthImpl) BeginLogin(username string) (*protocol.CredentialAssertion, error) {
+func (authimpl AuthImpl) BeginLogin(username string, largeBlob LargeBlobOperation) (*protocol.CredentialAssertion, error) {
 	user, err := userDb.GetUser(username)
+	if err == nil && user.Status == db.Blocked {
+		err = ErrLoginBlocked
+	}
 	if err != nil {
+		if enumerationProtection {
+			log.Info().Err(err).Str("username", username).Msg("returning fake login options")
+			return fakeLoginOptions(username, largeBlob)
+		}
 		return nil, err
 	}
-	if user.Status == db.Blocked {
-		return nil, ErrLoginBlocked
-	}
 	log.Printf("User Logging in: %v", user)
 
-	options, session, err := webAuthn.BeginLogin(user)
+	loginOpts := []webauthn.LoginOption{
+		webauthn.WithAssertionExtensions(loginExtensions(*user, largeBlob)),
+	}
+	// Only added when the user has legacy U2F credentials
+	if u2fAppID != "" && slices.ContainsFunc(user.Credentials, IsLegacyCredential) {
+		loginOpts = append(loginOpts, webauthn.WithAppIdExtension(u2fAppID))
+	}
+	if policy.For(user.Role).UserVerification {
+		loginOpts = append(loginOpts, webauthn.WithUserVerification(protocol.VerificationRequired))
+	}
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	options, session, err := rp.BeginLogin(user, loginOpts...)
 	if err != nil {
 		log.Err(err)
+		if enumerationProtection {
+			log.Info().Err(err).Str("username", username).Msg("returning fake login options")
+			return fakeLoginOptions(username, largeBlob)
+		}
 		return nil, err
 	}
 	dSession := db.Sessions{
 		Challenge:                   session.Challenge,
 		Expires:                     time.Now().Add(time.Minute * 5),
 		UserVerificationRequirement: session.UserVerification,
+		Extensions:                  session.Extensions,
 		UserID:                      session.UserID,
 	}
 
@@ -97,18 +169,12 @@ func (authimpl AuthImpl) BeginLogin(username string) (*protocol.CredentialAssert
 }
 
 func InitAuth(uDb db.UserDb) (Auth, error) {
-	origins := []string{"http://localhost:4200"}
-	o := viper.GetString("AUTH_ORIGIN")
-	if len(o) != 0 {
-		origins = append(origins, o)
-	}
-	wconfig := &webauthn.Config{
-		RPDisplayName: "Go Webauthn", // Display Name for your site
-		RPID:          "localhost",   // Generally the FQDN for your site
-		RPOrigins:     origins,       // The origin URLs allowed for WebAuthn requests
+	wconfig, err := relyingPartyConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	log.Info().Msgf("allowed origins: %v", origins)
+	log.Info().Msgf("allowed origins: %v", wconfig.RPOrigins)
 
 	web, err := webauthn.New(wconfig)
 	if err != nil {
@@ -117,13 +183,21 @@ func InitAuth(uDb db.UserDb) (Auth, error) {
 	}
 	userDb = uDb
 	webAuthn = web
+	rpConfig = wconfig
+
+	err = initEnumerationProtection()
+	if err != nil {
+		return nil, err
+	}
+	initExtensions()
+	u2fAppID = viper.GetString("AUTH_U2F_APPID")
 
 	log.Printf("Initialized Webauthn with config: %v", web)
 
 	return AuthImpl{}, nil
 }
 
-func (authImpl AuthImpl) BeginRegistration(username string) (*protocol.CredentialCreation, error) {
+func (authImpl AuthImpl) BeginRegistration(username string, host string) (*protocol.CredentialCreation, error) {
 	log.Printf("uDb: %v", userDb)
 	user, err := userDb.GetUser(username)
 	if err != nil && !errors.Is(err, db.ErrNoResults) {
@@ -144,7 +218,12 @@ func (authImpl AuthImpl) BeginRegistration(username string) (*protocol.Credentia
 		user.ID = id
 	}
 
-	if user.Status != db.Open && user.Username != viper.Get("AUTH_ADMIN_EMAIl") {
+	if user.Status != db.Open && user.Status != db.Recovering &&
+		!isBootstrapAdmin(user.Username) {
+		return nil, ErrRegistrationNotAllowed
+	}
+	// Service accounts only authenticate with access tokens
+	if user.ServiceAccount {
 		return nil, ErrRegistrationNotAllowed
 	}
 
@@ -152,7 +231,34 @@ func (authImpl AuthImpl) BeginRegistration(username string) (*protocol.Credentia
 	if err != nil {
 		return nil, err
 	}
-	options, sessionData, err := webAuthn.BeginRegistration(user)
+	return beginRegistration(user, host)
+}
+
+// Starts the registration ceremony of a user who is allowed to register,
+// the relying party is named after the brand of the host
+func beginRegistration(user *db.User, host string) (*protocol.CredentialCreation, error) {
+	p := policy.For(registrationRole(*user))
+	opts := []webauthn.RegistrationOption{
+		webauthn.WithExtensions(registrationExtensions(p)),
+	}
+	// Tenants are named after themselves
+	if db.TenantOf(user.Username) == "" {
+		opts = append(opts, withRelyingPartyName(host))
+	}
+	// Attestation is only worth asking for when it can be verified
+	if mds.Enabled() || p.RequiresAttestation() {
+		opts = append(opts, webauthn.WithConveyancePreference(protocol.PreferDirectAttestation))
+	}
+	if p.UserVerification {
+		opts = append(opts, webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			UserVerification: protocol.VerificationRequired,
+		}))
+	}
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	options, sessionData, err := rp.BeginRegistration(user, opts...)
 	if err != nil {
 		log.Err(err)
 	}
@@ -160,10 +266,15 @@ func (authImpl AuthImpl) BeginRegistration(username string) (*protocol.Credentia
 		Challenge:                   sessionData.Challenge,
 		Expires:                     sessionData.Expires,
 		UserVerificationRequirement: sessionData.UserVerification,
+		Extensions:                  sessionData.Extensions,
 		UserUsername:                user.Username,
 		UserID:                      user.ID,
 	}
 
+	err = userDb.DeleteSessions(*user)
+	if err != nil {
+		return nil, err
+	}
 	err = userDb.CreateSession(s)
 	if err != nil {
 		return nil, err
@@ -181,8 +292,11 @@ func (authImpl AuthImpl) FinishRegistration(resp protocol.ParsedCredentialCreati
 	log.Print(user)
 
 	session := userDb.GetUserSession(*user)
-
-	user.Sessions = append(user.Sessions, session)
+	// A challenge can only be answered once
+	err = userDb.DeleteSessions(*user)
+	if err != nil {
+		return err
+	}
 
 	wSession := webauthn.SessionData{
 		Challenge:            session.Challenge,
@@ -190,20 +304,36 @@ func (authImpl AuthImpl) FinishRegistration(resp protocol.ParsedCredentialCreati
 		AllowedCredentialIDs: [][]byte{},
 		Expires:              session.Expires,
 		UserVerification:     session.UserVerificationRequirement,
-		Extensions:           map[string]interface{}{},
+		Extensions:           session.Extensions,
 	}
 
-	credential, err := webAuthn.CreateCredential(user, wSession, &resp)
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return err
+	}
+	credential, err := rp.CreateCredential(user, wSession, &resp)
 	if err != nil {
 		log.Print("credential error: " + err.Error())
 		return err
 	}
+	authenticator, err := mds.Verify(resp.Response.AttestationObject)
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("authenticator rejected by metadata")
+		return fmt.Errorf("%w: %w", ErrAuthenticatorNotAllowed, err)
+	}
+	role := registrationRole(*user)
+	err = policy.For(role).Check(*credential, authenticator.Attested)
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("authenticator rejected by policy")
+		return fmt.Errorf("%w: %w", ErrAuthenticatorNotAllowed, err)
+	}
 
 	// If creation was successful, store the credential object
-	var transport string
-	for t := range credential.Transport {
-		transport = transport + "," + string(rune(t))
+	transports := []string{}
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
 	}
+	transport := strings.Join(transports, ",")
 
 	if err != nil {
 		log.Err(err)
@@ -213,11 +343,17 @@ func (authImpl AuthImpl) FinishRegistration(resp protocol.ParsedCredentialCreati
 		PublicKey:       credential.PublicKey,
 		AttestationType: credential.AttestationType,
 		Transport:       transport,
+		Name:            aaguid.Name(credential.Authenticator.AAGUID),
+		Description:     authenticator.Description,
+		Certification:   authenticator.CertificationLevel,
+		Attested:        authenticator.Attested,
 		Flags:           credential.Flags,
 		Authentication:  credential.Authenticator,
 		UserUsername:    user.Username,
 		UserID:          user.ID,
+		CreatedAt:       time.Now(),
 	}
+	applyRegistrationResults(&dCredential, resp.ClientExtensionResults, resp.Response.AttestationObject.AuthData)
 
 	err = userDb.CreateCredentials(dCredential)
 	if err != nil {
@@ -225,11 +361,7 @@ func (authImpl AuthImpl) FinishRegistration(resp protocol.ParsedCredentialCreati
 	}
 
 	log.Print(user)
-	if user.Username == viper.Get("AUTH_ADMIN_EMAIL") {
-		user.Role = db.Admin
-	} else {
-		user.Role = db.Member
-	}
+	user.Role = role
 	user.Status = db.Registered
 	err = userDb.CreateUser(*user)
 	if err != nil {
@@ -237,3 +369,14 @@ func (authImpl AuthImpl) FinishRegistration(resp protocol.ParsedCredentialCreati
 	}
 	return nil
 }
+
+// The role a user has once registered, recovering and upgrading users keep
+// their role
+func registrationRole(user db.User) db.Role {
+	if isBootstrapAdmin(user.Username) {
+		return db.Admin
+	} else if user.Status == db.Open {
+		return db.Member
+	}
+	return user.Role
+}
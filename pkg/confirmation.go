@@ -0,0 +1,238 @@
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+const confirmationTTL = time.Minute * 5
+
+var (
+	ErrConfirmationInvalid = errors.New("confirmation is invalid, expired or does not match the operation")
+	ErrSignatureInvalid    = errors.New("signature of the confirmation is invalid")
+)
+
+// An operation an admin is asked to approve with their passkey
+type Operation struct {
+	Action  string
+	Target  string
+	Details string
+	Actor   string
+}
+
+// Returns the canonical description of the operation that the WebAuthn
+// challenge is derived from, nonce makes every confirmation unique
+func (o Operation) Canonical(nonce string, t time.Time) string {
+	return strings.Join([]string{
+		"go-webauthn-htmx/confirmation/v1",
+		"action=" + o.Action,
+		"target=" + o.Target,
+		"details=" + o.Details,
+		"actor=" + o.Actor,
+		"time=" + t.UTC().Format(time.RFC3339),
+		"nonce=" + nonce,
+	}, "\n")
+}
+
+// Returns the WebAuthn challenge of a canonical operation description
+func ConfirmationChallenge(canonical string) protocol.URLEncodedBase64 {
+	sum := sha256.Sum256([]byte(canonical))
+	return sum[:]
+}
+
+// Begins an assertion whose challenge is derived from the operation, the
+// returned id identifies the confirmation once it has been signed
+func (authImpl AuthImpl) BeginConfirmation(op Operation) (string, string, *protocol.CredentialAssertion, error) {
+	user, err := userDb.GetUser(op.Actor)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", "", nil, err
+	}
+	id := base64.RawURLEncoding.EncodeToString(nonce)
+	now := time.Now()
+	canonical := op.Canonical(id, now)
+	challenge := ConfirmationChallenge(canonical)
+
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return "", "", nil, err
+	}
+	options, _, err := rp.BeginLogin(user,
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		func(o *protocol.PublicKeyCredentialRequestOptions) {
+			o.Challenge = challenge
+		})
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	err = userDb.SaveConfirmation(db.Confirmation{
+		ID:        id,
+		Actor:     op.Actor,
+		Action:    op.Action,
+		Target:    op.Target,
+		Details:   op.Details,
+		Canonical: canonical,
+		Challenge: challenge.String(),
+		Expires:   now.Add(confirmationTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return "", "", nil, err
+	}
+	return id, canonical, options, nil
+}
+
+// Validates the signed assertion of the confirmation and stores it
+// alongside the confirmation
+func (authImpl AuthImpl) FinishConfirmation(actor string, id string,
+	data protocol.ParsedCredentialAssertionData) (*webauthn.Credential, error) {
+	confirmation, err := userDb.GetConfirmation(id)
+	if err != nil {
+		return nil, err
+	}
+	if confirmation.Actor != actor || confirmation.ConfirmedAt != nil ||
+		confirmation.Expires.Before(time.Now()) {
+		return nil, ErrConfirmationInvalid
+	}
+	user, err := userDb.GetUser(actor)
+	if err != nil {
+		return nil, err
+	}
+
+	session := webauthn.SessionData{
+		Challenge:            confirmation.Challenge,
+		UserID:               user.ID,
+		AllowedCredentialIDs: [][]byte{},
+		Expires:              confirmation.Expires,
+		UserVerification:     protocol.VerificationRequired,
+		Extensions:           map[string]interface{}{},
+	}
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := rp.ValidateLogin(user, session, &data)
+	if err != nil {
+		log.Err(err).Str("confirmation", id).Msg("failed to validate confirmation")
+		return nil, err
+	}
+
+	now := time.Now()
+	confirmation.CredentialID = credential.ID
+	confirmation.AuthenticatorData = data.Raw.AssertionResponse.AuthenticatorData
+	confirmation.ClientDataJSON = data.Raw.AssertionResponse.ClientDataJSON
+	confirmation.Signature = data.Raw.AssertionResponse.Signature
+	confirmation.ConfirmedAt = &now
+	err = userDb.SaveConfirmation(*confirmation)
+	if err != nil {
+		return nil, err
+	}
+	return credential, nil
+}
+
+// Consumes a signed confirmation, it must have been signed by the actor
+// for exactly the input operation
+func (authImpl AuthImpl) ConsumeConfirmation(id string, op Operation) error {
+	confirmation, err := userDb.GetConfirmation(id)
+	if err != nil {
+		return ErrConfirmationInvalid
+	}
+	if confirmation.Actor != op.Actor || confirmation.Action != op.Action ||
+		confirmation.Target != op.Target || confirmation.Details != op.Details ||
+		confirmation.Expires.Before(time.Now()) {
+		return ErrConfirmationInvalid
+	}
+	err = userDb.UseConfirmation(id)
+	if errors.Is(err, db.ErrNoResults) {
+		return ErrConfirmationInvalid
+	}
+	return err
+}
+
+// Verifies a stored confirmation from its canonical description, signed
+// client data and the public key of the credential that signed it. The
+// assertion must have been made for the RP ID at one of the origins.
+func VerifyConfirmation(confirmation db.Confirmation, publicKey []byte, rpID string, origins []string) error {
+	if confirmation.ConfirmedAt == nil {
+		return ErrConfirmationInvalid
+	}
+
+	clientData := protocol.CollectedClientData{}
+	err := json.Unmarshal(confirmation.ClientDataJSON, &clientData)
+	if err != nil {
+		return err
+	}
+	challenge := ConfirmationChallenge(confirmation.Canonical)
+	if clientData.Type != protocol.AssertCeremony || clientData.Challenge != challenge.String() {
+		return fmt.Errorf("%w: client data does not match the operation", ErrSignatureInvalid)
+	}
+	if !slices.Contains(origins, strings.TrimSuffix(clientData.Origin, "/")) {
+		return fmt.Errorf("%w: signed at unexpected origin %s", ErrSignatureInvalid, clientData.Origin)
+	}
+	// authenticatorData starts with the SHA-256 of the RP ID, followed by the
+	// flags and the signature counter
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if len(confirmation.AuthenticatorData) < 37 ||
+		!bytes.Equal(confirmation.AuthenticatorData[:32], rpIDHash[:]) {
+		return fmt.Errorf("%w: authenticator data is not for RP ID %s", ErrSignatureInvalid, rpID)
+	}
+
+	key, err := webauthncose.ParsePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	clientDataHash := sha256.Sum256(confirmation.ClientDataJSON)
+	signed := bytes.Join([][]byte{confirmation.AuthenticatorData, clientDataHash[:]}, nil)
+	valid, err := webauthncose.VerifySignature(key, signed, confirmation.Signature)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+// Verifies the stored confirmation with the id against the credential
+// of the actor that signed it
+func (authImpl AuthImpl) VerifyConfirmation(id string) (*db.Confirmation, error) {
+	confirmation, err := userDb.GetConfirmation(id)
+	if err != nil {
+		return nil, err
+	}
+	user, err := userDb.GetUser(confirmation.Actor)
+	if err != nil {
+		return confirmation, err
+	}
+	rp, err := relyingParty(user.Username)
+	if err != nil {
+		return confirmation, err
+	}
+	for _, credential := range user.Credentials {
+		if bytes.Equal(credential.ID, confirmation.CredentialID) {
+			return confirmation, VerifyConfirmation(*confirmation, credential.PublicKey,
+				rp.Config.RPID, rp.Config.RPOrigins)
+		}
+	}
+	return confirmation, fmt.Errorf("%w: signing credential no longer exists", ErrSignatureInvalid)
+}
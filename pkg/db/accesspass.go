@@ -0,0 +1,69 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A temporary access pass issued by an admin or helpdesk user, it lets the
+// user enrol a new passkey when both the key and recovery codes are lost
+type AccessPass struct {
+	ID                uint `gorm:"primarykey"`
+	UserID            []byte
+	Hash              string
+	ExpiresAt         time.Time
+	SingleUse         bool
+	RevokeCredentials bool
+	IssuedBy          string
+	UsedAt            *time.Time
+	CreatedAt         time.Time
+}
+
+func (userdbimpl UserDbImpl) CreateAccessPass(pass AccessPass) error {
+	result := db.Create(&pass)
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// Marks the access pass with the input hash as used and returns it,
+// returns ErrNoResults if the pass does not exist, has expired or
+// is single use and has already been used
+func (userdbimpl UserDbImpl) UseAccessPass(user User, hash string) (*AccessPass, error) {
+	pass := AccessPass{}
+	result := db.Where("user_id = ? AND hash = ? AND expires_at > ?", user.ID, hash, time.Now()).
+		Where("single_use = ? OR used_at IS NULL", false).
+		First(&pass)
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+
+	// The condition is checked again in the update, so that concurrent
+	// redemptions of a single use pass can not both succeed
+	now := time.Now()
+	result = db.Model(&AccessPass{}).
+		Where("id = ? AND (single_use = ? OR used_at IS NULL)", pass.ID, false).
+		Update("used_at", now)
+	if result.Error != nil {
+		log.Err(result.Error)
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	pass.UsedAt = &now
+	return &pass, nil
+}
+
+func (userdbimpl UserDbImpl) DeleteUserCredentials(user User) error {
+	result := db.Where("user_id = ?", user.ID).Delete(&Credentials{})
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	log.Debug().Int64("count", result.RowsAffected).Msgf("Deleted credentials of %s", user.Username)
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUseAccessPassSingleUse(t *testing.T) {
+	useTestDb(t)
+	user := User{ID: []byte("bob"), Username: "bob"}
+	userDb := UserDbImpl{}
+	for _, pass := range []AccessPass{
+		{UserID: user.ID, Hash: "single", SingleUse: true, ExpiresAt: time.Now().Add(time.Hour)},
+		{UserID: user.ID, Hash: "multi", ExpiresAt: time.Now().Add(time.Hour)},
+		{UserID: user.ID, Hash: "expired", ExpiresAt: time.Now().Add(-time.Minute)},
+	} {
+		if err := userDb.CreateAccessPass(pass); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := userDb.UseAccessPass(user, "single")
+			if err == nil {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			} else if !errors.Is(err, ErrNoResults) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 1 {
+		t.Errorf("single use pass redeemed %d times", used)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := userDb.UseAccessPass(user, "multi"); err != nil {
+			t.Errorf("multi use pass rejected: %v", err)
+		}
+	}
+	if _, err := userDb.UseAccessPass(user, "expired"); !errors.Is(err, ErrNoResults) {
+		t.Errorf("expired pass accepted: %v", err)
+	}
+}
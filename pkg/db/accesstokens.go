@@ -0,0 +1,166 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Key of the access token that authenticated the request in the request
+// locals, not set for requests authenticated by a session
+const AccessTokenLocal = "accessToken"
+
+// Permissions of access tokens on the user API. Every scope includes the
+// ones listed before it.
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+	ScopeUsersAdmin = "users:admin"
+)
+
+var AccessTokenScopes = []string{ScopeUsersRead, ScopeUsersWrite, ScopeUsersAdmin}
+
+type AccessTokenDb interface {
+	CreateAccessToken(AccessToken) error
+	GetAccessTokens(string) []AccessToken
+	GetAccessToken(string) (*AccessToken, error)
+	FindAccessToken(string) (*AccessToken, error)
+	TouchAccessToken(string, string) error
+	RevokeAccessToken(string) error
+}
+
+type AccessTokenDbImpl struct{}
+
+// A personal access token, or the token of a service account, used in
+// place of a session to call the API
+type AccessToken struct {
+	ID       string `json:"id" gorm:"primarykey"`
+	Username string `json:"username" gorm:"index"`
+	Name     string `json:"name"`
+	// Start of the token, shown to tell tokens apart
+	Hint string `json:"hint"`
+	Hash string `json:"-" gorm:"uniqueIndex"`
+	// Comma separated scopes
+	Scopes     string     `json:"scopes"`
+	CreatedBy  string     `json:"createdBy"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	LastUsedIP string     `json:"lastUsedIp"`
+}
+
+func (t AccessToken) ScopeList() []string {
+	scopes := []string{}
+	for _, scope := range strings.Split(t.Scopes, ",") {
+		if scope = strings.TrimSpace(scope); scope != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// Reports whether the token was granted the scope or one including it
+func (t AccessToken) HasScope(scope string) bool {
+	required := scopeRank(scope)
+	for _, granted := range t.ScopeList() {
+		if required >= 0 && scopeRank(granted) >= required {
+			return true
+		}
+	}
+	return false
+}
+
+func ValidScope(scope string) bool {
+	return scopeRank(scope) >= 0
+}
+
+// Returns the scopes a token of a user with the role can be granted.
+// Members cannot use the user API, helpdesk users cannot change roles or
+// delete users.
+func RoleScopes(role Role) []string {
+	switch role {
+	case Admin:
+		return AccessTokenScopes
+	case Helpdesk:
+		return []string{ScopeUsersRead, ScopeUsersWrite}
+	default:
+		return []string{}
+	}
+}
+
+func scopeRank(scope string) int {
+	for i, s := range AccessTokenScopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+func InitAccessTokens() AccessTokenDbImpl {
+	err := db.AutoMigrate(&AccessToken{})
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
+	}
+	return AccessTokenDbImpl{}
+}
+
+func (accesstokendbimpl AccessTokenDbImpl) CreateAccessToken(token AccessToken) error {
+	result := db.Create(&token)
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+// Returns the tokens of the user, expired ones included
+func (accesstokendbimpl AccessTokenDbImpl) GetAccessTokens(username string) []AccessToken {
+	tokens := []AccessToken{}
+	db.Where("username = ?", username).Order("created_at desc").Find(&tokens)
+	return tokens
+}
+
+func (accesstokendbimpl AccessTokenDbImpl) GetAccessToken(id string) (*AccessToken, error) {
+	token := AccessToken{}
+	result := db.Where("id = ?", id).Limit(1).Find(&token)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &token, nil
+}
+
+// Returns the unexpired token with the hash, ErrNoResults if there is none
+func (accesstokendbimpl AccessTokenDbImpl) FindAccessToken(hash string) (*AccessToken, error) {
+	token := AccessToken{}
+	result := db.Where("hash = ? AND expires_at > ?", hash, time.Now()).Limit(1).Find(&token)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &token, nil
+}
+
+// Records that the token was used from the IP
+func (accesstokendbimpl AccessTokenDbImpl) TouchAccessToken(id string, ip string) error {
+	return db.Model(&AccessToken{}).Where("id = ?", id).
+		Updates(map[string]any{"last_used_at": time.Now(), "last_used_ip": ip}).Error
+}
+
+func (accesstokendbimpl AccessTokenDbImpl) RevokeAccessToken(id string) error {
+	result := db.Where("id = ?", id).Delete(&AccessToken{})
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return nil
+}
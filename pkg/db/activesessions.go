@@ -0,0 +1,314 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+// How often the last seen time of a session is written to the database
+const sessionTouchInterval = time.Minute
+
+// Indexes the login sessions in the session storage by user. The id is
+// the hash of the session id, so the index can not be used to hijack a
+// session. A login session without an index entry is considered revoked,
+// so the index lives where the sessions do, see sessionIndex.
+type ActiveSession struct {
+	ID           string `gorm:"primarykey"`
+	Username     string `gorm:"index"`
+	CredentialID []byte
+	IP           string
+	UserAgent    string
+	CreatedAt    time.Time
+	LastSeen     time.Time
+	Expires      time.Time
+}
+
+func sessionHash(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores the ActiveSession index. The local database keeps it by default,
+// with AUTH_STORAGE=redis it is kept in the shared storage next to the
+// sessions so that every instance sees the same logins and revocations.
+type sessionIndex interface {
+	// Adds the session to the index
+	save(ActiveSession) error
+	// Refreshes the entry of an indexed session, sessions revoked in the
+	// meantime stay revoked
+	update(ActiveSession) error
+	get(id string) (*ActiveSession, error)
+	delete(id string) error
+	list(username string) []ActiveSession
+}
+
+var activeSessions sessionIndex = dbSessionIndex{}
+
+func createActiveSession(c *fiber.Ctx, sessionID string, username string,
+	credentialID []byte, expires time.Time) error {
+	now := time.Now()
+	return activeSessions.save(ActiveSession{
+		ID:           sessionHash(sessionID),
+		Username:     username,
+		CredentialID: credentialID,
+		IP:           c.IP(),
+		UserAgent:    c.Get(fiber.HeaderUserAgent),
+		CreatedAt:    now,
+		LastSeen:     now,
+		Expires:      expires,
+	})
+}
+
+// Returns the index entry of the session if it has not been revoked. When
+// active is set its last seen time and expiry are refreshed.
+func touchActiveSession(c *fiber.Ctx, sessionID string, username string, active bool,
+	expires time.Time) (*ActiveSession, error) {
+	session, err := activeSessions.get(sessionHash(sessionID))
+	if err != nil {
+		return nil, err
+	}
+	if session.Username != username || !session.Expires.After(time.Now()) {
+		return nil, ErrNoResults
+	}
+	if active {
+		session.LastSeen = time.Now()
+		session.Expires = expires
+		session.IP = c.IP()
+		session.UserAgent = c.Get(fiber.HeaderUserAgent)
+		err := activeSessions.update(*session)
+		if err != nil {
+			log.Err(err).Msg("failed to update active session")
+		}
+	}
+	return session, nil
+}
+
+// Moves the index entry to the new id of a regenerated session
+func rekeyActiveSession(oldID string, newID string) error {
+	session, err := activeSessions.get(sessionHash(oldID))
+	if errors.Is(err, ErrNoResults) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	session.ID = sessionHash(newID)
+	err = activeSessions.save(*session)
+	if err != nil {
+		return err
+	}
+	return activeSessions.delete(sessionHash(oldID))
+}
+
+func deleteActiveSession(sessionID string) error {
+	return activeSessions.delete(sessionHash(sessionID))
+}
+
+// Returns the unexpired sessions of the user, most recently used first
+func (userdbimpl UserDbImpl) GetActiveSessions(username string) []ActiveSession {
+	return activeSessions.list(username)
+}
+
+// Revokes the session with the index id if it belongs to the user
+func (userdbimpl UserDbImpl) RevokeSession(username string, id string) error {
+	session, err := activeSessions.get(id)
+	if err != nil {
+		return err
+	}
+	if session.Username != username {
+		return ErrNoResults
+	}
+	err = activeSessions.delete(id)
+	if err != nil {
+		return err
+	}
+	sessions.revoke(username, []string{id}, false)
+	return nil
+}
+
+// Revokes every session of the user except the one with the index id,
+// returns the number of revoked sessions
+func (userdbimpl UserDbImpl) RevokeSessions(username string, except string) (int64, error) {
+	ids := []string{}
+	for _, session := range activeSessions.list(username) {
+		if session.ID == except {
+			continue
+		}
+		err := activeSessions.delete(session.ID)
+		if err != nil {
+			return int64(len(ids)), err
+		}
+		ids = append(ids, session.ID)
+	}
+	sessions.revoke(username, ids, except == "")
+	return int64(len(ids)), nil
+}
+
+// Keeps the index in the ActiveSession table of the local database
+type dbSessionIndex struct{}
+
+func (dbSessionIndex) save(session ActiveSession) error {
+	return db.Save(&session).Error
+}
+
+func (dbSessionIndex) update(session ActiveSession) error {
+	return db.Model(&ActiveSession{}).Where("id = ?", session.ID).
+		Select("last_seen", "expires", "ip", "user_agent").Updates(&session).Error
+}
+
+func (dbSessionIndex) get(id string) (*ActiveSession, error) {
+	session := ActiveSession{}
+	result := db.Where("id = ?", id).Limit(1).Find(&session)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &session, nil
+}
+
+func (dbSessionIndex) delete(id string) error {
+	return db.Where("id = ?", id).Delete(&ActiveSession{}).Error
+}
+
+func (dbSessionIndex) list(username string) []ActiveSession {
+	// Expired sessions are pruned along the way
+	db.Where("expires <= ?", time.Now()).Delete(&ActiveSession{})
+	sessions := []ActiveSession{}
+	db.Where("username = ? AND expires > ?", username, time.Now()).
+		Order("last_seen desc").Find(&sessions)
+	return sessions
+}
+
+// Keeps the index in a key value storage shared by the instances. Every
+// session is stored under its id and expires with it, the ids of the
+// sessions of a user are kept in a set under the username.
+type storageSessionIndex struct {
+	storage fiber.Storage
+	sets    sessionSets
+}
+
+// The atomic operations on the shared storage the index needs beyond
+// fiber.Storage, so that instances logging in, touching and revoking
+// sessions at the same time do not undo each other's changes
+type sessionSets interface {
+	// Replaces the value of the key only if it still exists
+	replace(key string, val []byte, exp time.Duration) error
+	// Adds the member to the set and extends its expiry
+	add(key string, member string, exp time.Duration) error
+	remove(key string, members ...string) error
+	members(key string) ([]string, error)
+}
+
+func activeSessionKey(id string) string {
+	return "session:" + id
+}
+
+func userSessionsKey(username string) string {
+	return "user:" + username
+}
+
+// The set outlives every session it can hold
+func userSessionsTTL() time.Duration {
+	return max(Policy.AbsoluteTimeout, Policy.RememberAbsoluteTimeout)
+}
+
+func (index storageSessionIndex) save(session ActiveSession) error {
+	ttl := time.Until(session.Expires)
+	if ttl <= 0 {
+		return index.delete(session.ID)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	err = index.storage.Set(activeSessionKey(session.ID), data, ttl)
+	if err != nil {
+		return err
+	}
+	return index.sets.add(userSessionsKey(session.Username), session.ID, userSessionsTTL())
+}
+
+func (index storageSessionIndex) update(session ActiveSession) error {
+	ttl := time.Until(session.Expires)
+	if ttl <= 0 {
+		return index.delete(session.ID)
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return index.sets.replace(activeSessionKey(session.ID), data, ttl)
+}
+
+func (index storageSessionIndex) get(id string) (*ActiveSession, error) {
+	data, err := index.storage.Get(activeSessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, ErrNoResults
+	}
+	session := ActiveSession{}
+	err = json.Unmarshal(data, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (index storageSessionIndex) delete(id string) error {
+	session, err := index.get(id)
+	if errors.Is(err, ErrNoResults) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = index.storage.Delete(activeSessionKey(id))
+	if err != nil {
+		return err
+	}
+	return index.sets.remove(userSessionsKey(session.Username), id)
+}
+
+// Returns the sessions of the user, dropping the ids of expired and
+// deleted sessions from the set
+func (index storageSessionIndex) list(username string) []ActiveSession {
+	ids, err := index.sets.members(userSessionsKey(username))
+	if err != nil {
+		log.Err(err).Msg("failed to load active sessions")
+	}
+	sessions := []ActiveSession{}
+	gone := []string{}
+	for _, id := range ids {
+		session, err := index.get(id)
+		if err != nil {
+			if errors.Is(err, ErrNoResults) {
+				gone = append(gone, id)
+			} else {
+				log.Err(err).Msg("failed to load active session")
+			}
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+	if len(gone) > 0 {
+		err := index.sets.remove(userSessionsKey(username), gone...)
+		if err != nil {
+			log.Err(err).Msg("failed to prune active sessions")
+		}
+	}
+	slices.SortFunc(sessions, func(a, b ActiveSession) int {
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+	return sessions
+}
@@ -0,0 +1,142 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Returned when another writer appended an event after the last event was
+// read, the append can be retried
+var ErrAuditConflict = errors.New("audit log was appended to concurrently")
+
+type AuditDb interface {
+	AppendAuditEvent(AuditEvent, func(AuditEvent) string) (AuditEvent, error)
+	GetAuditEvents(AuditFilter) []AuditEvent
+	IterateAuditEvents(AuditFilter, func(AuditEvent) error) error
+}
+
+type AuditDbImpl struct{}
+
+// An entry in the audit log, each event holds the hash of the previous
+// event so that modifications or deletions can be detected
+type AuditEvent struct {
+	ID           uint `gorm:"primarykey"`
+	Time         time.Time
+	Actor        string `gorm:"index"`
+	Target       string `gorm:"index"`
+	Action       string `gorm:"index"`
+	Outcome      string
+	IP           string
+	UserAgent    string
+	RequestID    string
+	Confirmation string
+	Details      string
+	// Unique, so that only one of several concurrent writers can link an
+	// event to the same previous event
+	PrevHash string `gorm:"uniqueIndex"`
+	Hash     string
+}
+
+type AuditFilter struct {
+	Actor   string
+	Target  string
+	Action  string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	Limit   int
+	Offset  int
+}
+
+func InitAudit() AuditDbImpl {
+	err := db.AutoMigrate(&AuditEvent{})
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
+	}
+	return AuditDbImpl{}
+}
+
+// Appends the event to the log, linking it to the last event. The hash
+// function is called with PrevHash set and its result is stored as Hash.
+// Returns ErrAuditConflict when another event was linked to the last event
+// first.
+func (auditdbimpl AuditDbImpl) AppendAuditEvent(event AuditEvent,
+	hash func(AuditEvent) string) (AuditEvent, error) {
+	last := AuditEvent{}
+	result := db.Order("id desc").Limit(1).Find(&last)
+	if result.Error != nil {
+		return event, result.Error
+	}
+	event.PrevHash = last.Hash
+	event.Hash = hash(event)
+	result = db.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+	if result.Error != nil {
+		return event, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return event, ErrAuditConflict
+	}
+	return event, nil
+}
+
+func (f AuditFilter) apply(query *gorm.DB) *gorm.DB {
+	if len(f.Actor) > 0 {
+		query = query.Where("actor = ?", f.Actor)
+	}
+	if len(f.Target) > 0 {
+		query = query.Where("target = ?", f.Target)
+	}
+	if len(f.Action) > 0 {
+		query = query.Where("action = ?", f.Action)
+	}
+	if len(f.Outcome) > 0 {
+		query = query.Where("outcome = ?", f.Outcome)
+	}
+	if !f.From.IsZero() {
+		query = query.Where("time >= ?", f.From)
+	}
+	if !f.To.IsZero() {
+		query = query.Where("time <= ?", f.To)
+	}
+	return query
+}
+
+// Returns the events matching the filter, newest first
+func (auditdbimpl AuditDbImpl) GetAuditEvents(filter AuditFilter) []AuditEvent {
+	events := []AuditEvent{}
+	query := filter.apply(db.Model(&AuditEvent{})).Order("id desc")
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	if filter.Offset > 0 {
+		query = query.Offset(filter.Offset)
+	}
+	query.Find(&events)
+	return events
+}
+
+// Calls fn with every event matching the filter in the order they were
+// appended, loading the events in batches
+func (auditdbimpl AuditDbImpl) IterateAuditEvents(filter AuditFilter,
+	fn func(AuditEvent) error) error {
+	events := []AuditEvent{}
+	var fnErr error
+	result := filter.apply(db.Model(&AuditEvent{})).
+		FindInBatches(&events, 500, func(tx *gorm.DB, batch int) error {
+			for _, event := range events {
+				fnErr = fn(event)
+				if fnErr != nil {
+					return fnErr
+				}
+			}
+			return nil
+		})
+	if fnErr != nil {
+		return fnErr
+	}
+	return result.Error
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func useTestAuditDb(t *testing.T) AuditDbImpl {
+	t.Helper()
+	useTestDb(t)
+	err := db.AutoMigrate(&AuditEvent{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return AuditDbImpl{}
+}
+
+func testHash(event AuditEvent) string {
+	return fmt.Sprintf("%s>%s", event.PrevHash, event.Action)
+}
+
+func TestAppendAuditEventConflict(t *testing.T) {
+	auditDb := useTestAuditDb(t)
+	if _, err := auditDb.AppendAuditEvent(AuditEvent{Action: "first"}, testHash); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another writer links its event to the same last event between the
+	// read and the insert
+	_, err := auditDb.AppendAuditEvent(AuditEvent{Action: "second"}, func(event AuditEvent) string {
+		db.Create(&AuditEvent{Action: "other", PrevHash: event.PrevHash, Hash: "other"})
+		return testHash(event)
+	})
+	if !errors.Is(err, ErrAuditConflict) {
+		t.Fatalf("expected ErrAuditConflict, got %v", err)
+	}
+	if _, err := auditDb.AppendAuditEvent(AuditEvent{Action: "second"}, testHash); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+}
+
+func TestAppendAuditEventConcurrentKeepsChain(t *testing.T) {
+	auditDb := useTestAuditDb(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				_, err := auditDb.AppendAuditEvent(AuditEvent{Action: fmt.Sprint(i)}, testHash)
+				if err == nil {
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	prev := ""
+	count := 0
+	err := auditDb.IterateAuditEvents(AuditFilter{}, func(event AuditEvent) error {
+		if event.PrevHash != prev {
+			return fmt.Errorf("event %d does not link to the previous event", event.ID)
+		}
+		prev = event.Hash
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 20 {
+		t.Errorf("expected 20 events, got %d", count)
+	}
+}
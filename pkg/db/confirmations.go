@@ -0,0 +1,61 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// A WebAuthn assertion over the canonical description of an admin
+// action, kept so that the approval can be verified independently later
+type Confirmation struct {
+	ID                string `gorm:"primarykey"`
+	Actor             string
+	Action            string
+	Target            string
+	Details           string
+	Canonical         string
+	Challenge         string
+	Expires           time.Time
+	CredentialID      []byte
+	AuthenticatorData []byte
+	ClientDataJSON    []byte
+	Signature         []byte
+	ConfirmedAt       *time.Time
+	UsedAt            *time.Time
+	CreatedAt         time.Time
+}
+
+func (userdbimpl UserDbImpl) SaveConfirmation(confirmation Confirmation) error {
+	result := db.Save(&confirmation)
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	return nil
+}
+
+func (userdbimpl UserDbImpl) GetConfirmation(id string) (*Confirmation, error) {
+	confirmation := Confirmation{}
+	result := db.Where("id = ?", id).First(&confirmation)
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &confirmation, nil
+}
+
+// Marks the confirmed and unused confirmation as used, returns
+// ErrNoResults if there is no such confirmation
+func (userdbimpl UserDbImpl) UseConfirmation(id string) error {
+	result := db.Model(&Confirmation{}).
+		Where("id = ? AND confirmed_at IS NOT NULL AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+var testDbs atomic.Int64
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// Opens an empty in memory database with the user schema and makes it the
+// package database until the test ends
+func useTestDb(tb testing.TB) *gorm.DB {
+	tb.Helper()
+	name := fmt.Sprintf("file:test%d?mode=memory&cache=shared", testDbs.Add(1))
+	testDb, err := gorm.Open(sqlite.Open(name), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = testDb.AutoMigrate(&Credentials{}, &User{}, &Registration{}, &RecoveryCode{},
+		&AccessPass{}, &Confirmation{}, &ActiveSession{}, &RevokedSession{}, &AccessToken{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	previous := db
+	db = testDb
+	tb.Cleanup(func() {
+		db = previous
+		if sqlDb, err := testDb.DB(); err == nil {
+			sqlDb.Close()
+		}
+	})
+	return testDb
+}
+
+// In memory fiber.Storage standing in for redis
+type memoryStorage struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	sets    map[string]map[string]bool
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{entries: map[string]memoryEntry{}, sets: map[string]map[string]bool{}}
+}
+
+func (s *memoryStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil, nil
+	}
+	return append([]byte{}, entry.value...), nil
+}
+
+func (s *memoryStorage) Set(key string, val []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry := memoryEntry{value: append([]byte{}, val...)}
+	if exp > 0 {
+		entry.expires = time.Now().Add(exp)
+	}
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *memoryStorage) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *memoryStorage) Reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = map[string]memoryEntry{}
+	s.sets = map[string]map[string]bool{}
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	return nil
+}
+
+func (s *memoryStorage) replace(key string, val []byte, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil
+	}
+	s.entries[key] = memoryEntry{value: append([]byte{}, val...), expires: time.Now().Add(exp)}
+	return nil
+}
+
+// The sets never expire, sessions outlive no test
+func (s *memoryStorage) add(key string, member string, exp time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sets[key] == nil {
+		s.sets[key] = map[string]bool{}
+	}
+	s.sets[key][member] = true
+	return nil
+}
+
+func (s *memoryStorage) remove(key string, members ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, member := range members {
+		delete(s.sets[key], member)
+	}
+	return nil
+}
+
+func (s *memoryStorage) members(key string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := []string{}
+	for member := range s.sets[key] {
+		members = append(members, member)
+	}
+	return members, nil
+}
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// Key of the logged in User in the request locals
+const UserLocal = "user"
+
+// Caches the users looked up on every authenticated request. Entries are
+// dropped when the user is saved or deleted, the TTL bounds how long
+// changes made by other instances go unnoticed.
+type identityCache struct {
+	mu      sync.RWMutex
+	ttl     time.Duration
+	entries map[string]identity
+	// Incremented on every invalidation, so a lookup racing with a save
+	// does not cache the old user
+	generation uint64
+}
+
+type identity struct {
+	user    User
+	expires time.Time
+}
+
+// Number of entries above which expired entries are pruned
+const identityCacheSize = 10000
+
+var identities = &identityCache{entries: map[string]identity{}}
+
+func (cache *identityCache) get(username string) (*User, uint64, bool) {
+	cache.mu.RLock()
+	defer cache.mu.RUnlock()
+	entry, ok := cache.entries[username]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, cache.generation, false
+	}
+	user := entry.user
+	return &user, cache.generation, true
+}
+
+func (cache *identityCache) set(user User, generation uint64) {
+	if cache.ttl <= 0 {
+		return
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	now := time.Now()
+	if len(cache.entries) >= identityCacheSize {
+		for username, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, username)
+			}
+		}
+	}
+	cache.entries[user.Username] = identity{user: user, expires: now.Add(cache.ttl)}
+}
+
+func (cache *identityCache) invalidate(username string) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	delete(cache.entries, username)
+	cache.generation++
+}
+
+// Returns the user without credentials, served from the identity cache
+// when possible. Use GetUser for users that are going to be modified.
+func (userdbimpl UserDbImpl) GetIdentity(username string) (*User, error) {
+	cached, generation, ok := identities.get(username)
+	if ok {
+		return cached, nil
+	}
+	user := User{}
+	result := db.Where("username = ?", username).Limit(1).Find(&user)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	identities.set(user, generation)
+	return &user, nil
+}
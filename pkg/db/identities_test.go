@@ -0,0 +1,126 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func useIdentityCache(tb testing.TB, ttl time.Duration) {
+	previous := identities
+	identities = &identityCache{ttl: ttl, entries: map[string]identity{}}
+	tb.Cleanup(func() { identities = previous })
+}
+
+func TestIdentityCacheInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, user User)
+		check  func(user *User, err error) bool
+	}{
+		{
+			name: "block",
+			change: func(t *testing.T, user User) {
+				user.Status = Blocked
+				UserDbImpl{}.CreateUser(user)
+			},
+			check: func(user *User, err error) bool { return err == nil && user.Status == Blocked },
+		},
+		{
+			name: "role change",
+			change: func(t *testing.T, user User) {
+				user.Role = Helpdesk
+				UserDbImpl{}.CreateUser(user)
+			},
+			check: func(user *User, err error) bool { return err == nil && user.Role == Helpdesk },
+		},
+		{
+			name: "delete",
+			change: func(t *testing.T, user User) {
+				err := UserDbImpl{}.DeleteUser(user.Username)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(user *User, err error) bool { return errors.Is(err, ErrNoResults) },
+		},
+		{
+			name: "recreate",
+			change: func(t *testing.T, user User) {
+				err := UserDbImpl{}.DeleteUser(user.Username)
+				if err != nil {
+					t.Fatal(err)
+				}
+				UserDbImpl{}.CreateUser(User{ID: []byte("alice2"), Username: user.Username,
+					Status: Open, Role: Admin})
+			},
+			check: func(user *User, err error) bool {
+				return err == nil && string(user.ID) == "alice2" && user.Role == Admin
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testDb := useTestDb(t)
+			useIdentityCache(t, time.Hour)
+			useStoreSessions(t)
+			user := User{ID: []byte("alice"), Username: "alice", Status: Registered, Role: Member}
+			UserDbImpl{}.CreateUser(user)
+
+			_, err := UserDbImpl{}.GetIdentity("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Changes that bypass the user db are not seen while cached
+			testDb.Model(&User{}).Where("username = ?", "alice").Update("role", Helpdesk)
+			cached, err := UserDbImpl{}.GetIdentity("alice")
+			if err != nil || cached.Role != Member {
+				t.Fatalf("identity was not cached: %v %v", cached, err)
+			}
+			testDb.Model(&User{}).Where("username = ?", "alice").Update("role", Member)
+
+			tt.change(t, user)
+			got, err := UserDbImpl{}.GetIdentity("alice")
+			if !tt.check(got, err) {
+				t.Errorf("stale identity after %s: %+v %v", tt.name, got, err)
+			}
+		})
+	}
+}
+
+// Measures GetLoginUser on a fresh request with a logged in session, the
+// identity is looked up twice per request, once to check that the user is
+// not blocked and once to load the user
+func benchmarkGetLoginUser(b *testing.B, ttl time.Duration) {
+	useStoreSessions(b)
+	useIdentityCache(b, ttl)
+	instance := newStoreInstance(b, newMemoryStorage())
+	instance.index = dbSessionIndex{}
+	_, cookie := instance.do("POST", "/login", "")
+	if cookie == "" {
+		b.Fatal("login failed")
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := instance.app.AcquireCtx(&fasthttp.RequestCtx{})
+		c.Request().Header.SetCookie(SessionCookie, cookie)
+		c.Request().Header.Set(PollHeader, "true")
+		_, err := GetLoginUser(c)
+		if err != nil {
+			b.Fatal(err)
+		}
+		instance.app.ReleaseCtx(c)
+	}
+}
+
+func BenchmarkGetLoginUserUncached(b *testing.B) {
+	benchmarkGetLoginUser(b, 0)
+}
+
+func BenchmarkGetLoginUserCached(b *testing.B) {
+	benchmarkGetLoginUser(b, 30*time.Second)
+}
@@ -0,0 +1,73 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type LockoutDb interface {
+	GetLockout(string) (*Lockout, error)
+	SaveLockout(Lockout) error
+	DeleteLockout(string) error
+	GetLockouts() []Lockout
+}
+
+type LockoutDbImpl struct{}
+
+// Failed authentication attempts of an identifier, a username or an IP.
+// Lockouts counts the consecutive lockouts, each one lasts longer.
+type Lockout struct {
+	Identifier  string `gorm:"primarykey"`
+	Failures    int
+	Lockouts    int
+	LastFailure time.Time
+	LockedUntil time.Time `gorm:"index"`
+}
+
+func (l Lockout) Locked() bool {
+	return time.Now().Before(l.LockedUntil)
+}
+
+func InitLockouts() LockoutDbImpl {
+	err := db.AutoMigrate(&Lockout{})
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
+	}
+	return LockoutDbImpl{}
+}
+
+func (lockoutdbimpl LockoutDbImpl) GetLockout(identifier string) (*Lockout, error) {
+	lockout := Lockout{}
+	result := db.Where("identifier = ?", identifier).Limit(1).Find(&lockout)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &lockout, nil
+}
+
+func (lockoutdbimpl LockoutDbImpl) SaveLockout(lockout Lockout) error {
+	return db.Save(&lockout).Error
+}
+
+func (lockoutdbimpl LockoutDbImpl) DeleteLockout(identifier string) error {
+	result := db.Where("identifier = ?", identifier).Delete(&Lockout{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return nil
+}
+
+// Returns the identifiers that are currently locked out, the longest
+// lockouts first
+func (lockoutdbimpl LockoutDbImpl) GetLockouts() []Lockout {
+	lockouts := []Lockout{}
+	db.Where("locked_until > ?", time.Now()).Order("locked_until desc").Find(&lockouts)
+	return lockouts
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+type RecoveryCode struct {
+	ID        uint `gorm:"primarykey"`
+	UserID    []byte
+	Hash      string
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// Replaces all recovery codes of the user with the input codes
+func (userdbimpl UserDbImpl) ReplaceRecoveryCodes(user User, codes []RecoveryCode) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("user_id = ?", user.ID).Delete(&RecoveryCode{})
+		if result.Error != nil {
+			return result.Error
+		}
+		for i := range codes {
+			codes[i].UserID = user.ID
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+// Returns the recovery codes of the user that have not been used
+func (userdbimpl UserDbImpl) GetRecoveryCodes(user User) []RecoveryCode {
+	codes := []RecoveryCode{}
+	db.Where("user_id = ? AND used_at IS NULL", user.ID).Find(&codes)
+	return codes
+}
+
+// Marks the unused recovery code with the input hash as used,
+// returns ErrNoResults if no such code exists
+func (userdbimpl UserDbImpl) UseRecoveryCode(user User, hash string) error {
+	result := db.Model(&RecoveryCode{}).
+		Where("user_id = ? AND hash = ? AND used_at IS NULL", user.ID, hash).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return nil
+}
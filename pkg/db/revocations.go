@@ -0,0 +1,106 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Revokes session tokens before they expire. Either a single session,
+// identified by its index id, or every session of the subject that logged
+// in before the Before time is revoked. Entries are kept until every token
+// they can match has expired.
+type RevokedSession struct {
+	ID        uint   `gorm:"primarykey"`
+	Subject   string `gorm:"index"`
+	SessionID string `gorm:"index"`
+	Before    time.Time
+	Expires   time.Time `gorm:"index"`
+}
+
+// In memory copy of the revocation list, checked on every request so that
+// token validation needs no database round-trip. Revocations made by this
+// instance apply immediately, those of other instances once synced.
+type revocationList struct {
+	mu       sync.RWMutex
+	subjects map[string]time.Time
+	sessions map[string]bool
+}
+
+func newRevocationList(interval time.Duration) *revocationList {
+	list := &revocationList{
+		subjects: map[string]time.Time{},
+		sessions: map[string]bool{},
+	}
+	list.sync()
+	go func() {
+		for range time.Tick(interval) {
+			list.sync()
+		}
+	}()
+	return list
+}
+
+// Reloads the unexpired revocations from the database
+func (list *revocationList) sync() {
+	now := time.Now()
+	db.Where("expires <= ?", now).Delete(&RevokedSession{})
+	revoked := []RevokedSession{}
+	err := db.Where("expires > ?", now).Find(&revoked).Error
+	if err != nil {
+		log.Err(err).Msg("failed to sync session revocations")
+		return
+	}
+	subjects := map[string]time.Time{}
+	sessions := map[string]bool{}
+	for _, r := range revoked {
+		if r.SessionID != "" {
+			sessions[r.SessionID] = true
+		} else if r.Before.After(subjects[r.Subject]) {
+			subjects[r.Subject] = r.Before
+		}
+	}
+	list.mu.Lock()
+	list.subjects = subjects
+	list.sessions = sessions
+	list.mu.Unlock()
+}
+
+// Revokes the sessions with the index ids, or every session of the subject
+// when ids is empty
+func (list *revocationList) add(subject string, ids []string, expires time.Time) {
+	now := time.Now()
+	revoked := []RevokedSession{}
+	if len(ids) == 0 {
+		revoked = append(revoked, RevokedSession{Subject: subject, Before: now, Expires: expires})
+	}
+	for _, id := range ids {
+		revoked = append(revoked, RevokedSession{Subject: subject, SessionID: id, Expires: expires})
+	}
+	err := db.Create(&revoked).Error
+	if err != nil {
+		log.Err(err).Msg("failed to store session revocation")
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if len(ids) == 0 {
+		list.subjects[subject] = now
+	}
+	for _, id := range ids {
+		list.sessions[id] = true
+	}
+}
+
+// Reports whether the session with the index id of the subject, logged in
+// at loginAt, has been revoked
+func (list *revocationList) revoked(subject string, id string, loginAt time.Time) bool {
+	list.mu.RLock()
+	defer list.mu.RUnlock()
+	if list.sessions[id] {
+		return true
+	}
+	before, ok := list.subjects[subject]
+	return ok && !loginAt.After(before)
+}
@@ -2,32 +2,200 @@ package db
 
 import (
 	"errors"
+	"strings"
 	"time"
 
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/session"
-	"github.com/gofiber/storage/sqlite3"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
-var LoginSession *session.Store
+const (
+	AssuranceUserPresent  = "user_present"
+	AssuranceUserVerified = "user_verified"
 
+	// Requests with this header, like htmx polling, do not count as
+	// activity and do not extend idle sessions
+	PollHeader = "X-Session-Poll"
+)
+
+var (
+	LoginSession *session.Store
+	// Name of the session cookie, prefixed with __Host- when served over https
+	SessionCookie = "session_id"
+	Policy        SessionPolicy
+
+	ErrSessionExpired = errors.New("session has expired")
+
+	sessions     sessionBackend = storeBackend{}
+	secureCookie bool
+)
+
+// Timeouts of login sessions. A session expires when it has been idle for
+// the idle timeout or when the absolute timeout has passed since login,
+// whichever comes first. Remembered devices use the longer Remember timeouts.
+type SessionPolicy struct {
+	IdleTimeout             time.Duration
+	AbsoluteTimeout         time.Duration
+	RememberIdleTimeout     time.Duration
+	RememberAbsoluteTimeout time.Duration
+}
+
+// Keeps the state of login sessions, either server side in the session
+// storage or client side in signed tokens
+type sessionBackend interface {
+	login(c *fiber.Ctx, username string, credential webauthn.Credential, remember bool) error
+	validate(c *fiber.Ctx) (string, error)
+	logout(c *fiber.Ctx) error
+	setAuthenticated(c *fiber.Ctx, flags webauthn.CredentialFlags) error
+	getAuthenticated(c *fiber.Ctx) (time.Time, string, error)
+	setRecovery(c *fiber.Ctx, username string) error
+	getRecovery(c *fiber.Ctx) (string, error)
+	// Returns the id of the session in the ActiveSession index
+	currentID(c *fiber.Ctx) string
+	// Revokes the indexed sessions, or every session of the user when all
+	// is set
+	revoke(username string, ids []string, all bool)
+}
+
+// Initializes the login sessions, must be called after InitUsers.
+// AUTH_SESSION_MODE selects between the session storage, "store", and
+// signed session tokens, "token".
 func Init() {
-	sessionStore := sqlite3.New()
+	Policy = SessionPolicy{
+		IdleTimeout:             viper.GetDuration("AUTH_SESSION_IDLE_TIMEOUT"),
+		AbsoluteTimeout:         viper.GetDuration("AUTH_SESSION_ABSOLUTE_TIMEOUT"),
+		RememberIdleTimeout:     viper.GetDuration("AUTH_SESSION_REMEMBER_IDLE_TIMEOUT"),
+		RememberAbsoluteTimeout: viper.GetDuration("AUTH_SESSION_REMEMBER_ABSOLUTE_TIMEOUT"),
+	}
+	secureCookie = strings.HasPrefix(viper.GetString("AUTH_ORIGIN"), "https://")
+	if secureCookie {
+		SessionCookie = "__Host-session_id"
+	}
 
 	LoginSession = session.New(session.Config{
 		CookieSameSite: "strict",
-		Expiration:     time.Hour * 6,
-		Storage:        sessionStore,
+		CookieSecure:   secureCookie,
+		CookieHTTPOnly: true,
+		CookiePath:     "/",
+		KeyLookup:      "cookie:" + SessionCookie,
+		// Sessions that have not logged in use the idle timeout
+		Expiration: Policy.IdleTimeout,
+		Storage:    NewStorage("fiber_storage"),
 	})
+
+	if viper.GetString("AUTH_STORAGE") == "redis" {
+		storage := NewStorage("active_sessions").(prefixStorage)
+		activeSessions = storageSessionIndex{storage, storage.sessionSets()}
+	}
+
+	if viper.GetString("AUTH_SESSION_MODE") == "token" {
+		backend, err := newTokenBackend()
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to configure session tokens")
+		}
+		sessions = backend
+		log.Info().Msg("using stateless session tokens")
+	}
 }
 
 func DeleteLoginSession(c *fiber.Ctx) error {
+	c.Locals(UserLocal, nil)
+	return sessions.logout(c)
+}
+
+// Logs the session in as username after a successful WebAuthn ceremony
+// with the credential. The session gets a new id to prevent fixation and
+// is indexed by user. Remembered sessions use the longer timeouts, a
+// session logging in again as the same user keeps its remembered state.
+func GetLoginSession(c *fiber.Ctx, username string, credential webauthn.Credential,
+	remember bool) error {
+	c.Locals(UserLocal, nil)
+	return sessions.login(c, username, credential, remember)
+}
+
+// Validates the Session attached to input context
+// returns the username or error. Sessions are only valid on the tenant
+// their user belongs to.
+func ValidateLoginSession(c *fiber.Ctx) (username string, err error) {
+	// Requests authenticated by an access token act as its user
+	if token, ok := c.Locals(AccessTokenLocal).(*AccessToken); ok {
+		return token.Username, nil
+	}
+	if len(c.Request().Header.Cookie(SessionCookie)) == 0 {
+		return "", errors.New("no session found")
+	}
+	username, err = sessions.validate(c)
+	if err == nil && TenantOf(username) != RequestTenant(c) {
+		return "", ErrWrongTenant
+	}
+	return username, err
+}
+
+// Returns the logged in user of the request. The user is resolved once per
+// request and kept in the request locals.
+func GetLoginUser(c *fiber.Ctx) (*User, error) {
+	if user, ok := c.Locals(UserLocal).(*User); ok {
+		return user, nil
+	}
+	username, err := ValidateLoginSession(c)
+	if err != nil {
+		return nil, err
+	}
+	user, err := UserDbImpl{}.GetIdentity(username)
+	if err != nil {
+		return nil, err
+	}
+	c.Locals(UserLocal, user)
+	return user, nil
+}
+
+// Records a successful WebAuthn ceremony on the logged in session,
+// sensitive operations require that this happened recently. Like a login
+// the session gets a new id.
+func SetAuthenticated(c *fiber.Ctx, flags webauthn.CredentialFlags) error {
+	return sessions.setAuthenticated(c, flags)
+}
+
+// Returns the time and assurance of the last WebAuthn ceremony
+// performed by the session
+func GetAuthenticated(c *fiber.Ctx) (time.Time, string, error) {
+	return sessions.getAuthenticated(c)
+}
+
+// Marks the session as recovering the account of username. A recovery
+// session is not a login session, it only allows a new passkey to be
+// registered for the account
+func SetRecoverySession(c *fiber.Ctx, username string) error {
+	return sessions.setRecovery(c, username)
+}
+
+// Returns the username of the account the session is recovering
+func GetRecoverySession(c *fiber.Ctx) (string, error) {
+	return sessions.getRecovery(c)
+}
+
+// Returns the index id of the session attached to the context
+func CurrentSessionID(c *fiber.Ctx) string {
+	return sessions.currentID(c)
+}
+
+// Keeps the sessions in the session storage
+type storeBackend struct{}
+
+func (storeBackend) logout(c *fiber.Ctx) error {
 	sess, err := LoginSession.Get(c)
 	if err != nil {
 		log.Err(err)
 		return err
 	}
+	err = deleteActiveSession(sess.ID())
+	if err != nil {
+		log.Err(err)
+		return err
+	}
 	err = sess.Destroy()
 	if err != nil {
 		log.Err(err)
@@ -36,26 +204,77 @@ func DeleteLoginSession(c *fiber.Ctx) error {
 	return nil
 }
 
-func GetLoginSession(c *fiber.Ctx, username string) (*session.Session, error) {
+func (storeBackend) login(c *fiber.Ctx, username string, credential webauthn.Credential,
+	remember bool) error {
 	sess, err := LoginSession.Get(c)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	if sess.Get("username") == username && sess.Get("remember") == int64(1) {
+		remember = true
+	}
+	err = deleteActiveSession(sess.ID())
+	if err != nil {
+		return err
+	}
+	err = regenerate(c, sess)
+	if err != nil {
+		return err
+	}
+
+	idle, absolute := Policy.IdleTimeout, Policy.AbsoluteTimeout
+	sess.Delete("remember")
+	if remember {
+		idle, absolute = Policy.RememberIdleTimeout, Policy.RememberAbsoluteTimeout
+		sess.Set("remember", int64(1))
+	}
+	now := time.Now()
 	sess.Set("username", username)
-	err = sess.Save()
+	sess.Set("idle_timeout", int64(idle.Seconds()))
+	sess.Set("expires_at", now.Add(absolute).Unix())
+	sess.Set("last_active", now.Unix())
+	sess.Delete("recovery")
+	setAuthenticated(sess, credential.Flags)
+	sess.SetExpiry(min(idle, absolute))
+
+	err = createActiveSession(c, sess.ID(), username, credential.ID, now.Add(min(idle, absolute)))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return sess, nil
+	return sess.Save()
 }
 
-// Validates the Session attached to input context
-// returns the username or error
-func ValidateLoginSession(c *fiber.Ctx) (username string, err error) {
-	s := c.Request().Header.Cookie("session_id")
-	if len(s) == 0 {
-		return "", errors.New("no session found")
+// Gives the session a new id, the request cookie is updated as well so
+// the session can be loaded again while handling the request
+func regenerate(c *fiber.Ctx, sess *session.Session) error {
+	err := sess.Regenerate()
+	if err != nil {
+		return err
 	}
+	c.Request().Header.SetCookie(SessionCookie, sess.ID())
+	return nil
+}
+
+// Returns when the session expires if it stays idle from now
+func sessionDeadline(sess *session.Session, now time.Time) (time.Time, error) {
+	idle, ok := sess.Get("idle_timeout").(int64)
+	if !ok {
+		return time.Time{}, ErrSessionExpired
+	}
+	lastActive, _ := sess.Get("last_active").(int64)
+	expiresAt, _ := sess.Get("expires_at").(int64)
+	deadline := time.Unix(lastActive, 0).Add(time.Duration(idle) * time.Second)
+	if absolute := time.Unix(expiresAt, 0); absolute.Before(deadline) {
+		deadline = absolute
+	}
+	if !now.Before(deadline) {
+		return deadline, ErrSessionExpired
+	}
+	return deadline, nil
+}
+
+func (storeBackend) validate(c *fiber.Ctx) (string, error) {
+	s := c.Request().Header.Cookie(SessionCookie)
 	sess, err := LoginSession.Get(c)
 	if err != nil {
 		return "", err
@@ -68,11 +287,131 @@ func ValidateLoginSession(c *fiber.Ctx) (username string, err error) {
 	if !ok {
 		return "", errors.New("could not parse username from session")
 	}
-	user := &User{}
-	db.Where("Username = ?", username).First(&user)
-	if user.ID == nil {
+	now := time.Now()
+	_, err = sessionDeadline(sess, now)
+	if err != nil {
+		logOut(sess)
+		return "", err
+	}
+	user, err := UserDbImpl{}.GetIdentity(username)
+	if err != nil {
 		return username, errors.New("Username does not exist")
 	}
+	if user.Status == Blocked {
+		return username, errors.New("user is blocked")
+	}
+
+	// Polling requests do not extend the session, and activity is only
+	// written once per touch interval
+	active := len(c.Get(PollHeader)) == 0
+	lastActive, _ := sess.Get("last_active").(int64)
+	idle, _ := sess.Get("idle_timeout").(int64)
+	interval := min(sessionTouchInterval, time.Duration(idle)*time.Second/4)
+	refresh := active && now.Sub(time.Unix(lastActive, 0)) >= interval
+	if refresh {
+		sess.Set("last_active", now.Unix())
+	}
+	deadline, _ := sessionDeadline(sess, now)
+	_, err = touchActiveSession(c, sess.ID(), username, refresh, deadline)
+	if err != nil {
+		logOut(sess)
+		return "", errors.New("session has been revoked")
+	}
+	if refresh {
+		sess.SetExpiry(deadline.Sub(now))
+		err = sess.Save()
+		if err != nil {
+			log.Err(err)
+		}
+	}
 
 	return username, nil
 }
+
+// Removes the login from a revoked or expired session
+func logOut(sess *session.Session) {
+	err := deleteActiveSession(sess.ID())
+	if err != nil {
+		log.Err(err)
+	}
+	err = sess.Destroy()
+	if err != nil {
+		log.Err(err)
+	}
+}
+
+func (storeBackend) setAuthenticated(c *fiber.Ctx, flags webauthn.CredentialFlags) error {
+	sess, err := LoginSession.Get(c)
+	if err != nil {
+		return err
+	}
+	oldID := sess.ID()
+	err = regenerate(c, sess)
+	if err != nil {
+		return err
+	}
+	err = rekeyActiveSession(oldID, sess.ID())
+	if err != nil {
+		return err
+	}
+	setAuthenticated(sess, flags)
+	deadline, err := sessionDeadline(sess, time.Now())
+	if err == nil {
+		sess.SetExpiry(time.Until(deadline))
+	}
+	return sess.Save()
+}
+
+func setAuthenticated(sess *session.Session, flags webauthn.CredentialFlags) {
+	assurance := AssuranceUserPresent
+	if flags.UserVerified {
+		assurance = AssuranceUserVerified
+	}
+	sess.Set("auth_time", time.Now().Unix())
+	sess.Set("auth_assurance", assurance)
+}
+
+func (storeBackend) getAuthenticated(c *fiber.Ctx) (time.Time, string, error) {
+	sess, err := LoginSession.Get(c)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	authTime, ok := sess.Get("auth_time").(int64)
+	if !ok {
+		return time.Time{}, "", errors.New("session has not authenticated")
+	}
+	assurance, _ := sess.Get("auth_assurance").(string)
+	return time.Unix(authTime, 0), assurance, nil
+}
+
+func (storeBackend) setRecovery(c *fiber.Ctx, username string) error {
+	sess, err := LoginSession.Get(c)
+	if err != nil {
+		return err
+	}
+	sess.Set("recovery", username)
+	return sess.Save()
+}
+
+func (storeBackend) getRecovery(c *fiber.Ctx) (string, error) {
+	sess, err := LoginSession.Get(c)
+	if err != nil {
+		return "", err
+	}
+	username, ok := sess.Get("recovery").(string)
+	if !ok {
+		return "", errors.New("session is not recovering an account")
+	}
+	return username, nil
+}
+
+func (storeBackend) currentID(c *fiber.Ctx) string {
+	sess, err := LoginSession.Get(c)
+	if err != nil {
+		return ""
+	}
+	return sessionHash(sess.ID())
+}
+
+// Sessions without an index entry are already rejected by validate
+func (storeBackend) revoke(username string, ids []string, all bool) {}
@@ -0,0 +1,218 @@
+package db
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/session"
+	"gorm.io/gorm"
+)
+
+// An instance of the server behind a load balancer, with its own local
+// database and a session store on the storage shared by every instance
+type storeInstance struct {
+	t     testing.TB
+	db    *gorm.DB
+	store *session.Store
+	index sessionIndex
+	app   *fiber.App
+}
+
+func newStoreInstance(t testing.TB, shared *memoryStorage) *storeInstance {
+	instance := &storeInstance{
+		t:     t,
+		db:    useTestDb(t),
+		index: storageSessionIndex{shared, shared},
+		store: session.New(session.Config{
+			KeyLookup:  "cookie:" + SessionCookie,
+			Expiration: time.Hour,
+			Storage:    shared,
+		}),
+		app: fiber.New(),
+	}
+	instance.db.Create(&User{ID: []byte("alice"), Username: "alice", Status: Registered})
+
+	instance.app.Post("/login", func(c *fiber.Ctx) error {
+		return GetLoginSession(c, "alice", webauthn.Credential{ID: []byte("key")}, false)
+	})
+	instance.app.Get("/check", func(c *fiber.Ctx) error {
+		_, err := ValidateLoginSession(c)
+		if err != nil {
+			return c.Status(401).SendString(err.Error())
+		}
+		return nil
+	})
+	instance.app.Get("/sessions", func(c *fiber.Ctx) error {
+		return c.JSON(UserDbImpl{}.GetActiveSessions("alice"))
+	})
+	instance.app.Delete("/sessions", func(c *fiber.Ctx) error {
+		_, err := UserDbImpl{}.RevokeSessions("alice", "")
+		return err
+	})
+	instance.app.Post("/logout", func(c *fiber.Ctx) error {
+		return DeleteLoginSession(c)
+	})
+	return instance
+}
+
+// Sends the request to the instance, the package state is switched to the
+// instance while the request is handled
+func (instance *storeInstance) do(method string, path string, cookie string) (int, string) {
+	instance.t.Helper()
+	db, LoginSession, activeSessions = instance.db, instance.store, instance.index
+	req := httptest.NewRequest(method, path, nil)
+	if cookie != "" {
+		req.Header.Set("Cookie", SessionCookie+"="+cookie)
+	}
+	resp, err := instance.app.Test(req, -1)
+	if err != nil {
+		instance.t.Fatal(err)
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == SessionCookie {
+			cookie = c.Value
+		}
+	}
+	return resp.StatusCode, cookie
+}
+
+func useStoreSessions(t testing.TB) {
+	previousStore, previousIndex, previousPolicy := LoginSession, activeSessions, Policy
+	previousBackend := sessions
+	t.Cleanup(func() {
+		LoginSession, activeSessions, Policy = previousStore, previousIndex, previousPolicy
+		sessions = previousBackend
+	})
+	sessions = storeBackend{}
+	Policy = SessionPolicy{
+		IdleTimeout:             time.Hour,
+		AbsoluteTimeout:         12 * time.Hour,
+		RememberIdleTimeout:     time.Hour,
+		RememberAbsoluteTimeout: 12 * time.Hour,
+	}
+}
+
+func TestSharedStoreSessionValidOnEveryInstance(t *testing.T) {
+	useStoreSessions(t)
+	shared := newMemoryStorage()
+	a, b := newStoreInstance(t, shared), newStoreInstance(t, shared)
+
+	status, cookie := a.do("POST", "/login", "")
+	if status != 200 || cookie == "" {
+		t.Fatalf("login failed: %d %q", status, cookie)
+	}
+	for name, instance := range map[string]*storeInstance{"a": a, "b": b} {
+		if status, _ := instance.do("GET", "/check", cookie); status != 200 {
+			t.Errorf("session rejected by instance %s: %d", name, status)
+		}
+	}
+	var count int64
+	b.db.Model(&ActiveSession{}).Count(&count)
+	if count != 0 {
+		t.Errorf("session indexed in the local database of instance b")
+	}
+}
+
+func TestSharedStoreRevocationAppliesToEveryInstance(t *testing.T) {
+	useStoreSessions(t)
+	shared := newMemoryStorage()
+	a, b := newStoreInstance(t, shared), newStoreInstance(t, shared)
+
+	_, first := a.do("POST", "/login", "")
+	_, second := b.do("POST", "/login", "")
+	if len(a.index.list("alice")) != 2 {
+		t.Fatalf("expected both sessions in the shared index")
+	}
+
+	if status, _ := b.do("DELETE", "/sessions", ""); status != 200 {
+		t.Fatalf("revoke failed: %d", status)
+	}
+	for _, cookie := range []string{first, second} {
+		if status, _ := a.do("GET", "/check", cookie); status != 401 {
+			t.Errorf("revoked session accepted by instance a: %d", status)
+		}
+		if status, _ := b.do("GET", "/check", cookie); status != 401 {
+			t.Errorf("revoked session accepted by instance b: %d", status)
+		}
+	}
+}
+
+func TestSharedStoreLogoutAppliesToEveryInstance(t *testing.T) {
+	useStoreSessions(t)
+	shared := newMemoryStorage()
+	a, b := newStoreInstance(t, shared), newStoreInstance(t, shared)
+
+	_, cookie := a.do("POST", "/login", "")
+	b.do("POST", "/logout", cookie)
+	if status, _ := a.do("GET", "/check", cookie); status != 401 {
+		t.Errorf("logged out session accepted: %d", status)
+	}
+	if sessions := b.index.list("alice"); len(sessions) != 0 {
+		t.Errorf("logged out session still listed: %v", sessions)
+	}
+}
+
+func TestSharedStoreConcurrentLoginsAreAllRevoked(t *testing.T) {
+	useStoreSessions(t)
+	shared := newMemoryStorage()
+	indexes := []sessionIndex{storageSessionIndex{shared, shared}, storageSessionIndex{shared, shared}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := indexes[i%2].save(ActiveSession{
+				ID:       fmt.Sprint(i),
+				Username: "alice",
+				LastSeen: time.Now(),
+				Expires:  time.Now().Add(time.Hour),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	listed := indexes[0].list("alice")
+	if len(listed) != 50 {
+		t.Fatalf("expected 50 sessions in the shared index, got %d", len(listed))
+	}
+	for _, session := range listed {
+		if err := indexes[1].delete(session.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sessions := indexes[0].list("alice"); len(sessions) != 0 {
+		t.Errorf("revoked sessions still listed: %d", len(sessions))
+	}
+}
+
+func TestSharedStoreTouchDoesNotRestoreRevokedSession(t *testing.T) {
+	useStoreSessions(t)
+	shared := newMemoryStorage()
+	index := storageSessionIndex{shared, shared}
+	session := ActiveSession{ID: "1", Username: "alice", LastSeen: time.Now(), Expires: time.Now().Add(time.Hour)}
+
+	if err := index.save(session); err != nil {
+		t.Fatal(err)
+	}
+	if err := index.delete(session.ID); err != nil {
+		t.Fatal(err)
+	}
+	session.LastSeen = time.Now()
+	if err := index.update(session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.get(session.ID); err != ErrNoResults {
+		t.Errorf("touch restored the revoked session: %v", err)
+	}
+	if sessions := index.list("alice"); len(sessions) != 0 {
+		t.Errorf("revoked session listed after a touch: %v", sessions)
+	}
+}
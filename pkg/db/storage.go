@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/storage/redis"
+	"github.com/gofiber/storage/sqlite3"
+	goredis "github.com/redis/go-redis/v9"
+	"github.com/spf13/viper"
+)
+
+// Returns the key value storage for the named collection. AUTH_STORAGE
+// selects between the local "sqlite" database, which is the default, and
+// a "redis" server shared by every instance at AUTH_REDIS_URL.
+func NewStorage(name string) fiber.Storage {
+	if viper.GetString("AUTH_STORAGE") != "redis" {
+		return sqlite3.New(sqlite3.Config{Table: name})
+	}
+	config := redis.Config{URL: viper.GetString("AUTH_REDIS_URL")}
+	// The URL is parsed by the storage, but a TLS config has to be passed
+	// along for rediss URLs
+	if u, err := url.Parse(config.URL); err == nil && u.Scheme == "rediss" {
+		config.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12, ServerName: u.Hostname()}
+	}
+	return prefixStorage{redis.New(config), name + ":"}
+}
+
+// Keeps a collection apart from the others in a shared redis database
+type prefixStorage struct {
+	fiber.Storage
+	prefix string
+}
+
+func (s prefixStorage) Get(key string) ([]byte, error) {
+	return s.Storage.Get(s.prefix + key)
+}
+
+func (s prefixStorage) Set(key string, val []byte, exp time.Duration) error {
+	return s.Storage.Set(s.prefix+key, val, exp)
+}
+
+func (s prefixStorage) Delete(key string) error {
+	return s.Storage.Delete(s.prefix + key)
+}
+
+// Resetting would flush the collections of every instance
+func (s prefixStorage) Reset() error {
+	return errors.New("reset is not supported on a shared storage")
+}
+
+// Runs the set operations of the session index on the redis server of a
+// shared storage, with the prefix of its collection
+func (s prefixStorage) sessionSets() sessionSets {
+	return redisSets{client: s.Storage.(*redis.Storage).Conn(), prefix: s.prefix}
+}
+
+type redisSets struct {
+	client *goredis.Client
+	prefix string
+}
+
+func (s redisSets) replace(key string, val []byte, exp time.Duration) error {
+	return s.client.SetXX(context.Background(), s.prefix+key, val, exp).Err()
+}
+
+func (s redisSets) add(key string, member string, exp time.Duration) error {
+	ctx := context.Background()
+	pipe := s.client.TxPipeline()
+	pipe.SAdd(ctx, s.prefix+key, member)
+	pipe.Expire(ctx, s.prefix+key, exp)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s redisSets) remove(key string, members ...string) error {
+	values := make([]any, len(members))
+	for i, member := range members {
+		values[i] = member
+	}
+	return s.client.SRem(context.Background(), s.prefix+key, values...).Err()
+}
+
+func (s redisSets) members(key string) ([]string, error) {
+	return s.client.SMembers(context.Background(), s.prefix+key).Result()
+}
@@ -0,0 +1,213 @@
+package db
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+const (
+	// Separates the tenant from the name in the usernames of tenant users,
+	// e.g. acme/alice@acme.com. Users of the default tenant have no prefix.
+	TenantSeparator = "/"
+	// Key of the tenant the request was made to in the request locals, not
+	// set for the default tenant
+	TenantLocal = "tenant"
+)
+
+var (
+	ErrInvalidUsername = errors.New("usernames cannot contain " + TenantSeparator)
+	ErrInvalidTenant   = errors.New("tenant ids are lowercase letters, digits and dashes")
+	ErrTenantExists    = errors.New("tenant already exists")
+	ErrTenantSuspended = errors.New("tenant is suspended")
+	ErrWrongTenant     = errors.New("session belongs to another tenant")
+
+	tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+)
+
+type TenantDb interface {
+	GetTenant(string) (*Tenant, error)
+	GetTenants() []Tenant
+	CreateTenant(Tenant) error
+	SaveTenant(Tenant) error
+}
+
+type TenantDbImpl struct{}
+
+type TenantStatus int
+
+const (
+	TenantActive TenantStatus = iota
+	TenantSuspended
+)
+
+func (s TenantStatus) String() string {
+	return []string{"Active", "Suspended"}[s]
+}
+
+// An organization with its own users, selected by subdomain or path prefix
+type Tenant struct {
+	// Subdomain and path prefix of the tenant
+	ID     string       `json:"id" gorm:"primarykey"`
+	Name   string       `json:"name"`
+	Status TenantStatus `json:"status" gorm:"type:integer"`
+	// Relying party of the tenant's passkeys, the RP ID defaults to
+	// AUTH_RPID. Origins is a comma separated list of origins accepted in
+	// addition to the configured ones.
+	RPID    string `json:"rpId"`
+	Origins string `json:"origins"`
+	// Branding of the pages
+	Logo  string `json:"logo"`
+	Theme string `json:"theme"`
+	// Email settings. AdminEmail may register as the first admin of the
+	// tenant, EmailDomain restricts the usernames of new users.
+	AdminEmail  string `json:"adminEmail"`
+	EmailDomain string `json:"emailDomain"`
+	// Sender of the notifications to the tenant's users, sent through the
+	// SMTP server when a host is set. The password is never returned.
+	SenderName   string `json:"senderName"`
+	SenderEmail  string `json:"senderEmail"`
+	SMTPHost     string `json:"smtpHost"`
+	SMTPPort     int    `json:"smtpPort"`
+	SMTPUsername string `json:"smtpUsername"`
+	SMTPPassword string `json:"-"`
+	// SHA-256 of the bearer token of the tenant's SCIM client, SCIM is
+	// disabled for the tenant without one
+	SCIMTokenHash string    `json:"-"`
+	SCIMEnabled   bool      `json:"scimEnabled" gorm:"-"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Sets whether SCIM is enabled, the token hash itself is never returned
+func (t *Tenant) AfterFind(tx *gorm.DB) error {
+	t.SCIMEnabled = t.SCIMTokenHash != ""
+	return nil
+}
+
+// Replaces the SCIM token of the tenant, an empty token disables SCIM
+func (t *Tenant) SetSCIMToken(token string) {
+	t.SCIMTokenHash = ""
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		t.SCIMTokenHash = hex.EncodeToString(sum[:])
+	}
+	t.SCIMEnabled = t.SCIMTokenHash != ""
+}
+
+// Reports whether the token is the SCIM token of the tenant
+func (t Tenant) SCIMTokenMatches(token string) bool {
+	if t.SCIMTokenHash == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	presented := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(presented), []byte(t.SCIMTokenHash)) == 1
+}
+
+// Returns the additional origins of the tenant
+func (t Tenant) OriginList() []string {
+	origins := []string{}
+	for _, origin := range strings.Split(t.Origins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// Reports whether the tenant accepts users with the username
+func (t Tenant) AllowsUsername(username string) bool {
+	if t.EmailDomain == "" {
+		return true
+	}
+	return strings.HasSuffix(strings.ToLower(username), "@"+strings.ToLower(t.EmailDomain))
+}
+
+func ValidTenantID(id string) bool {
+	return tenantIDPattern.MatchString(id)
+}
+
+func InitTenants() TenantDbImpl {
+	err := db.AutoMigrate(&Tenant{})
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
+	}
+	return TenantDbImpl{}
+}
+
+func (tenantdbimpl TenantDbImpl) GetTenant(id string) (*Tenant, error) {
+	tenant := Tenant{}
+	result := db.Where("id = ?", id).Limit(1).Find(&tenant)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &tenant, nil
+}
+
+func (tenantdbimpl TenantDbImpl) GetTenants() []Tenant {
+	tenants := []Tenant{}
+	db.Order("id").Find(&tenants)
+	return tenants
+}
+
+func (tenantdbimpl TenantDbImpl) CreateTenant(tenant Tenant) error {
+	if !ValidTenantID(tenant.ID) {
+		return ErrInvalidTenant
+	}
+	var count int64
+	db.Model(&Tenant{}).Where("id = ?", tenant.ID).Count(&count)
+	if count > 0 {
+		return ErrTenantExists
+	}
+	return db.Create(&tenant).Error
+}
+
+func (tenantdbimpl TenantDbImpl) SaveTenant(tenant Tenant) error {
+	return db.Save(&tenant).Error
+}
+
+// Returns the tenant the request was made to, empty for the default tenant
+func RequestTenant(c *fiber.Ctx) string {
+	tenant, _ := c.Locals(TenantLocal).(string)
+	return tenant
+}
+
+// Returns the username of a user of the request's tenant
+func QualifyUsername(c *fiber.Ctx, username string) (string, error) {
+	if strings.Contains(username, TenantSeparator) {
+		return "", ErrInvalidUsername
+	}
+	if tenant := RequestTenant(c); tenant != "" {
+		return tenant + TenantSeparator + username, nil
+	}
+	return username, nil
+}
+
+// Returns the tenant of a username, empty for the default tenant
+func TenantOf(username string) string {
+	tenant, _, ok := strings.Cut(username, TenantSeparator)
+	if !ok {
+		return ""
+	}
+	return tenant
+}
+
+// Returns the username without its tenant
+func LocalUsername(username string) string {
+	_, local, ok := strings.Cut(username, TenantSeparator)
+	if !ok {
+		return username
+	}
+	return local
+}
@@ -0,0 +1,417 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var ErrInvalidToken = errors.New("invalid session token")
+
+// Claims of a session token. The expiry is the earlier of the idle and
+// absolute deadlines, active sessions get a new token once per touch
+// interval which moves the idle deadline.
+type sessionClaims struct {
+	jwt.RegisteredClaims
+	// Login time in unix milliseconds, kept when the token is reissued
+	LoginAt    int64  `json:"lat,omitempty"`
+	LastActive int64  `json:"lst,omitempty"`
+	Idle       int64  `json:"idl"`
+	Absolute   int64  `json:"abs"`
+	Remember   bool   `json:"rem,omitempty"`
+	AuthTime   int64  `json:"auth_time,omitempty"`
+	Assurance  string `json:"acr,omitempty"`
+	Recovery   string `json:"rec,omitempty"`
+}
+
+// Signing key of session tokens, the kid is included in the token header
+type sessionKey struct {
+	kid    string
+	secret []byte
+	aead   cipher.AEAD
+}
+
+// Keeps the sessions in signed, and optionally encrypted, tokens held by
+// the client. Validation only checks the signature, the expiry and the in
+// memory revocation list, the database is written when a session logs in,
+// is revoked or once per touch interval while active.
+type tokenBackend struct {
+	// The first key signs new tokens, all keys are accepted
+	keys    []sessionKey
+	encrypt bool
+	revoked *revocationList
+}
+
+// Configures the token backend from AUTH_SESSION_KEYS, a comma separated
+// list of kid:base64 secrets. Keys are rotated by prepending a new key and
+// dropping the old one once the tokens it signed have expired.
+func newTokenBackend() (*tokenBackend, error) {
+	backend := &tokenBackend{encrypt: viper.GetBool("AUTH_SESSION_ENCRYPT")}
+	for _, entry := range strings.Split(viper.GetString("AUTH_SESSION_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kid, encoded, ok := strings.Cut(entry, ":")
+		if !ok || kid == "" {
+			return nil, fmt.Errorf("session key %q is not in the form kid:secret", entry)
+		}
+		secret, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			secret, err = base64.RawURLEncoding.DecodeString(encoded)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("session key %s is not base64: %w", kid, err)
+		}
+		if len(secret) < 32 {
+			return nil, fmt.Errorf("session key %s must be at least 32 bytes", kid)
+		}
+		key, err := newSessionKey(kid, secret)
+		if err != nil {
+			return nil, err
+		}
+		backend.keys = append(backend.keys, key)
+	}
+	if len(backend.keys) == 0 {
+		log.Warn().Msg("AUTH_SESSION_KEYS is not set, sessions are lost on restart " +
+			"and can not be shared between instances")
+		secret := make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, secret)
+		if err != nil {
+			return nil, err
+		}
+		key, err := newSessionKey("ephemeral", secret)
+		if err != nil {
+			return nil, err
+		}
+		backend.keys = append(backend.keys, key)
+	}
+	backend.revoked = newRevocationList(viper.GetDuration("AUTH_SESSION_REVOCATION_SYNC"))
+	return backend, nil
+}
+
+func newSessionKey(kid string, secret []byte) (sessionKey, error) {
+	// The encryption key is derived so a secret is never used for both
+	encKey := sha256.Sum256(append([]byte("enc:"), secret...))
+	block, err := aes.NewCipher(encKey[:])
+	if err != nil {
+		return sessionKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return sessionKey{}, err
+	}
+	return sessionKey{kid: kid, secret: secret, aead: aead}, nil
+}
+
+func (backend *tokenBackend) key(kid string) (sessionKey, bool) {
+	for _, key := range backend.keys {
+		if key.kid == kid {
+			return key, true
+		}
+	}
+	return sessionKey{}, false
+}
+
+// Signs the claims and sets the token as session cookie on the response
+// and the request
+func (backend *tokenBackend) issue(c *fiber.Ctx, claims *sessionClaims) error {
+	now := time.Now()
+	idle := time.Duration(claims.Idle) * time.Second
+	expires := time.Unix(claims.LastActive, 0).Add(idle)
+	if absolute := time.Unix(claims.Absolute, 0); absolute.Before(expires) {
+		expires = absolute
+	}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(expires)
+
+	key := backend.keys[0]
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.kid
+	value, err := token.SignedString(key.secret)
+	if err != nil {
+		return err
+	}
+	if backend.encrypt {
+		nonce := make([]byte, key.aead.NonceSize())
+		_, err = io.ReadFull(rand.Reader, nonce)
+		if err != nil {
+			return err
+		}
+		sealed := key.aead.Seal(nonce, nonce, []byte(value), []byte(key.kid))
+		value = key.kid + "." + base64.RawURLEncoding.EncodeToString(sealed)
+	}
+
+	c.Cookie(&fiber.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		Secure:   secureCookie,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	c.Request().Header.SetCookie(SessionCookie, value)
+	return nil
+}
+
+func (backend *tokenBackend) clear(c *fiber.Ctx) {
+	c.Cookie(&fiber.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		Secure:   secureCookie,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+	c.Request().Header.DelCookie(SessionCookie)
+}
+
+// Returns the claims of the session token attached to the context if it
+// is valid, unexpired and not revoked
+func (backend *tokenBackend) current(c *fiber.Ctx) (*sessionClaims, error) {
+	value := c.Cookies(SessionCookie)
+	if value == "" {
+		return nil, errors.New("no session found")
+	}
+	if backend.encrypt {
+		kid, sealed, ok := strings.Cut(value, ".")
+		key, found := backend.key(kid)
+		if !ok || !found {
+			return nil, ErrInvalidToken
+		}
+		data, err := base64.RawURLEncoding.DecodeString(sealed)
+		if err != nil || len(data) < key.aead.NonceSize() {
+			return nil, ErrInvalidToken
+		}
+		size := key.aead.NonceSize()
+		plain, err := key.aead.Open(nil, data[:size], data[size:], []byte(kid))
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+		value = string(plain)
+	}
+
+	claims := &sessionClaims{}
+	_, err := jwt.ParseWithClaims(value, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := backend.key(kid)
+		if !ok {
+			return nil, fmt.Errorf("unknown session key %q", kid)
+		}
+		return key.secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return nil, ErrSessionExpired
+	case err != nil:
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	case claims.ExpiresAt == nil:
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject != "" && backend.revoked.revoked(claims.Subject,
+		sessionHash(claims.ID), time.UnixMilli(claims.LoginAt)) {
+		return nil, errors.New("session has been revoked")
+	}
+	return claims, nil
+}
+
+func newSessionID() (string, error) {
+	id := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+// How long a revocation has to be kept to outlive the tokens it matches
+func revocationExpiry() time.Time {
+	return time.Now().Add(max(Policy.AbsoluteTimeout, Policy.RememberAbsoluteTimeout))
+}
+
+func (backend *tokenBackend) login(c *fiber.Ctx, username string,
+	credential webauthn.Credential, remember bool) error {
+	if claims, err := backend.current(c); err == nil && claims.Subject != "" {
+		if claims.Subject == username && claims.Remember {
+			remember = true
+		}
+		err = deleteActiveSession(claims.ID)
+		if err != nil {
+			return err
+		}
+	}
+	id, err := newSessionID()
+	if err != nil {
+		return err
+	}
+
+	idle, absolute := Policy.IdleTimeout, Policy.AbsoluteTimeout
+	if remember {
+		idle, absolute = Policy.RememberIdleTimeout, Policy.RememberAbsoluteTimeout
+	}
+	now := time.Now()
+	claims := &sessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{Subject: username, ID: id},
+		LoginAt:          now.UnixMilli(),
+		LastActive:       now.Unix(),
+		Idle:             int64(idle.Seconds()),
+		Absolute:         now.Add(absolute).Unix(),
+		Remember:         remember,
+	}
+	setTokenAuthenticated(claims, credential.Flags)
+
+	err = createActiveSession(c, id, username, credential.ID, now.Add(min(idle, absolute)))
+	if err != nil {
+		return err
+	}
+	return backend.issue(c, claims)
+}
+
+func (backend *tokenBackend) validate(c *fiber.Ctx) (string, error) {
+	claims, err := backend.current(c)
+	if err != nil {
+		backend.clear(c)
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("session is not logged in")
+	}
+
+	// Polling requests do not extend the session, a new token is only
+	// issued once per touch interval
+	now := time.Now()
+	idle := time.Duration(claims.Idle) * time.Second
+	interval := min(sessionTouchInterval, idle/4)
+	if len(c.Get(PollHeader)) > 0 || now.Sub(time.Unix(claims.LastActive, 0)) < interval {
+		return claims.Subject, nil
+	}
+	claims.LastActive = now.Unix()
+	deadline := now.Add(idle)
+	if absolute := time.Unix(claims.Absolute, 0); absolute.Before(deadline) {
+		deadline = absolute
+	}
+	_, err = touchActiveSession(c, claims.ID, claims.Subject, true, deadline)
+	if err != nil {
+		// Revoked by an instance that has not been synced yet
+		backend.clear(c)
+		return "", errors.New("session has been revoked")
+	}
+	err = backend.issue(c, claims)
+	if err != nil {
+		log.Err(err).Msg("failed to reissue session token")
+	}
+	return claims.Subject, nil
+}
+
+func (backend *tokenBackend) logout(c *fiber.Ctx) error {
+	claims, err := backend.current(c)
+	backend.clear(c)
+	if err != nil {
+		return nil
+	}
+	if claims.Subject != "" {
+		err = deleteActiveSession(claims.ID)
+		if err != nil {
+			return err
+		}
+		// Copies of the token are no longer accepted either
+		backend.revoked.add(claims.Subject, []string{sessionHash(claims.ID)}, claims.ExpiresAt.Time)
+	}
+	return nil
+}
+
+func (backend *tokenBackend) setAuthenticated(c *fiber.Ctx, flags webauthn.CredentialFlags) error {
+	claims, err := backend.current(c)
+	if err != nil {
+		return err
+	}
+	if claims.Subject != "" {
+		id, err := newSessionID()
+		if err != nil {
+			return err
+		}
+		err = rekeyActiveSession(claims.ID, id)
+		if err != nil {
+			return err
+		}
+		backend.revoked.add(claims.Subject, []string{sessionHash(claims.ID)}, claims.ExpiresAt.Time)
+		claims.ID = id
+	}
+	setTokenAuthenticated(claims, flags)
+	return backend.issue(c, claims)
+}
+
+func setTokenAuthenticated(claims *sessionClaims, flags webauthn.CredentialFlags) {
+	claims.AuthTime = time.Now().Unix()
+	claims.Assurance = AssuranceUserPresent
+	if flags.UserVerified {
+		claims.Assurance = AssuranceUserVerified
+	}
+}
+
+func (backend *tokenBackend) getAuthenticated(c *fiber.Ctx) (time.Time, string, error) {
+	claims, err := backend.current(c)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if claims.AuthTime == 0 {
+		return time.Time{}, "", errors.New("session has not authenticated")
+	}
+	return time.Unix(claims.AuthTime, 0), claims.Assurance, nil
+}
+
+func (backend *tokenBackend) setRecovery(c *fiber.Ctx, username string) error {
+	claims, err := backend.current(c)
+	if err != nil {
+		now := time.Now()
+		claims = &sessionClaims{
+			LastActive: now.Unix(),
+			Idle:       int64(Policy.IdleTimeout.Seconds()),
+			Absolute:   now.Add(Policy.IdleTimeout).Unix(),
+		}
+	}
+	claims.Recovery = username
+	return backend.issue(c, claims)
+}
+
+func (backend *tokenBackend) getRecovery(c *fiber.Ctx) (string, error) {
+	claims, err := backend.current(c)
+	if err != nil {
+		return "", err
+	}
+	if claims.Recovery == "" {
+		return "", errors.New("session is not recovering an account")
+	}
+	return claims.Recovery, nil
+}
+
+func (backend *tokenBackend) currentID(c *fiber.Ctx) string {
+	claims, err := backend.current(c)
+	if err != nil || claims.Subject == "" {
+		return ""
+	}
+	return sessionHash(claims.ID)
+}
+
+func (backend *tokenBackend) revoke(username string, ids []string, all bool) {
+	if all {
+		ids = nil
+	} else if len(ids) == 0 {
+		return
+	}
+	backend.revoked.add(username, ids, revocationExpiry())
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"strings"
 	"time"
@@ -10,17 +12,26 @@ import (
 
 	"github.com/go-webauthn/webauthn/protocol"
 	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 )
 
 var (
 	ErrNoResults = errors.New("no results found")
 	db           *gorm.DB
+	// Pending registration and login ceremonies
+	ceremonies fiber.Storage
 )
 
+// Lifetime of ceremonies that do not set an expiry
+const ceremonyTimeout = 5 * time.Minute
+
 type UserDb interface {
 	GetUser(string) (*User, error)
+	GetIdentity(string) (*User, error)
 	GetUsers() []User
+	GetTenantUsers(string) []User
 	DeleteUser(string) error
 	CreateUser(User) error
 	CreateSession(Sessions) error
@@ -28,6 +39,19 @@ type UserDb interface {
 	GetUserSession(User) Sessions
 	GetUserCredentials(User) []Credentials
 	CreateCredentials(Credentials) error
+	ReplaceRecoveryCodes(User, []RecoveryCode) error
+	GetRecoveryCodes(User) []RecoveryCode
+	UseRecoveryCode(User, string) error
+	CreateAccessPass(AccessPass) error
+	UseAccessPass(User, string) (*AccessPass, error)
+	DeleteUserCredentials(User) error
+	DeleteCredential(User, []byte) error
+	SaveConfirmation(Confirmation) error
+	GetConfirmation(string) (*Confirmation, error)
+	UseConfirmation(string) error
+	GetActiveSessions(string) []ActiveSession
+	RevokeSession(string, string) error
+	RevokeSessions(string, string) (int64, error)
 }
 
 type UserDbImpl struct{}
@@ -37,12 +61,36 @@ func (userdbimpl UserDbImpl) CreateCredentials(c Credentials) error {
 	return nil
 }
 
+// Returns the pending WebAuthn ceremony of the user
 func (userdbimpl UserDbImpl) GetUserSession(user User) Sessions {
 	session := Sessions{}
-	db.Where("user_id = ?", user.ID).First(&session)
+	data, err := ceremonies.Get(ceremonyKey(user.ID))
+	if err != nil {
+		log.Err(err).Msg("failed to load ceremony session")
+		return session
+	}
+	if data != nil {
+		err = json.Unmarshal(data, &session)
+		if err != nil {
+			log.Err(err).Msg("failed to parse ceremony session")
+		}
+	}
 	return session
 }
 
+// Deletes the credential with the input id if it belongs to the user
+func (userdbimpl UserDbImpl) DeleteCredential(user User, id []byte) error {
+	result := db.Where("user_id = ? AND id = ?", user.ID, id).Delete(&Credentials{})
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return nil
+}
+
 func (userdbimpl UserDbImpl) GetUserCredentials(user User) []Credentials {
 	credentials := []Credentials{}
 	db.Where("user_id = ?", user.ID).Find(&credentials)
@@ -55,24 +103,45 @@ func (userdbimpl UserDbImpl) GetUsers() []User {
 	return users
 }
 
-func (userdbimpl UserDbImpl) DeleteSessions(user User) error {
-	db.Where("user_id = ?", user.ID).Delete(&Sessions{})
-	return nil
+// Returns the users of a tenant, the default tenant is empty. Users created
+// before tenants existed have no tenant.
+func (userdbimpl UserDbImpl) GetTenantUsers(tenant string) []User {
+	users := []User{}
+	db.Where("coalesce(tenant, '') = ?", tenant).Find(&users)
+	return users
 }
-func (userdbimpl UserDbImpl) GetUserSessions(user User) (Sessions, error) {
-	session := &Sessions{}
-	db.Where("user_id = ?", user.ID).First(&session)
-	return *session, nil
+
+func (userdbimpl UserDbImpl) DeleteSessions(user User) error {
+	return ceremonies.Delete(ceremonyKey(user.ID))
 }
 
 func (userdbimpl UserDbImpl) CreateUser(user User) error {
 	log.Printf("saving user: %v", user)
+	user.Tenant = TenantOf(user.Username)
 	db.Save(user)
+	identities.invalidate(user.Username)
 	return nil
 }
+
+// Stores the pending WebAuthn ceremony of the user until it expires, a
+// user has at most one ceremony in progress
 func (userdbimpl UserDbImpl) CreateSession(session Sessions) error {
-	db.Save(session)
-	return nil
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ttl := time.Until(session.Expires)
+	if session.Expires.IsZero() {
+		ttl = ceremonyTimeout
+	}
+	if ttl <= 0 {
+		return errors.New("ceremony session has expired")
+	}
+	return ceremonies.Set(ceremonyKey(session.UserID), data, ttl)
+}
+
+func ceremonyKey(userID []byte) string {
+	return base64.RawURLEncoding.EncodeToString(userID)
 }
 
 func InitUsers() UserDbImpl {
@@ -81,8 +150,11 @@ func InitUsers() UserDbImpl {
 		log.Fatal().Msg("Failed to open connection to db")
 	}
 	db = usersDb
+	ceremonies = NewStorage("ceremonies")
+	identities.ttl = viper.GetDuration("AUTH_IDENTITY_CACHE_TTL")
 
-	err = db.AutoMigrate(&Sessions{}, &Credentials{}, &User{}, &Registration{})
+	err = db.AutoMigrate(&Credentials{}, &User{}, &Registration{},
+		&RecoveryCode{}, &AccessPass{}, &Confirmation{}, &ActiveSession{}, &RevokedSession{})
 	if err != nil {
 		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
 	}
@@ -131,6 +203,18 @@ func (d UserDbImpl) DeleteUser(username string) error {
 		log.Debug().Msg("User Id was not found")
 		return ErrNoResults
 	}
+	identities.invalidate(username)
+
+	result = db.Where("username = ?", username).Delete(&AccessToken{})
+	if result.Error != nil {
+		log.Err(result.Error)
+		return result.Error
+	}
+	_, err := UserDbImpl{}.RevokeSessions(username, "")
+	if err != nil {
+		log.Err(err)
+		return err
+	}
 
 	return nil
 }
@@ -144,7 +228,7 @@ func (user User) WebAuthnName() string {
 }
 
 func (user User) WebAuthnDisplayName() string {
-	return user.Username
+	return LocalUsername(user.Username)
 }
 
 func (user User) WebAuthnIcon() string {
@@ -163,6 +247,9 @@ func (user User) WebAuthnCredentials() []webauthn.Credential {
 		transportStrings := strings.Split(cred.Transport, ",")
 		var transport []protocol.AuthenticatorTransport
 		for i := range transportStrings {
+			if len(transportStrings[i]) == 0 {
+				continue
+			}
 			transport = append(transport, protocol.AuthenticatorTransport(transportStrings[i]))
 		}
 		c = append(c, webauthn.Credential{
@@ -183,10 +270,11 @@ const (
 	Registered RegistrationStatus = iota
 	Open
 	Blocked
+	Recovering
 )
 
 func (s RegistrationStatus) String() string {
-	return []string{"Registered", "Open", "Blocked"}[s]
+	return []string{"Registered", "Open", "Blocked", "Recovering"}[s]
 }
 
 type Role int
@@ -194,19 +282,31 @@ type Role int
 const (
 	Admin Role = iota
 	Member
+	Helpdesk
 )
 
 func (r Role) String() string {
-	return []string{"Admin", "Member"}[r]
+	return []string{"Admin", "Member", "Helpdesk"}[r]
+}
+
+// Reports whether the role has at least the privileges of the other role,
+// the roles are not declared in that order
+func (r Role) Includes(other Role) bool {
+	privilege := map[Role]int{Member: 0, Helpdesk: 1, Admin: 2}
+	return privilege[r] >= privilege[other]
 }
 
 type User struct {
 	ID          []byte `json:"id" gorm:"primarykey"`
 	Username    string `json:"username"`
-	Sessions    []Sessions
 	Credentials []Credentials
 	Role        Role               `gorm:"type:integer"`
 	Status      RegistrationStatus `gorm:"type:integer"`
+	// Tenant of the user, derived from the username
+	Tenant string `json:"tenant" gorm:"index"`
+	// Service accounts have no passkeys and only call the API with their
+	// access tokens
+	ServiceAccount bool `json:"serviceAccount"`
 }
 
 type Credentials struct {
@@ -218,13 +318,33 @@ type Credentials struct {
 	Authentication  webauthn.Authenticator   `gorm:"embedded"`
 	UserID          []byte
 	UserUsername    string
+	CreatedAt       time.Time
+	// Authenticator model and FIDO certification level from the metadata
+	Description   string
+	Certification string
+	// Whether the attestation chain was verified against the metadata
+	// roots of the model at registration
+	Attested bool
+	// Name of the authenticator model from the aaguid catalogue
+	Name string
+	// Outcomes of the requested extensions, Discoverable is nil when the
+	// client did not tell
+	Discoverable    *bool
+	CredProtect     int
+	PRF             bool
+	LargeBlob       bool
+	LargeBlobStored bool
 }
 
+// State of a pending WebAuthn ceremony
 type Sessions struct {
 	Challenge                   string `gorm:"primarykey"`
 	UserDisplayName             string
 	Expires                     time.Time
 	UserVerificationRequirement protocol.UserVerificationRequirement `gorm:"embedded"`
-	UserUsername                string
-	UserID                      []byte `gorm:"primarykey"`
+	// Extensions requested by the ceremony, the appid has to be known to
+	// verify assertions of legacy U2F credentials
+	Extensions   protocol.AuthenticationExtensions
+	UserUsername string
+	UserID       []byte `gorm:"primarykey"`
 }
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+type WebhookDb interface {
+	CreateWebhook(*Webhook) error
+	GetWebhooks() []Webhook
+	GetWebhook(uint) (*Webhook, error)
+	DeleteWebhook(uint) error
+	CreateDelivery(*WebhookDelivery) error
+	SaveDelivery(WebhookDelivery) error
+	GetDelivery(uint) (*WebhookDelivery, error)
+	GetDeliveries(webhookID uint, limit int) []WebhookDelivery
+}
+
+type WebhookDbImpl struct{}
+
+// An endpoint that is notified of user lifecycle events. Events holds a
+// comma separated list of event types, empty subscribes to every event.
+type Webhook struct {
+	ID        uint `gorm:"primarykey"`
+	URL       string
+	Secret    string `json:"-"`
+	Events    string
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+func (w Webhook) Subscribes(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range strings.Split(w.Events, ",") {
+		if strings.TrimSpace(e) == event {
+			return true
+		}
+	}
+	return false
+}
+
+// A delivery of an event to a webhook, redeliveries reuse the delivery so
+// receivers can deduplicate on its id
+type WebhookDelivery struct {
+	ID          uint `gorm:"primarykey"`
+	WebhookID   uint `gorm:"index"`
+	Event       string
+	Payload     string
+	Attempts    int
+	StatusCode  int
+	Error       string
+	CreatedAt   time.Time
+	DeliveredAt *time.Time
+}
+
+func InitWebhooks() WebhookDbImpl {
+	err := db.AutoMigrate(&Webhook{}, &WebhookDelivery{})
+	if err != nil {
+		log.Fatal().Msgf("Failed to migrate schema: %v", err.Error())
+	}
+	return WebhookDbImpl{}
+}
+
+func (webhookdbimpl WebhookDbImpl) CreateWebhook(webhook *Webhook) error {
+	return db.Create(webhook).Error
+}
+
+func (webhookdbimpl WebhookDbImpl) GetWebhooks() []Webhook {
+	webhooks := []Webhook{}
+	db.Order("id").Find(&webhooks)
+	return webhooks
+}
+
+func (webhookdbimpl WebhookDbImpl) GetWebhook(id uint) (*Webhook, error) {
+	webhook := Webhook{}
+	result := db.Limit(1).Find(&webhook, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &webhook, nil
+}
+
+// Deletes the webhook together with its delivery log
+func (webhookdbimpl WebhookDbImpl) DeleteWebhook(id uint) error {
+	result := db.Delete(&Webhook{}, id)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrNoResults
+	}
+	return db.Where("webhook_id = ?", id).Delete(&WebhookDelivery{}).Error
+}
+
+func (webhookdbimpl WebhookDbImpl) CreateDelivery(delivery *WebhookDelivery) error {
+	return db.Create(delivery).Error
+}
+
+func (webhookdbimpl WebhookDbImpl) SaveDelivery(delivery WebhookDelivery) error {
+	return db.Save(&delivery).Error
+}
+
+func (webhookdbimpl WebhookDbImpl) GetDelivery(id uint) (*WebhookDelivery, error) {
+	delivery := WebhookDelivery{}
+	result := db.Limit(1).Find(&delivery, id)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrNoResults
+	}
+	return &delivery, nil
+}
+
+// Returns the latest deliveries of the webhook, newest first
+func (webhookdbimpl WebhookDbImpl) GetDeliveries(webhookID uint, limit int) []WebhookDelivery {
+	deliveries := []WebhookDelivery{}
+	db.Where("webhook_id = ?", webhookID).Order("id desc").Limit(limit).Find(&deliveries)
+	return deliveries
+}
@@ -0,0 +1,107 @@
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var (
+	// Returned instead of the real reason when enumeration protection is on
+	ErrAuthenticationFailed = errors.New("Authentication failed")
+
+	enumerationProtection bool
+	enumerationKey        []byte
+	enumerationMinLatency time.Duration
+)
+
+// Lengths and transports of the credentials of popular authenticators,
+// fake credentials pick one of each so they look like real ones
+var (
+	fakeCredentialLengths = []int{16, 20, 32, 64}
+	fakeTransports        = []string{"internal,hybrid", "hybrid,internal", "usb,nfc", "usb"}
+)
+
+// Configures enumeration protection from AUTH_ENUMERATION_PROTECTION. The
+// fake credential ids are derived with AUTH_ENUMERATION_KEY, which has to
+// be shared between instances so they return the same ids.
+func initEnumerationProtection() error {
+	enumerationProtection = viper.GetBool("AUTH_ENUMERATION_PROTECTION")
+	enumerationMinLatency = viper.GetDuration("AUTH_ENUMERATION_MIN_LATENCY")
+	if !enumerationProtection {
+		return nil
+	}
+	key := viper.GetString("AUTH_ENUMERATION_KEY")
+	if key == "" {
+		log.Warn().Msg("AUTH_ENUMERATION_KEY is not set, fake credentials change on restart")
+		enumerationKey = make([]byte, 32)
+		_, err := io.ReadFull(rand.Reader, enumerationKey)
+		return err
+	}
+	var err error
+	enumerationKey, err = base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("AUTH_ENUMERATION_KEY must be base64")
+	}
+	return nil
+}
+
+// Reports whether unknown and blocked usernames get fake login options
+func EnumerationProtection() bool {
+	return enumerationProtection
+}
+
+// Delays the response until at least the minimum latency has passed since
+// start, so responses for existing and unknown usernames take equally long
+func UniformLatency(start time.Time) {
+	if enumerationProtection {
+		time.Sleep(time.Until(start.Add(enumerationMinLatency)))
+	}
+}
+
+func enumerationMAC(username string, purpose string) []byte {
+	mac := hmac.New(sha256.New, enumerationKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strings.ToLower(username)))
+	return mac.Sum(nil)
+}
+
+// Returns login options for a username that can not log in. They look like
+// those of a real user, and repeated requests for the username return the
+// same credentials.
+func fakeLoginOptions(username string, largeBlob LargeBlobOperation) (*protocol.CredentialAssertion, error) {
+	seed := enumerationMAC(username, "seed")
+	user := db.User{ID: enumerationMAC(username, "user"), Username: username}
+	count := 1 + int(seed[0]%3)/2
+	for i := 0; i < count; i++ {
+		length := fakeCredentialLengths[int(seed[1+i])%len(fakeCredentialLengths)]
+		id := []byte{}
+		for n := 0; len(id) < length; n++ {
+			id = append(id, enumerationMAC(username, fmt.Sprintf("credential/%d/%d", i, n))...)
+		}
+		user.Credentials = append(user.Credentials, db.Credentials{
+			ID:        id[:length],
+			Transport: fakeTransports[int(seed[3+i])%len(fakeTransports)],
+		})
+	}
+	rp, err := relyingParty(username)
+	if err != nil {
+		return nil, err
+	}
+	options, _, err := rp.BeginLogin(user,
+		webauthn.WithAssertionExtensions(loginExtensions(user, largeBlob)))
+	return options, err
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/a19simma/go-webauthn-htmx/pkg/policy"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Large blob operation a login is asked to perform
+type LargeBlobOperation string
+
+const (
+	LargeBlobNone  LargeBlobOperation = ""
+	LargeBlobRead  LargeBlobOperation = "read"
+	LargeBlobWrite LargeBlobOperation = "write"
+)
+
+var (
+	ErrExtensionDisabled = errors.New("extension is not enabled")
+	ErrInvalidLargeBlob  = errors.New("large blob operation must be read or write")
+
+	extensions ExtensionConfig
+)
+
+// Extensions requested from authenticators
+type ExtensionConfig struct {
+	// Asks whether credentials are discoverable
+	CredProps bool
+	// Evaluates the PRF of the credential at every login, the output stays
+	// with the client for application level encryption
+	PRF bool
+	// Lets logins read or write a blob stored on the authenticator
+	LargeBlob bool
+}
+
+// Configures the extensions from AUTH_EXTENSIONS_CRED_PROPS,
+// AUTH_EXTENSIONS_PRF and AUTH_EXTENSIONS_LARGE_BLOB. The credProtect level
+// is part of the authenticator policy of the role.
+func initExtensions() {
+	extensions = ExtensionConfig{
+		CredProps: viper.GetBool("AUTH_EXTENSIONS_CRED_PROPS"),
+		PRF:       viper.GetBool("AUTH_EXTENSIONS_PRF"),
+		LargeBlob: viper.GetBool("AUTH_EXTENSIONS_LARGE_BLOB"),
+	}
+	log.Info().Interface("extensions", extensions).Msg("webauthn extensions")
+}
+
+// Parses the large blob operation requested by the client
+func ParseLargeBlobOperation(s string) (LargeBlobOperation, error) {
+	switch op := LargeBlobOperation(s); op {
+	case LargeBlobNone, LargeBlobRead, LargeBlobWrite:
+		if op != LargeBlobNone && !extensions.LargeBlob {
+			return op, ErrExtensionDisabled
+		}
+		return op, nil
+	default:
+		return op, ErrInvalidLargeBlob
+	}
+}
+
+func registrationExtensions(p policy.Policy) protocol.AuthenticationExtensions {
+	ext := protocol.AuthenticationExtensions{}
+	if extensions.CredProps {
+		ext["credProps"] = true
+	}
+	if extensions.PRF {
+		ext["prf"] = map[string]interface{}{}
+	}
+	if extensions.LargeBlob {
+		ext["largeBlob"] = map[string]interface{}{"support": "preferred"}
+	}
+	if policyName, ok := credProtectPolicies[p.CredProtect]; ok {
+		ext["credentialProtectionPolicy"] = policyName
+		ext["enforceCredentialProtectionPolicy"] = true
+	}
+	return ext
+}
+
+// Names of the credProtect levels in the WebAuthn extension
+var credProtectPolicies = map[int]string{
+	1: "userVerificationOptional",
+	2: "userVerificationOptionalWithCredentialIDList",
+	3: "userVerificationRequired",
+}
+
+// Returns the extensions of a login. They only depend on the user id, so
+// the fake options of unknown users carry the same ones. A write carries
+// an empty blob the client replaces with its data.
+func loginExtensions(user db.User, op LargeBlobOperation) protocol.AuthenticationExtensions {
+	ext := protocol.AuthenticationExtensions{}
+	if extensions.PRF {
+		ext["prf"] = map[string]interface{}{
+			"eval": map[string]interface{}{"first": prfSalt(user.ID)},
+		}
+	}
+	switch op {
+	case LargeBlobRead:
+		ext["largeBlob"] = map[string]interface{}{"read": true}
+	case LargeBlobWrite:
+		ext["largeBlob"] = map[string]interface{}{"write": ""}
+	}
+	return ext
+}
+
+// The PRF input of a user, it stays the same so the output of a credential
+// does too
+func prfSalt(userID []byte) string {
+	salt := sha256.Sum256(append([]byte("go-webauthn-htmx prf\x00"), userID...))
+	return base64.RawURLEncoding.EncodeToString(salt[:])
+}
+
+// Records the outcomes of the extensions of a registration on the
+// credential
+func applyRegistrationResults(credential *db.Credentials, results protocol.AuthenticationExtensionsClientOutputs,
+	authData protocol.AuthenticatorData) {
+	if credProps, ok := results["credProps"].(map[string]interface{}); ok {
+		if rk, ok := credProps["rk"].(bool); ok {
+			credential.Discoverable = &rk
+		}
+	}
+	if prf, ok := results["prf"].(map[string]interface{}); ok {
+		credential.PRF, _ = prf["enabled"].(bool)
+	}
+	if largeBlob, ok := results["largeBlob"].(map[string]interface{}); ok {
+		credential.LargeBlob, _ = largeBlob["supported"].(bool)
+	}
+	if authData.Flags.HasExtensions() && len(authData.ExtData) > 0 {
+		outputs := map[string]interface{}{}
+		err := webauthncbor.Unmarshal(authData.ExtData, &outputs)
+		if err != nil {
+			log.Err(err).Msg("failed to parse authenticator extension outputs")
+			return
+		}
+		if level, ok := outputs["credProtect"].(uint64); ok {
+			credential.CredProtect = int(level)
+		}
+	}
+}
+
+// Records the outcomes of the extensions of a login on the credential,
+// returns whether anything changed
+func applyLoginResults(credential *db.Credentials, results protocol.AuthenticationExtensionsClientOutputs) bool {
+	changed := false
+	if prf, ok := results["prf"].(map[string]interface{}); ok {
+		if enabled, _ := prf["enabled"].(bool); enabled && !credential.PRF {
+			credential.PRF = true
+			changed = true
+		}
+	}
+	if largeBlob, ok := results["largeBlob"].(map[string]interface{}); ok {
+		if written, _ := largeBlob["written"].(bool); written && !credential.LargeBlobStored {
+			credential.LargeBlob = true
+			credential.LargeBlobStored = true
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,426 @@
+package mds
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/metadata"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrInvalidBLOB          = errors.New("invalid metadata blob")
+	ErrOutdatedBLOB         = errors.New("metadata blob is not newer than the loaded one")
+	ErrNotLoaded            = errors.New("no metadata blob is loaded")
+	ErrUnknownAuthenticator = errors.New("authenticator is not listed in the metadata")
+	ErrAuthenticatorStatus  = errors.New("authenticator has been revoked or compromised")
+	ErrAttestationMissing   = errors.New("authenticator did not provide an attestation")
+	ErrAttestationUntrusted = errors.New("attestation does not chain to a root of the authenticator")
+
+	mu                 sync.RWMutex
+	current            *BLOB
+	modTime            time.Time
+	path               string
+	root               *x509.Certificate
+	requireAttestation bool
+)
+
+// The parts of a metadata statement used by the service
+type Statement struct {
+	Description                 string   `json:"description"`
+	AttestationRootCertificates []string `json:"attestationRootCertificates"`
+	Icon                        string   `json:"icon"`
+}
+
+type StatusReport struct {
+	Status        metadata.AuthenticatorStatus `json:"status"`
+	EffectiveDate string                       `json:"effectiveDate"`
+}
+
+type Entry struct {
+	AAGUID            string         `json:"aaguid"`
+	MetadataStatement Statement      `json:"metadataStatement"`
+	StatusReports     []StatusReport `json:"statusReports"`
+}
+
+// A verified metadata blob, only the FIDO2 entries are kept
+type BLOB struct {
+	Number     int       `json:"number"`
+	NextUpdate string    `json:"nextUpdate"`
+	Entries    int       `json:"entries"`
+	LoadedAt   time.Time `json:"loadedAt"`
+	entries    map[string]Entry
+}
+
+// Reports whether the blob should have been replaced by a newer one
+func (b BLOB) Stale() bool {
+	next, err := time.Parse("2006-01-02", b.NextUpdate)
+	return err == nil && time.Now().After(next.Add(time.Hour*24))
+}
+
+type blobClaims struct {
+	Number     int     `json:"no"`
+	NextUpdate string  `json:"nextUpdate"`
+	Entries    []Entry `json:"entries"`
+	jwt.RegisteredClaims
+}
+
+// What the metadata tells about a registered authenticator
+type Authenticator struct {
+	Description        string
+	CertificationLevel string
+	// Whether the attestation chain was verified against the roots of the
+	// entry, only then is the AAGUID vouched for by the manufacturer
+	Attested bool
+}
+
+// Configures the metadata service and loads the blob from AUTH_MDS_BLOB.
+// The blob is reloaded when the file changes, so it can be kept up to date
+// by downloading it to the path.
+func Init() {
+	path = viper.GetString("AUTH_MDS_BLOB")
+	requireAttestation = viper.GetBool("AUTH_MDS_REQUIRE_ATTESTATION")
+
+	var err error
+	root, err = loadRoot(viper.GetString("AUTH_MDS_ROOT"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load the metadata root certificate")
+	}
+
+	err = Reload()
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Info().Str("path", path).Msg("no metadata blob found, authenticators are not checked")
+	case err != nil:
+		log.Error().Err(err).Str("path", path).Msg("failed to load metadata blob")
+	}
+
+	interval := viper.GetDuration("AUTH_MDS_RELOAD_INTERVAL")
+	if path != "" && interval > 0 {
+		go watch(interval)
+	}
+}
+
+// The trust anchor of the blob, the FIDO Alliance root unless a PEM or DER
+// certificate file is configured
+func loadRoot(file string) (*x509.Certificate, error) {
+	var der []byte
+	var err error
+	if file == "" {
+		der, err = base64.StdEncoding.DecodeString(metadata.ProductionMDSRoot)
+	} else {
+		der, err = os.ReadFile(file)
+		if block, _ := pem.Decode(der); block != nil {
+			der = block.Bytes
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(path)
+		mu.RLock()
+		changed := err == nil && !info.ModTime().Equal(modTime)
+		mu.RUnlock()
+		if !changed {
+			continue
+		}
+		err = Reload()
+		if err != nil && !errors.Is(err, ErrOutdatedBLOB) {
+			log.Error().Err(err).Str("path", path).Msg("failed to reload metadata blob")
+		}
+	}
+}
+
+// Verifies the signature of a blob and its certificate chain up to the
+// root. Revocation of the chain is not checked, as the blob is loaded
+// offline.
+func Parse(data []byte, root *x509.Certificate) (*BLOB, error) {
+	claims := &blobClaims{}
+	_, err := jwt.ParseWithClaims(strings.TrimSpace(string(data)), claims, func(token *jwt.Token) (interface{}, error) {
+		chain, err := parseChain(token.Header["x5c"])
+		if err != nil {
+			return nil, err
+		}
+		// Without a chain the blob is signed by the root itself
+		if len(chain) == 0 {
+			return root.PublicKey, nil
+		}
+		err = verifyChain(chain, []*x509.Certificate{root})
+		if err != nil {
+			return nil, err
+		}
+		return chain[0].PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512", "PS256"}))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBLOB, err)
+	}
+
+	blob := &BLOB{
+		Number:     claims.Number,
+		NextUpdate: claims.NextUpdate,
+		LoadedAt:   time.Now(),
+		entries:    map[string]Entry{},
+	}
+	for _, entry := range claims.Entries {
+		// UAF and U2F authenticators are identified by other ids
+		if entry.AAGUID != "" {
+			blob.entries[strings.ToLower(entry.AAGUID)] = entry
+		}
+	}
+	blob.Entries = len(blob.entries)
+	return blob, nil
+}
+
+func parseChain(x5c interface{}) ([]*x509.Certificate, error) {
+	if x5c == nil {
+		return nil, nil
+	}
+	encoded, ok := x5c.([]interface{})
+	if !ok {
+		return nil, errors.New("x5c is not a list of certificates")
+	}
+	chain := []*x509.Certificate{}
+	for _, e := range encoded {
+		s, ok := e.(string)
+		if !ok {
+			return nil, errors.New("x5c is not a list of certificates")
+		}
+		der, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// Verifies that the first certificate of the chain is issued by one of the
+// roots, through the other certificates of the chain
+func verifyChain(chain []*x509.Certificate, roots []*x509.Certificate) error {
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	for _, cert := range roots {
+		opts.Roots.AddCert(cert)
+	}
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := chain[0].Verify(opts)
+	return err
+}
+
+// Replaces the loaded blob after verifying it, and writes it to the
+// configured path so it is kept over restarts and picked up by other
+// instances
+func Load(data []byte) (*BLOB, error) {
+	blob, err := Parse(data, root)
+	if err != nil {
+		return nil, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if current != nil && blob.Number <= current.Number {
+		return nil, ErrOutdatedBLOB
+	}
+	if path != "" {
+		err = writeFile(path, data)
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			modTime = info.ModTime()
+		}
+	}
+	install(blob)
+	return blob, nil
+}
+
+// Loads the blob from the configured path
+func Reload() error {
+	if path == "" {
+		return os.ErrNotExist
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	blob, err := Parse(data, root)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	modTime = info.ModTime()
+	if current != nil && blob.Number <= current.Number {
+		return ErrOutdatedBLOB
+	}
+	install(blob)
+	return nil
+}
+
+// Must be called with the lock held
+func install(blob *BLOB) {
+	current = blob
+	log.Info().Int("number", blob.Number).Int("entries", blob.Entries).
+		Str("nextUpdate", blob.NextUpdate).Msg("loaded metadata blob")
+	if blob.Stale() {
+		log.Warn().Str("nextUpdate", blob.NextUpdate).Msg("metadata blob is past its next update")
+	}
+}
+
+func writeFile(name string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Returns the loaded blob, nil when there is none
+func Status() *BLOB {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Reports whether registrations are checked against the metadata, in
+// which case direct attestation is requested from authenticators
+func Enabled() bool {
+	return Status() != nil || requireAttestation
+}
+
+// Checks the authenticator of a registration against the metadata. The
+// status reports of the authenticator must not show it as compromised, and
+// an attestation certificate has to chain to one of its roots. Without
+// AUTH_MDS_REQUIRE_ATTESTATION authenticators that are not listed or do not
+// attest are accepted.
+func Verify(att protocol.AttestationObject) (Authenticator, error) {
+	blob := Status()
+	if blob == nil {
+		if requireAttestation {
+			return Authenticator{}, ErrNotLoaded
+		}
+		return Authenticator{}, nil
+	}
+	entry, ok := blob.entries[formatAAGUID(att.AuthData.AttData.AAGUID)]
+	if !ok {
+		if requireAttestation {
+			return Authenticator{}, ErrUnknownAuthenticator
+		}
+		return Authenticator{}, nil
+	}
+	for _, report := range entry.StatusReports {
+		if metadata.IsUndesiredAuthenticatorStatus(report.Status) {
+			return Authenticator{}, fmt.Errorf("%w: %s", ErrAuthenticatorStatus, report.Status)
+		}
+	}
+
+	x5c, _ := att.AttStatement["x5c"].([]interface{})
+	if len(x5c) > 0 {
+		err := verifyAttestation(x5c, entry)
+		if err != nil {
+			return Authenticator{}, err
+		}
+	} else if requireAttestation {
+		return Authenticator{}, ErrAttestationMissing
+	}
+
+	return Authenticator{
+		Description:        entry.MetadataStatement.Description,
+		CertificationLevel: certificationLevel(entry.StatusReports),
+		Attested:           len(x5c) > 0,
+	}, nil
+}
+
+func verifyAttestation(x5c []interface{}, entry Entry) error {
+	chain := []*x509.Certificate{}
+	for _, e := range x5c {
+		der, ok := e.([]byte)
+		if !ok {
+			return ErrAttestationUntrusted
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrAttestationUntrusted, err)
+		}
+		chain = append(chain, cert)
+	}
+	roots := []*x509.Certificate{}
+	for _, encoded := range entry.MetadataStatement.AttestationRootCertificates {
+		der, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			continue
+		}
+		roots = append(roots, cert)
+	}
+	err := verifyChain(chain, roots)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAttestationUntrusted, err)
+	}
+	return nil
+}
+
+// The latest FIDO certification of the status reports, e.g. "L1" or "L2+"
+func certificationLevel(reports []StatusReport) string {
+	level := ""
+	for _, report := range reports {
+		status := string(report.Status)
+		if !strings.HasPrefix(status, string(metadata.FidoCertified)) {
+			continue
+		}
+		level = strings.TrimPrefix(strings.TrimPrefix(status, string(metadata.FidoCertified)), "_")
+		// The original certification was replaced by level 1
+		if level == "" {
+			level = "L1"
+		}
+		level = strings.Replace(level, "plus", "+", 1)
+	}
+	return level
+}
+
+func formatAAGUID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
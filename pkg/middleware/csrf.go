@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Header carrying the token on state changing requests, htmx sends it
+	// through the hx-headers attribute in head.html
+	CSRFHeader = "X-CSRF-Token"
+	// Key of the token in the request locals, passed on to the views
+	CSRFLocal = "csrf"
+
+	csrfTokenLength = 32
+)
+
+// Name of the cookie holding the token, prefixed with __Host- when served
+// over https
+var CSRFCookie = "csrf_token"
+
+type CSRFConfig struct {
+	// Origins other than the one of the request that may send state
+	// changing requests, like the configured AUTH_ORIGIN
+	TrustedOrigins []string
+	Secure         bool
+	// Renders the response of rejected requests
+	ErrorHandler fiber.Handler
+	// Skips the check when it returns true, for requests that do not
+	// authenticate with cookies
+	Next func(c *fiber.Ctx) bool
+}
+
+// Returns a handler protecting state changing requests against cross site
+// request forgery. Requests from other sites are rejected based on the
+// Origin and Sec-Fetch-Site headers, and every unsafe request has to send
+// the token from the CSRF cookie in the X-CSRF-Token header.
+func NewCSRFMiddleware(config CSRFConfig) fiber.Handler {
+	if config.Secure {
+		CSRFCookie = "__Host-csrf_token"
+	}
+	trusted := map[string]bool{}
+	for _, origin := range config.TrustedOrigins {
+		trusted[strings.TrimSuffix(origin, "/")] = true
+	}
+	reject := func(c *fiber.Ctx, reason string) error {
+		log.Warn().Str("path", c.Path()).Str("ip", c.IP()).Str("reason", reason).
+			Msg("rejected cross site request")
+		c.Status(fiber.StatusForbidden)
+		if config.ErrorHandler != nil {
+			return config.ErrorHandler(c)
+		}
+		return c.SendString("Forbidden")
+	}
+
+	return func(c *fiber.Ctx) error {
+		if config.Next != nil && config.Next(c) {
+			return c.Next()
+		}
+		token := c.Cookies(CSRFCookie)
+		known := len(token) == base64.RawURLEncoding.EncodedLen(csrfTokenLength)
+		if !known {
+			var err error
+			token, err = newCSRFToken()
+			if err != nil {
+				return err
+			}
+			c.Cookie(&fiber.Cookie{
+				Name:     CSRFCookie,
+				Value:    token,
+				Path:     "/",
+				Secure:   config.Secure,
+				HTTPOnly: true,
+				SameSite: fiber.CookieSameSiteStrictMode,
+			})
+		}
+		c.Locals(CSRFLocal, token)
+
+		switch c.Method() {
+		case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions, fiber.MethodTrace:
+			return c.Next()
+		}
+
+		if site := c.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" &&
+			!trusted[c.Get(fiber.HeaderOrigin)] {
+			return reject(c, "cross site request")
+		}
+		if origin := c.Get(fiber.HeaderOrigin); origin != "" && origin != c.BaseURL() &&
+			!trusted[origin] {
+			return reject(c, "untrusted origin "+origin)
+		}
+		header := c.Get(CSRFHeader)
+		if !known || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			return reject(c, "missing or invalid csrf token")
+		}
+		return c.Next()
+	}
+}
+
+func newCSRFToken() (string, error) {
+	token := make([]byte, csrfTokenLength)
+	_, err := io.ReadFull(rand.Reader, token)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
@@ -0,0 +1,134 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+// Key of the brand of the request host in the request locals, passed on to
+// the views
+const BrandLocal = "brand"
+
+var (
+	ErrInvalidOrigin = errors.New("invalid origin")
+
+	relatedOrigins = []string{}
+	defaultBrand   Brand
+	brands         = map[string]Brand{}
+)
+
+// How the pages and the relying party present themselves on a host
+type Brand struct {
+	// Relying party name shown by the authenticator during registration
+	Name string `json:"name"`
+	// Path or URL of the logo shown in the header
+	Logo string `json:"logo,omitempty"`
+	// daisyUI theme of the pages
+	Theme string `json:"theme,omitempty"`
+}
+
+// Builds the relying party configuration. AUTH_RPID is shared by the
+// origins in AUTH_RELATED_ORIGINS, which browsers accept once the RP ID
+// domain lists them at /.well-known/webauthn. AUTH_BRANDING points to a
+// JSON file with the brand of every host, hosts without one get
+// AUTH_RP_DISPLAY_NAME.
+func relyingPartyConfig() (*webauthn.Config, error) {
+	origins := []string{"http://localhost:4200"}
+	o := viper.GetString("AUTH_ORIGIN")
+	if len(o) != 0 {
+		origins = append(origins, o)
+	}
+	related := []string{}
+	for _, origin := range strings.Split(viper.GetString("AUTH_RELATED_ORIGINS"), ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return nil, fmt.Errorf("%w in AUTH_RELATED_ORIGINS: %s", ErrInvalidOrigin, origin)
+		}
+		related = append(related, origin)
+	}
+	relatedOrigins = related
+	origins = append(origins, related...)
+
+	defaultBrand = Brand{Name: viper.GetString("AUTH_RP_DISPLAY_NAME"), Theme: "dark"}
+	brands = map[string]Brand{}
+	if path := viper.GetString("AUTH_BRANDING"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal(data, &brands)
+		if err != nil {
+			return nil, fmt.Errorf("invalid branding %s: %w", path, err)
+		}
+		log.Info().Int("hosts", len(brands)).Msg("branding loaded")
+	}
+
+	return &webauthn.Config{
+		RPDisplayName: defaultBrand.Name,
+		RPID:          viper.GetString("AUTH_RPID"),
+		RPOrigins:     origins,
+	}, nil
+}
+
+// Returns the brand of a host, the port is ignored. Fields the host does
+// not configure are taken from the default brand.
+func BrandFor(host string) Brand {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	brand, ok := brands[strings.ToLower(host)]
+	if !ok {
+		return defaultBrand
+	}
+	if brand.Name == "" {
+		brand.Name = defaultBrand.Name
+	}
+	if brand.Theme == "" {
+		brand.Theme = defaultBrand.Theme
+	}
+	return brand
+}
+
+// Names the relying party after the brand of the host the registration was
+// started from
+func withRelyingPartyName(host string) webauthn.RegistrationOption {
+	return func(cco *protocol.PublicKeyCredentialCreationOptions) {
+		cco.RelyingParty.Name = BrandFor(host).Name
+	}
+}
+
+// Makes the brand of the request host available to the views, unless the
+// request was made to a tenant with its own
+func NewBrandMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if c.Locals(BrandLocal) == nil {
+			c.Locals(BrandLocal, BrandFor(c.Hostname()))
+		}
+		return c.Next()
+	}
+}
+
+// Serves the origins that may use the RP ID, for WebAuthn related origin
+// requests. Only needed on the RP ID domain.
+func RelatedOriginsHandler(c *fiber.Ctx) error {
+	if len(relatedOrigins) == 0 {
+		return c.SendStatus(404)
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+	return c.JSON(fiber.Map{"origins": relatedOrigins})
+}
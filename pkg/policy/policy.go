@@ -0,0 +1,186 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/aaguid"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrPolicyViolation = errors.New("authenticator does not meet the policy")
+
+	roles    = []db.Role{db.Admin, db.Member, db.Helpdesk}
+	policies = map[db.Role]Policy{}
+)
+
+// Requirements on the authenticators of a role. Empty lists allow
+// anything.
+type Policy struct {
+	Role db.Role `json:"-"`
+	// Allowed authenticator models, as AAGUIDs
+	AAGUIDs []string `json:"aaguids"`
+	// Allowed attestation statement formats, e.g. packed or none
+	AttestationTypes []string `json:"attestationTypes"`
+	UserVerification bool     `json:"userVerification"`
+	// Rejects credentials that can be synced to other devices, which
+	// report themselves as backup eligible
+	DeviceBound bool `json:"deviceBound"`
+	// credProtect level requested for new credentials, 3 only lets them be
+	// used with user verification
+	CredProtect int `json:"credProtect"`
+}
+
+// A credential that does not meet the current policy of its user's role
+type Violation struct {
+	Username        string   `json:"username"`
+	Role            string   `json:"role"`
+	CredentialID    []byte   `json:"credentialId"`
+	Name            string   `json:"name"`
+	Description     string   `json:"description"`
+	AttestationType string   `json:"attestationType"`
+	Reasons         []string `json:"reasons"`
+}
+
+// Reads the policy of every role from AUTH_POLICY_<ROLE>_AAGUIDS,
+// _ATTESTATION, _USER_VERIFICATION, _DEVICE_BOUND and _CRED_PROTECT, e.g.
+// AUTH_POLICY_ADMIN_DEVICE_BOUND=true
+func Init() {
+	for _, role := range roles {
+		prefix := "AUTH_POLICY_" + strings.ToUpper(role.String()) + "_"
+		p := Policy{
+			Role:             role,
+			AAGUIDs:          list(viper.GetString(prefix + "AAGUIDS")),
+			AttestationTypes: list(viper.GetString(prefix + "ATTESTATION")),
+			UserVerification: viper.GetBool(prefix + "USER_VERIFICATION"),
+			DeviceBound:      viper.GetBool(prefix + "DEVICE_BOUND"),
+			CredProtect:      viper.GetInt(prefix + "CRED_PROTECT"),
+		}
+		for i, aaguid := range p.AAGUIDs {
+			p.AAGUIDs[i] = strings.ToLower(aaguid)
+		}
+		policies[role] = p
+		if p.Restricted() {
+			log.Info().Str("role", role.String()).Interface("policy", p).Msg("authenticator policy")
+		}
+	}
+}
+
+func list(s string) []string {
+	l := []string{}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// Returns the policy of a role
+func For(role db.Role) Policy {
+	p, ok := policies[role]
+	if !ok {
+		return Policy{Role: role}
+	}
+	return p
+}
+
+// Reports whether the policy places any requirement on authenticators
+func (p Policy) Restricted() bool {
+	return len(p.AAGUIDs) > 0 || len(p.AttestationTypes) > 0 || p.UserVerification || p.DeviceBound ||
+		p.CredProtect > 0
+}
+
+// Reports whether authenticators have to attest their model, in which case
+// direct attestation is requested
+func (p Policy) RequiresAttestation() bool {
+	if len(p.AAGUIDs) > 0 {
+		return true
+	}
+	for _, t := range p.AttestationTypes {
+		if t == "none" {
+			return false
+		}
+	}
+	return len(p.AttestationTypes) > 0
+}
+
+// Returns the requirements of the policy the credential does not meet.
+// attested tells whether the attestation chain of the credential was
+// verified against the metadata roots of its model.
+func (p Policy) Violations(credential webauthn.Credential, attested bool) []string {
+	reasons := []string{}
+	if len(p.AAGUIDs) > 0 {
+		// Without a verified attestation chain the AAGUID is only claimed by
+		// the authenticator, self attestation can claim any model
+		model := aaguid.Format(credential.Authenticator.AAGUID)
+		if !contains(p.AAGUIDs, model) {
+			reasons = append(reasons, "the authenticator model is not on the allowlist")
+		} else if !attested {
+			reasons = append(reasons, "the authenticator model is not attested by its manufacturer")
+		}
+	}
+	if len(p.AttestationTypes) > 0 && !contains(p.AttestationTypes, credential.AttestationType) {
+		reasons = append(reasons, fmt.Sprintf("%s attestation is not accepted", credential.AttestationType))
+	}
+	if p.UserVerification && !credential.Flags.UserVerified {
+		reasons = append(reasons, "user verification with a PIN or biometric is required")
+	}
+	if p.DeviceBound && credential.Flags.BackupEligible {
+		reasons = append(reasons, "synced passkeys are not accepted, use a hardware security key")
+	}
+	return reasons
+}
+
+// Checks a credential against the policy, the error tells which
+// requirements it does not meet
+func (p Policy) Check(credential webauthn.Credential, attested bool) error {
+	reasons := p.Violations(credential, attested)
+	if len(reasons) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w of the %s role: %s", ErrPolicyViolation, p.Role, strings.Join(reasons, ", "))
+}
+
+// Lists the registered credentials of the users of a tenant that do not
+// meet the current policy of their user's role
+func Report(userDb db.UserDb, tenant string) []Violation {
+	violations := []Violation{}
+	for _, user := range userDb.GetTenantUsers(tenant) {
+		p := For(user.Role)
+		if !p.Restricted() {
+			continue
+		}
+		user.Credentials = userDb.GetUserCredentials(user)
+		for i, credential := range user.WebAuthnCredentials() {
+			reasons := p.Violations(credential, user.Credentials[i].Attested)
+			if len(reasons) == 0 {
+				continue
+			}
+			violations = append(violations, Violation{
+				Username:        db.LocalUsername(user.Username),
+				Role:            user.Role.String(),
+				CredentialID:    credential.ID,
+				Name:            user.Credentials[i].Name,
+				Description:     user.Credentials[i].Description,
+				AttestationType: credential.AttestationType,
+				Reasons:         reasons,
+			})
+		}
+	}
+	return violations
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/audit"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Delay of the first failed attempt, doubled for every further failure
+	failureDelay    = 250 * time.Millisecond
+	maxFailureDelay = 4 * time.Second
+	maxLockout      = 24 * time.Hour
+)
+
+var (
+	lockoutDb db.LockoutDb
+	lockouts  LockoutPolicy
+)
+
+// Identifiers are locked out after Threshold failed attempts within Window
+// of each other. Lockouts last Duration, doubled for every consecutive
+// lockout up to a day.
+type LockoutPolicy struct {
+	Threshold   int
+	IPThreshold int
+	Window      time.Duration
+	Duration    time.Duration
+}
+
+func initLockouts(lDb db.LockoutDb) {
+	lockoutDb = lDb
+	lockouts = LockoutPolicy{
+		Threshold:   viper.GetInt("AUTH_LOCKOUT_THRESHOLD"),
+		IPThreshold: viper.GetInt("AUTH_LOCKOUT_IP_THRESHOLD"),
+		Window:      viper.GetDuration("AUTH_LOCKOUT_WINDOW"),
+		Duration:    viper.GetDuration("AUTH_LOCKOUT_DURATION"),
+	}
+}
+
+func UserIdentifier(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func IPIdentifier(ip string) string {
+	return "ip:" + ip
+}
+
+// Returns how long the first of the identifiers is still locked out
+func Locked(identifiers ...string) (time.Duration, bool) {
+	for _, identifier := range identifiers {
+		lockout, err := lockoutDb.GetLockout(identifier)
+		if err == nil && lockout.Locked() {
+			return time.Until(lockout.LockedUntil), true
+		}
+	}
+	return 0, false
+}
+
+// Returns the username route parameter as a user of the request's tenant,
+// the key failures are recorded under
+func usernameParam(c *fiber.Ctx) string {
+	username, err := db.QualifyUsername(c, c.Params("username"))
+	if err != nil {
+		return c.Params("username")
+	}
+	return username
+}
+
+// Returns a handler rejecting requests from locked out IPs or for locked
+// out usernames
+func NewLockoutGuard() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		identifiers := []string{IPIdentifier(c.IP())}
+		if username := usernameParam(c); username != "" {
+			identifiers = append(identifiers, UserIdentifier(username))
+		}
+		remaining, locked := Locked(identifiers...)
+		if !locked {
+			return c.Next()
+		}
+		c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(remaining.Seconds())+1))
+		return c.Status(fiber.StatusTooManyRequests).
+			SendString("Too many failed attempts, try again later")
+	}
+}
+
+// Records a failed authentication of username from the request. The
+// response is delayed more for every consecutive failure, and the username
+// or the IP is locked out once its threshold is reached.
+func Failure(c *fiber.Ctx, username string) {
+	failures := 0
+	if lockouts.Threshold > 0 && username != "" {
+		failures = recordFailure(UserIdentifier(username), lockouts.Threshold)
+	}
+	if lockouts.IPThreshold > 0 {
+		failures = max(failures, recordFailure(IPIdentifier(c.IP()), lockouts.IPThreshold))
+	}
+	if failures > 0 {
+		time.Sleep(min(failureDelay<<(failures-1), maxFailureDelay))
+	}
+}
+
+// Returns the number of consecutive failures of the identifier
+func recordFailure(identifier string, threshold int) int {
+	now := time.Now()
+	lockout, err := lockoutDb.GetLockout(identifier)
+	switch {
+	case errors.Is(err, db.ErrNoResults):
+		lockout = &db.Lockout{Identifier: identifier}
+	case err != nil:
+		log.Err(err).Msg("failed to load lockout")
+		return 0
+	}
+	if now.Sub(lockout.LastFailure) > lockouts.Window {
+		lockout.Failures = 0
+	}
+	// Consecutive lockouts are forgotten after a day without failures
+	if now.Sub(lockout.LastFailure) > maxLockout {
+		lockout.Lockouts = 0
+	}
+	lockout.Failures++
+	lockout.LastFailure = now
+	failures := lockout.Failures
+
+	if lockout.Failures >= threshold {
+		duration := min(lockouts.Duration<<min(lockout.Lockouts, 16), maxLockout)
+		lockout.Lockouts++
+		lockout.Failures = 0
+		lockout.LockedUntil = now.Add(duration)
+		log.Warn().Str("identifier", identifier).Str("duration", duration.String()).
+			Msg("locked out after failed attempts")
+		audit.Log(audit.Entry{
+			Action:  "lockout",
+			Target:  identifier,
+			Outcome: audit.OutcomeDenied,
+			Details: map[string]string{"until": lockout.LockedUntil.Format(time.RFC3339)},
+		})
+	}
+	err = lockoutDb.SaveLockout(*lockout)
+	if err != nil {
+		log.Err(err).Msg("failed to save lockout")
+	}
+	return failures
+}
+
+// Clears the failed attempts of username after a successful authentication
+func Success(username string) {
+	err := lockoutDb.DeleteLockout(UserIdentifier(username))
+	if err != nil && !errors.Is(err, db.ErrNoResults) {
+		log.Err(err).Msg("failed to clear lockout")
+	}
+}
+
+// Returns the identifiers that are currently locked out
+func Lockouts() []db.Lockout {
+	return lockoutDb.GetLockouts()
+}
+
+// Lifts the lockout of the identifier
+func Unlock(identifier string) error {
+	return lockoutDb.DeleteLockout(identifier)
+}
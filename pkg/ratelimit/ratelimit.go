@@ -0,0 +1,195 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrInvalidLimit = errors.New("limit must be in the form count/period, e.g. 30/1m")
+
+	limiter *Limiter
+	limits  Limits
+)
+
+// A token bucket holding Count tokens that are refilled over Period
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// Parses limits like "30/1m", an empty limit or a count of 0 disables it
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Limit{}, nil
+	}
+	count, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, ErrInvalidLimit
+	}
+	limit := Limit{}
+	var err error
+	limit.Count, err = strconv.Atoi(count)
+	if err != nil || limit.Count < 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+	limit.Period, err = time.ParseDuration(period)
+	if err != nil || limit.Period <= 0 {
+		return Limit{}, ErrInvalidLimit
+	}
+	return limit, nil
+}
+
+func (l Limit) Enabled() bool {
+	return l.Count > 0
+}
+
+// The limits applied to the WebAuthn endpoints
+type Limits struct {
+	IP       Limit
+	Username Limit
+	Global   Limit
+}
+
+// The outcome of taking a token from a bucket
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Until the bucket is full again
+	Reset time.Duration
+	// Until the next token is available when the request was not allowed
+	RetryAfter time.Duration
+}
+
+// Keeps token buckets in a storage, which can be shared between
+// instances. Buckets are updated with a read and a write, so concurrent
+// requests on different instances may both take the last token.
+type Limiter struct {
+	mu      sync.Mutex
+	storage fiber.Storage
+}
+
+type bucket struct {
+	Tokens  float64 `json:"t"`
+	Updated int64   `json:"u"`
+}
+
+func NewLimiter(storage fiber.Storage) *Limiter {
+	return &Limiter{storage: storage}
+}
+
+// Takes a token from the bucket with the key
+func (l *Limiter) Take(key string, limit Limit) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(limit.Count) / limit.Period.Seconds()
+	b := bucket{Tokens: float64(limit.Count), Updated: now.UnixNano()}
+	data, err := l.storage.Get(key)
+	if err != nil {
+		return Result{}, err
+	}
+	if data != nil && json.Unmarshal(data, &b) == nil {
+		elapsed := now.Sub(time.Unix(0, b.Updated)).Seconds()
+		b.Tokens = math.Min(float64(limit.Count), b.Tokens+elapsed*rate)
+		b.Updated = now.UnixNano()
+	}
+
+	result := Result{Limit: limit.Count}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.Tokens) / rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.Reset = seconds((float64(limit.Count) - b.Tokens) / rate)
+
+	data, err = json.Marshal(b)
+	if err != nil {
+		return Result{}, err
+	}
+	return result, l.storage.Set(key, data, limit.Period)
+}
+
+// Rounds up to whole seconds, as used in the headers
+func seconds(s float64) time.Duration {
+	return time.Duration(math.Ceil(s)) * time.Second
+}
+
+// Configures the limits from AUTH_RATELIMIT_IP, AUTH_RATELIMIT_USERNAME and
+// AUTH_RATELIMIT_GLOBAL and the lockouts after failed authentications
+func Init(lDb db.LockoutDb) {
+	var err error
+	for name, limit := range map[string]*Limit{
+		"AUTH_RATELIMIT_IP":       &limits.IP,
+		"AUTH_RATELIMIT_USERNAME": &limits.Username,
+		"AUTH_RATELIMIT_GLOBAL":   &limits.Global,
+	} {
+		*limit, err = ParseLimit(viper.GetString(name))
+		if err != nil {
+			log.Fatal().Err(err).Str("variable", name).Msg("invalid rate limit")
+		}
+	}
+	limiter = NewLimiter(db.NewStorage("ratelimit"))
+	initLockouts(lDb)
+}
+
+// Returns a handler limiting requests per IP, per username route parameter
+// and over all clients. The RateLimit headers describe the most restrictive
+// of the limits, requests over a limit get a 429 with a Retry-After header.
+func New() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var tightest *Result
+		take := func(key string, limit Limit) bool {
+			if !limit.Enabled() {
+				return true
+			}
+			result, err := limiter.Take(key, limit)
+			if err != nil {
+				// Requests are let through when the storage fails
+				log.Err(err).Msg("failed to take rate limit token")
+				return true
+			}
+			if tightest == nil || !result.Allowed ||
+				(tightest.Allowed && result.Remaining < tightest.Remaining) {
+				tightest = &result
+			}
+			return result.Allowed
+		}
+
+		allowed := take("ip:"+c.IP(), limits.IP)
+		if username := usernameParam(c); allowed && username != "" {
+			allowed = take("user:"+strings.ToLower(username), limits.Username)
+		}
+		if allowed {
+			allowed = take("global", limits.Global)
+		}
+
+		if tightest != nil {
+			c.Set("RateLimit-Limit", strconv.Itoa(tightest.Limit))
+			c.Set("RateLimit-Remaining", strconv.Itoa(tightest.Remaining))
+			c.Set("RateLimit-Reset", fmt.Sprint(int(tightest.Reset.Seconds())))
+		}
+		if !allowed {
+			log.Warn().Str("ip", c.IP()).Str("path", c.Path()).Msg("rate limit exceeded")
+			c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(tightest.RetryAfter.Seconds())))
+			return c.Status(fiber.StatusTooManyRequests).SendString("Too many requests, try again later")
+		}
+		return c.Next()
+	}
+}
@@ -0,0 +1,133 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	recoveryCodeCount = 10
+
+	RecoveryMethodCode       = "recovery_code"
+	RecoveryMethodAccessPass = "access_pass"
+)
+
+var (
+	ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+	recoveryEncoding       = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Generates a new set of recovery codes for the user, replacing any
+// previous codes. Only the hashes are stored so the returned codes
+// can not be retrieved again.
+func (authImpl AuthImpl) GenerateRecoveryCodes(username string) ([]string, error) {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	dCodes := make([]db.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+		dCodes[i] = db.RecoveryCode{Hash: hashRecoveryCode(code)}
+	}
+
+	err = userDb.ReplaceRecoveryCodes(*user, dCodes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (authImpl AuthImpl) RemainingRecoveryCodes(username string) int {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return 0
+	}
+	return len(userDb.GetRecoveryCodes(*user))
+}
+
+// Consumes the recovery code, or a temporary access pass issued by an
+// admin, and puts the user in the Recovering status which allows a new
+// passkey to be registered for the account. Returns the recovery method
+// that was used.
+func (authImpl AuthImpl) RecoverAccount(username string, code string) (string, error) {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return "", err
+	}
+	if user.Status == db.Blocked {
+		return "", ErrLoginBlocked
+	}
+
+	err = userDb.UseRecoveryCode(*user, hashRecoveryCode(code))
+	if errors.Is(err, db.ErrNoResults) {
+		err = redeemAccessPass(*user, code)
+		if errors.Is(err, db.ErrNoResults) {
+			return "", ErrInvalidRecoveryCode
+		}
+		if err != nil {
+			return "", err
+		}
+		return RecoveryMethodAccessPass, setRecovering(user)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	err = setRecovering(user)
+	if err != nil {
+		return "", err
+	}
+
+	remaining := len(userDb.GetRecoveryCodes(*user))
+	go notifyRecoveryCodeUsed(username, remaining)
+	return RecoveryMethodCode, nil
+}
+
+func setRecovering(user *db.User) error {
+	// Saving the user upserts its associations, which would restore
+	// credentials revoked by an access pass
+	user.Credentials = nil
+	user.Status = db.Recovering
+	return userDb.CreateUser(*user)
+}
+
+func notifyRecoveryCodeUsed(username string, remaining int) {
+	content := fmt.Sprintf("A recovery code was used to regain access to your account %s. "+
+		"You have %d unused recovery codes left. If this was not you, contact an administrator.",
+		db.LocalUsername(username), remaining)
+	err := notifyUser(username, "Recovery code used", content)
+	if err != nil {
+		log.Warn().Err(err).Str("username", username).Msg("failed to send recovery notification")
+	}
+}
+
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(recoveryEncoding.EncodeToString(b))
+	return code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16], nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,98 @@
+package scim
+
+// Describes the supported features, RFC 7643 section 5
+func ServiceProviderConfig(documentationURI string) map[string]any {
+	unsupported := map[string]any{"supported": false}
+	return map[string]any{
+		"schemas":          []string{ServiceProviderConfigSchema},
+		"documentationUri": documentationURI,
+		"patch":            map[string]any{"supported": true},
+		"bulk":             map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]any{"supported": true, "maxResults": MaxResults},
+		"changePassword":   unsupported,
+		"sort":             unsupported,
+		"etag":             unsupported,
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "The token configured in AUTH_SCIM_TOKEN",
+			"primary":     true,
+		}},
+		"meta": Meta{ResourceType: "ServiceProviderConfig"},
+	}
+}
+
+// Returns the User and Group resource types, RFC 7643 section 6
+func ResourceTypes(base string) []any {
+	return []any{
+		map[string]any{
+			"schemas":  []string{ResourceTypeSchema},
+			"id":       "User",
+			"name":     "User",
+			"endpoint": "/Users",
+			"schema":   UserSchema,
+			"meta":     Meta{ResourceType: "ResourceType", Location: base + "/ResourceTypes/User"},
+		},
+		map[string]any{
+			"schemas":  []string{ResourceTypeSchema},
+			"id":       "Group",
+			"name":     "Group",
+			"endpoint": "/Groups",
+			"schema":   GroupSchema,
+			"meta":     Meta{ResourceType: "ResourceType", Location: base + "/ResourceTypes/Group"},
+		},
+	}
+}
+
+// Returns the attributes of the User and Group schemas that are stored,
+// RFC 7643 section 7. Clients may send others, they are ignored.
+func Schemas(base string) []any {
+	return []any{
+		map[string]any{
+			"schemas":     []string{SchemaSchema},
+			"id":          UserSchema,
+			"name":        "User",
+			"description": "User account",
+			"attributes": []map[string]any{
+				attribute("userName", "string", true, "readWrite", "server"),
+				attribute("active", "boolean", false, "readWrite", "none"),
+				multiValued(attribute("groups", "complex", false, "readOnly", "none")),
+			},
+			"meta": Meta{ResourceType: "Schema", Location: base + "/Schemas/" + UserSchema},
+		},
+		map[string]any{
+			"schemas":     []string{SchemaSchema},
+			"id":          GroupSchema,
+			"name":        "Group",
+			"description": "Role of the users",
+			"attributes": []map[string]any{
+				attribute("displayName", "string", true, "readOnly", "server"),
+				multiValued(attribute("members", "complex", false, "readWrite", "none")),
+			},
+			"meta": Meta{ResourceType: "Schema", Location: base + "/Schemas/" + GroupSchema},
+		},
+	}
+}
+
+func attribute(name string, kind string, required bool, mutability string, uniqueness string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"type":        kind,
+		"multiValued": false,
+		"required":    required,
+		"caseExact":   false,
+		"mutability":  mutability,
+		"returned":    "default",
+		"uniqueness":  uniqueness,
+	}
+}
+
+func multiValued(attr map[string]any) map[string]any {
+	attr["multiValued"] = true
+	attr["subAttributes"] = []map[string]any{
+		attribute("value", "string", false, attr["mutability"].(string), "none"),
+		attribute("$ref", "reference", false, attr["mutability"].(string), "none"),
+		attribute("display", "string", false, "readOnly", "none"),
+	}
+	return attr
+}
@@ -0,0 +1,280 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Attribute values of a resource by lowercase attribute path, e.g.
+// username or members.value. Multi-valued attributes hold every value.
+type Attributes map[string][]any
+
+// Attributes whose string values are compared case sensitively, everything
+// else is case insensitive like userName
+var caseExact = map[string]bool{"id": true, "value": true, "members.value": true, "groups.value": true}
+
+// A parsed filter expression, RFC 7644 section 3.4.2.2
+type Filter interface {
+	Matches(Attributes) bool
+}
+
+type logical struct {
+	and         bool
+	left, right Filter
+}
+
+func (f logical) Matches(attrs Attributes) bool {
+	if f.and {
+		return f.left.Matches(attrs) && f.right.Matches(attrs)
+	}
+	return f.left.Matches(attrs) || f.right.Matches(attrs)
+}
+
+type not struct {
+	filter Filter
+}
+
+func (f not) Matches(attrs Attributes) bool {
+	return !f.filter.Matches(attrs)
+}
+
+type comparison struct {
+	attr  string
+	op    string
+	value any
+}
+
+func (f comparison) Matches(attrs Attributes) bool {
+	values := attrs[f.attr]
+	if f.op == "pr" {
+		return len(values) > 0
+	}
+	if f.value == nil {
+		return (f.op == "eq") == (len(values) == 0)
+	}
+	if f.op == "ne" {
+		for _, v := range values {
+			if compare(f.attr, "eq", v, f.value) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if compare(f.attr, f.op, v, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(attr string, op string, value any, filter any) bool {
+	switch v := value.(type) {
+	case bool:
+		b, ok := filter.(bool)
+		return ok && op == "eq" && v == b
+	case string:
+		s, ok := filter.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact[attr] {
+			v, s = strings.ToLower(v), strings.ToLower(s)
+		}
+		switch op {
+		case "eq":
+			return v == s
+		case "co":
+			return strings.Contains(v, s)
+		case "sw":
+			return strings.HasPrefix(v, s)
+		case "ew":
+			return strings.HasSuffix(v, s)
+		case "gt":
+			return v > s
+		case "ge":
+			return v >= s
+		case "lt":
+			return v < s
+		case "le":
+			return v <= s
+		}
+	}
+	return false
+}
+
+var operators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true, "pr": true,
+}
+
+// Parses a filter like userName eq "alice" and active eq true. Comparisons
+// of attributes, and, or, not and parentheses are supported, complex
+// attribute filters in brackets only in PATCH paths.
+func ParseFilter(filter string) (Filter, error) {
+	tokens, err := tokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("%w: unexpected %s", ErrInvalidFilter, p.tokens[p.pos].text)
+	}
+	return f, nil
+}
+
+type token struct {
+	text string
+	// Quoted strings are values, never keywords
+	quoted bool
+}
+
+func tokenize(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		switch ch := rune(s[i]); {
+		case unicode.IsSpace(ch):
+			i++
+		case ch == '(' || ch == ')':
+			tokens = append(tokens, token{text: string(ch)})
+			i++
+		case ch == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("%w: unterminated string", ErrInvalidFilter)
+			}
+			var value string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &value); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidFilter, err.Error())
+			}
+			tokens = append(tokens, token{text: value, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && s[j] != '(' && s[j] != ')' {
+				j++
+			}
+			tokens = append(tokens, token{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// Consumes the next token when it is the keyword
+func (p *parser) keyword(keyword string) bool {
+	if p.pos < len(p.tokens) && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) next() (token, error) {
+	if p.pos >= len(p.tokens) {
+		return token{}, fmt.Errorf("%w: unexpected end", ErrInvalidFilter)
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *parser) or() (Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Filter, error) {
+	left, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		left = logical{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) factor() (Filter, error) {
+	negate := p.keyword("not")
+	if p.keyword("(") {
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, fmt.Errorf("%w: missing )", ErrInvalidFilter)
+		}
+		if negate {
+			return not{filter: f}, nil
+		}
+		return f, nil
+	}
+	if negate {
+		return nil, fmt.Errorf("%w: not without (", ErrInvalidFilter)
+	}
+
+	attr, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if attr.quoted || attr.text == ")" || strings.Contains(attr.text, "[") {
+		return nil, fmt.Errorf("%w: unsupported attribute %s", ErrInvalidFilter, attr.text)
+	}
+	name, _, _ := ParsePath(attr.text)
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	c := comparison{attr: name, op: strings.ToLower(op.text)}
+	if op.quoted || !operators[c.op] {
+		return nil, fmt.Errorf("%w: unknown operator %s", ErrInvalidFilter, op.text)
+	}
+	if c.op == "pr" {
+		return c, nil
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case value.quoted:
+		c.value = value.text
+	case value.text == "true" || value.text == "false":
+		c.value = value.text == "true"
+	case value.text == "null" && (c.op == "eq" || c.op == "ne"):
+		c.value = nil
+	default:
+		return nil, fmt.Errorf("%w: unsupported value %s", ErrInvalidFilter, value.text)
+	}
+	return c, nil
+}
@@ -0,0 +1,162 @@
+package scim
+
+import (
+	"errors"
+	"testing"
+)
+
+var alice = Attributes{
+	"id":            {"2f1c"},
+	"username":      {"Alice@Example.com"},
+	"active":        {true},
+	"groups.value":  {"admin", "helpdesk"},
+	"members.value": {},
+}
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "alice@example.com"`, true},
+		{`userName eq "bob@example.com"`, false},
+		{`userName ne "bob@example.com"`, true},
+		{`id eq "2F1C"`, false},
+		{`userName co "example"`, true},
+		{`userName co "nope"`, false},
+		{`userName sw "ALICE"`, true},
+		{`userName sw "example"`, false},
+		{`userName ew ".com"`, true},
+		{`userName gt "a"`, true},
+		{`userName lt "a"`, false},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`active pr`, true},
+		{`displayName pr`, false},
+		{`displayName eq null`, true},
+		{`userName ne null`, true},
+		{`groups.value eq "helpdesk"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice@example.com"`, true},
+		{`USERNAME EQ "alice@example.com"`, true},
+		{`userName eq "alice@example.com" and active eq false`, false},
+		{`userName eq "bob@example.com" or active eq true`, true},
+		{`not (active eq false)`, true},
+		{`not (userName sw "a")`, false},
+		{`NOT (userName sw "b") AND active eq true`, true},
+		// and binds tighter than or
+		{`active eq true or userName eq "bob" and active eq false`, true},
+		{`userName eq "bob" and active eq false or active eq true`, true},
+		{`(active eq true or userName eq "bob") and active eq false`, false},
+		{`userName eq "bob" or userName eq "carol" or id eq "2f1c"`, true},
+		{`userName eq "and"`, false},
+		{`userName eq "with \"quotes\""`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.filter, func(t *testing.T) {
+			f, err := ParseFilter(test.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if matches := f.Matches(alice); matches != test.matches {
+				t.Errorf("expected %v, got %v", test.matches, matches)
+			}
+		})
+	}
+}
+
+func TestParseFilterInvalid(t *testing.T) {
+	tests := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName bogus "alice"`,
+		`userName "eq" "alice"`,
+		`"userName" eq "alice"`,
+		`userName eq alice`,
+		`userName gt null`,
+		`userName eq "alice`,
+		`userName eq "alice" and`,
+		`userName eq "alice" or or active eq true`,
+		`userName eq "alice" active eq true`,
+		`not active eq true`,
+		`(userName eq "alice"`,
+		`userName eq "alice")`,
+		`emails[type eq "work"] pr`,
+	}
+	for _, filter := range tests {
+		t.Run(filter, func(t *testing.T) {
+			_, err := ParseFilter(filter)
+			if !errors.Is(err, ErrInvalidFilter) {
+				t.Errorf("expected ErrInvalidFilter, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		attr    string
+		filter  bool
+		invalid bool
+	}{
+		{path: "active", attr: "active"},
+		{path: "userName", attr: "username"},
+		{path: "urn:ietf:params:scim:schemas:core:2.0:User:active", attr: "active"},
+		{path: `members[value eq "2f1c"]`, attr: "members", filter: true},
+		{path: `emails[type eq "work"].value`, invalid: true},
+		{path: `members[value eq "2f1c"`, invalid: true},
+		{path: `members[value eq "2f1c"]value`, invalid: true},
+		{path: `members[value bogus "2f1c"]`, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			attr, filter, err := ParsePath(test.path)
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidFilter) {
+					t.Errorf("expected ErrInvalidFilter, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if attr != test.attr || (filter != nil) != test.filter {
+				t.Errorf("expected %s with filter %v, got %s %v", test.attr, test.filter, attr, filter)
+			}
+		})
+	}
+}
+
+func TestParseValuePath(t *testing.T) {
+	tests := []struct {
+		path    string
+		attr    string
+		sub     string
+		invalid bool
+	}{
+		{path: `emails[type eq "work"].value`, attr: "emails", sub: "value"},
+		{path: `urn:ietf:params:scim:schemas:core:2.0:User:emails[type eq "work"].Value`, attr: "emails", sub: "value"},
+		{path: `members[value eq "2f1c"]`, attr: "members"},
+		{path: `emails[type eq "work"].`, invalid: true},
+		{path: `emails[type eq "work"]value`, invalid: true},
+		{path: `emails[type bogus "work"].value`, invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			attr, filter, sub, err := ParseValuePath(test.path)
+			if test.invalid {
+				if !errors.Is(err, ErrInvalidFilter) {
+					t.Errorf("expected ErrInvalidFilter, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if attr != test.attr || sub != test.sub || filter == nil {
+				t.Errorf("expected %s.%s with a filter, got %s.%s %v", test.attr, test.sub, attr, sub, filter)
+			}
+		})
+	}
+}
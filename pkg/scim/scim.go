@@ -0,0 +1,182 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Schema URNs of RFC 7643 and RFC 7644
+const (
+	UserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+	ListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+	ContentType = "application/scim+json"
+	// Most resources returned by one list request
+	MaxResults = 200
+)
+
+// scimType of errors, RFC 7644 section 3.12
+const (
+	InvalidFilter = "invalidFilter"
+	InvalidSyntax = "invalidSyntax"
+	InvalidPath   = "invalidPath"
+	InvalidValue  = "invalidValue"
+	Mutability    = "mutability"
+	Uniqueness    = "uniqueness"
+	NoTarget      = "noTarget"
+)
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+type Meta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+// Reference to another resource, like the members of a group
+type Reference struct {
+	Value   string `json:"value"`
+	Ref     string `json:"$ref,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type User struct {
+	Schemas  []string `json:"schemas"`
+	ID       string   `json:"id,omitempty"`
+	UserName string   `json:"userName"`
+	// Nil when a request leaves it out
+	Active *bool `json:"active,omitempty"`
+	// Read only, groups are changed through their members
+	Groups []Reference `json:"groups,omitempty"`
+	Meta   *Meta       `json:"meta,omitempty"`
+}
+
+type Group struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id,omitempty"`
+	DisplayName string      `json:"displayName"`
+	Members     []Reference `json:"members,omitempty"`
+	Meta        *Meta       `json:"meta,omitempty"`
+}
+
+type ListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type PatchRequest struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+type Operation struct {
+	// add, remove or replace, clients differ in case
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type Error struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func NewError(status int, scimType string, detail string) Error {
+	return Error{
+		Schemas:  []string{ErrorSchema},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+func (e Error) Error() string {
+	return e.Detail
+}
+
+// Returns the page of a list selected by the 1-based startIndex and count
+// parameters, as slice bounds
+func Page(total int, startIndex int, count int) (int, int) {
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > MaxResults {
+		count = MaxResults
+	}
+	start := startIndex - 1
+	if start > total {
+		start = total
+	}
+	end := start + count
+	if end > total {
+		end = total
+	}
+	return start, end
+}
+
+// Parses a boolean value, which some clients send as a string
+func ParseBool(value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return false, fmt.Errorf("not a boolean: %s", value)
+	}
+	return strconv.ParseBool(strings.ToLower(s))
+}
+
+// Returns the attribute name of a path, lowercase and without the schema
+// URN, and the filter of a value path like members[value eq "id"]
+func ParsePath(path string) (string, Filter, error) {
+	attr, filter, sub, err := ParseValuePath(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if sub != "" {
+		return "", nil, fmt.Errorf("%w: unsupported path %s", ErrInvalidFilter, path)
+	}
+	return attr, filter, nil
+}
+
+// Like ParsePath, but also accepts a sub-attribute after the filter, as in
+// emails[type eq "work"].value, and returns it lowercase
+func ParseValuePath(path string) (string, Filter, string, error) {
+	path = strings.TrimSpace(path)
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		i := strings.LastIndex(path, ":")
+		path = path[i+1:]
+	}
+	attr, rest, found := strings.Cut(path, "[")
+	attr = strings.ToLower(attr)
+	if !found {
+		return attr, nil, "", nil
+	}
+	expr, sub, ok := strings.Cut(rest, "]")
+	if !ok || (sub != "" && (!strings.HasPrefix(sub, ".") || len(sub) == 1)) {
+		return "", nil, "", fmt.Errorf("%w: unsupported path %s", ErrInvalidFilter, path)
+	}
+	filter, err := ParseFilter(expr)
+	if err != nil {
+		return "", nil, "", err
+	}
+	return attr, filter, strings.ToLower(strings.TrimPrefix(sub, ".")), nil
+}
@@ -0,0 +1,181 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/a19simma/go-webauthn-htmx/internal"
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+)
+
+const (
+	// Cookie remembering the tenant selected by a path prefix, so the
+	// absolute links of the pages stay in the tenant
+	TenantCookie = "tenant"
+	// Path prefix selecting a tenant, e.g. /t/acme/login
+	TenantPathPrefix = "/t/"
+)
+
+// Relying party configuration of the default tenant, tenants build theirs
+// on top of it
+var rpConfig *webauthn.Config
+
+// Returns the relying party of the tenant of the user. Tenants are named
+// after themselves, use their own RP ID when they have one and accept
+// their subdomain and own origins.
+func relyingParty(username string) (*webauthn.WebAuthn, error) {
+	id := db.TenantOf(username)
+	if id == "" {
+		return webAuthn, nil
+	}
+	tenant, err := db.TenantDbImpl{}.GetTenant(id)
+	if err != nil {
+		return nil, err
+	}
+	config := *rpConfig
+	config.RPDisplayName = tenant.Name
+	if tenant.RPID != "" {
+		config.RPID = tenant.RPID
+	}
+	config.RPOrigins = append(append([]string{}, rpConfig.RPOrigins...), tenant.OriginList()...)
+	if origin := tenantOrigin(tenant.ID); origin != "" {
+		config.RPOrigins = append(config.RPOrigins, origin)
+	}
+	return webauthn.New(&config)
+}
+
+// Sends a notification to the user, whose username is their email
+// address, from the sender configured for their tenant
+func notifyUser(username string, subject string, content string) error {
+	sender := internal.DefaultSender
+	if id := db.TenantOf(username); id != "" {
+		tenant, err := db.TenantDbImpl{}.GetTenant(id)
+		if err != nil {
+			return err
+		}
+		sender = internal.Sender{
+			Name:         tenant.SenderName,
+			Email:        tenant.SenderEmail,
+			SMTPHost:     tenant.SMTPHost,
+			SMTPPort:     tenant.SMTPPort,
+			SMTPUsername: tenant.SMTPUsername,
+			SMTPPassword: tenant.SMTPPassword,
+		}
+		if len(sender.Name) == 0 {
+			sender.Name = tenant.Name
+		}
+	}
+	return internal.SendNotification(sender, db.LocalUsername(username), subject, content)
+}
+
+// Returns the origin of the subdomain of a tenant, with the scheme and
+// port of AUTH_ORIGIN
+func tenantOrigin(id string) string {
+	domain := viper.GetString("AUTH_TENANT_DOMAIN")
+	if domain == "" {
+		return ""
+	}
+	origin, err := url.Parse(viper.GetString("AUTH_ORIGIN"))
+	if err != nil || origin.Scheme == "" {
+		origin = &url.URL{Scheme: "http"}
+	}
+	host := id + "." + domain
+	if port := origin.Port(); port != "" {
+		host = net.JoinHostPort(host, port)
+	}
+	return origin.Scheme + "://" + host
+}
+
+// Reports whether the user may register without being added first, like
+// AUTH_ADMIN_EMAIL or the admin email of their tenant. They become admins.
+func isBootstrapAdmin(username string) bool {
+	id := db.TenantOf(username)
+	if id == "" {
+		return username == viper.GetString("AUTH_ADMIN_EMAIL")
+	}
+	tenant, err := db.TenantDbImpl{}.GetTenant(id)
+	if err != nil {
+		return false
+	}
+	return tenant.AdminEmail != "" && db.LocalUsername(username) == tenant.AdminEmail
+}
+
+// Returns the brand of a tenant, falling back to the default brand
+func tenantBrand(tenant db.Tenant) Brand {
+	brand := Brand{Name: tenant.Name, Logo: tenant.Logo, Theme: tenant.Theme}
+	if brand.Name == "" {
+		brand.Name = defaultBrand.Name
+	}
+	if brand.Theme == "" {
+		brand.Theme = defaultBrand.Theme
+	}
+	return brand
+}
+
+// Selects the tenant of the request from the subdomain of
+// AUTH_TENANT_DOMAIN, the /t/<tenant> path prefix, which is stripped, or
+// the tenant cookie a prefix set. Requests to unknown tenants get a 404 and
+// requests to suspended ones a 403.
+func NewTenantMiddleware(tenantDb db.TenantDb) fiber.Handler {
+	domain := strings.ToLower(viper.GetString("AUTH_TENANT_DOMAIN"))
+	return func(c *fiber.Ctx) error {
+		id, fromPath, fromCookie := "", false, false
+		host := c.Hostname()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if domain != "" && strings.HasSuffix(strings.ToLower(host), "."+domain) {
+			id = strings.TrimSuffix(strings.ToLower(host), "."+domain)
+		} else if strings.HasPrefix(c.Path(), TenantPathPrefix) {
+			// The path is only valid until it is rewritten
+			prefix, rest, _ := strings.Cut(strings.TrimPrefix(c.Path(), TenantPathPrefix), "/")
+			id, fromPath = strings.Clone(prefix), true
+			c.Path("/" + rest)
+		} else if id = c.Cookies(TenantCookie); id != "" {
+			fromCookie = true
+		}
+		if id == "" {
+			return c.Next()
+		}
+
+		tenant, err := tenantDb.GetTenant(id)
+		if err == nil && tenant.Status == db.TenantSuspended {
+			err = db.ErrTenantSuspended
+		}
+		if err != nil {
+			log.Info().Err(err).Str("tenant", id).Msg("request to unavailable tenant")
+			if fromCookie {
+				c.ClearCookie(TenantCookie)
+				if errors.Is(err, db.ErrNoResults) {
+					return c.Next()
+				}
+			}
+			switch {
+			case errors.Is(err, db.ErrNoResults):
+				return c.Status(404).SendString("unknown tenant")
+			case errors.Is(err, db.ErrTenantSuspended):
+				return c.Status(403).SendString(err.Error())
+			default:
+				return c.SendStatus(500)
+			}
+		}
+		if fromPath {
+			c.Cookie(&fiber.Cookie{
+				Name:     TenantCookie,
+				Value:    tenant.ID,
+				Path:     "/",
+				HTTPOnly: true,
+				SameSite: fiber.CookieSameSiteLaxMode,
+			})
+		}
+		c.Locals(db.TenantLocal, tenant.ID)
+		c.Locals(BrandLocal, tenantBrand(*tenant))
+		return c.Next()
+	}
+}
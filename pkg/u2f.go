@@ -0,0 +1,171 @@
+package pkg
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidU2FKey = errors.New("invalid U2F key")
+	ErrNoLegacyKeys  = errors.New("account has no legacy U2F keys")
+
+	// AppID legacy U2F credentials were registered with, AUTH_U2F_APPID
+	u2fAppID string
+)
+
+// A FIDO U2F key registered with a previous system, the key handle and the
+// uncompressed P-256 public key are base64url encoded
+type U2FKey struct {
+	Username  string `json:"username"`
+	KeyHandle string `json:"keyHandle"`
+	PublicKey string `json:"publicKey"`
+	Counter   uint32 `json:"counter"`
+}
+
+// Reports whether the credential is a legacy U2F key, which only logs in
+// with the appid extension
+func IsLegacyCredential(credential db.Credentials) bool {
+	return credential.AttestationType == protocol.CredentialTypeFIDOU2F
+}
+
+// Imports legacy U2F keys as credentials. Users that do not exist are
+// created as registered members and open users become registered, keys
+// that were already imported are skipped. Returns the number of imported
+// keys.
+func ImportU2FKeys(uDb db.UserDb, keys []U2FKey) (int, error) {
+	credentials := make([]db.Credentials, len(keys))
+	for i, key := range keys {
+		credential, err := parseU2FKey(key)
+		if err != nil {
+			return 0, fmt.Errorf("key %d of %s: %w", i, key.Username, err)
+		}
+		credentials[i] = credential
+	}
+
+	imported := 0
+	for _, credential := range credentials {
+		user, err := uDb.GetUser(credential.UserUsername)
+		if errors.Is(err, db.ErrNoResults) {
+			id := make([]byte, 32)
+			_, err = rand.Read(id)
+			if err != nil {
+				return imported, err
+			}
+			user = &db.User{ID: id, Username: credential.UserUsername, Role: db.Member, Status: db.Open}
+		}
+		if err != nil {
+			return imported, err
+		}
+		if user.Status == db.Open {
+			user.Status = db.Registered
+			err = uDb.CreateUser(*user)
+			if err != nil {
+				return imported, err
+			}
+		}
+		exists := false
+		for _, c := range user.Credentials {
+			exists = exists || string(c.ID) == string(credential.ID)
+		}
+		if exists {
+			continue
+		}
+		credential.UserID = user.ID
+		err = uDb.CreateCredentials(credential)
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	log.Info().Int("imported", imported).Int("keys", len(keys)).Msg("imported legacy U2F keys")
+	return imported, nil
+}
+
+func parseU2FKey(key U2FKey) (db.Credentials, error) {
+	if key.Username == "" {
+		return db.Credentials{}, fmt.Errorf("%w: missing username", ErrInvalidU2FKey)
+	}
+	id, err := base64.RawURLEncoding.DecodeString(key.KeyHandle)
+	if err != nil || len(id) == 0 {
+		return db.Credentials{}, fmt.Errorf("%w: invalid key handle", ErrInvalidU2FKey)
+	}
+	publicKey, err := base64.RawURLEncoding.DecodeString(key.PublicKey)
+	if err != nil {
+		return db.Credentials{}, fmt.Errorf("%w: invalid public key", ErrInvalidU2FKey)
+	}
+	// Assertions of U2F keys are verified against the raw key, not a COSE key
+	x, _ := elliptic.Unmarshal(elliptic.P256(), publicKey)
+	if x == nil {
+		return db.Credentials{}, fmt.Errorf("%w: public key is not an uncompressed P-256 point", ErrInvalidU2FKey)
+	}
+	credential := db.Credentials{
+		ID:              id,
+		PublicKey:       publicKey,
+		AttestationType: protocol.CredentialTypeFIDOU2F,
+		Transport:       "usb",
+		UserUsername:    key.Username,
+		CreatedAt:       time.Now(),
+		Name:            "Legacy U2F security key",
+	}
+	credential.Flags.UserPresent = true
+	credential.Authentication.SignCount = key.Counter
+	return credential, nil
+}
+
+// Starts the registration of a passkey replacing the legacy U2F keys of a
+// logged in user
+func (authImpl AuthImpl) BeginUpgrade(username string, host string) (*protocol.CredentialCreation, error) {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if !hasLegacyCredentials(*user) {
+		return nil, ErrNoLegacyKeys
+	}
+	return beginRegistration(user, host)
+}
+
+// Finishes the registration of the passkey and removes the legacy U2F keys
+// of the user. Returns the number of removed keys.
+func (authImpl AuthImpl) FinishUpgrade(resp protocol.ParsedCredentialCreationData, username string) (int, error) {
+	user, err := userDb.GetUser(username)
+	if err != nil {
+		return 0, err
+	}
+	if !hasLegacyCredentials(*user) {
+		return 0, ErrNoLegacyKeys
+	}
+	err = authImpl.FinishRegistration(resp, username)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, credential := range user.Credentials {
+		if !IsLegacyCredential(credential) {
+			continue
+		}
+		err = userDb.DeleteCredential(*user, credential.ID)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func hasLegacyCredentials(user db.User) bool {
+	for _, credential := range user.Credentials {
+		if IsLegacyCredential(credential) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,285 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/db"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	UserCreated     = "user.created"
+	UserRegistered  = "user.registered"
+	UserBlocked     = "user.blocked"
+	UserUnblocked   = "user.unblocked"
+	UserDeleted     = "user.deleted"
+	UserRoleChanged = "user.role_changed"
+
+	SignatureHeader = "Webhook-Signature"
+	IDHeader        = "Webhook-Id"
+	EventHeader     = "Webhook-Event"
+
+	// Receivers should reject signatures older than this to prevent replay
+	DefaultTolerance = time.Minute * 5
+
+	maxAttempts = 5
+)
+
+var (
+	Events = []string{UserCreated, UserRegistered, UserBlocked, UserUnblocked,
+		UserDeleted, UserRoleChanged}
+
+	ErrInvalidSignature = errors.New("invalid webhook signature")
+	ErrSignatureExpired = errors.New("webhook signature timestamp outside of tolerance")
+	ErrUnknownEvent     = errors.New("unknown webhook event")
+
+	webhookDb db.WebhookDb
+	client    = &http.Client{Timeout: time.Second * 10}
+)
+
+// The body posted to a webhook
+type Payload struct {
+	ID        uint      `json:"id"`
+	Event     string    `json:"event"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	User      User      `json:"user"`
+}
+
+type User struct {
+	Username string `json:"username"`
+	Status   string `json:"status,omitempty"`
+	Role     string `json:"role,omitempty"`
+}
+
+func Init(wDb db.WebhookDb) {
+	webhookDb = wDb
+}
+
+func NewUser(user db.User) User {
+	return User{
+		Username: user.Username,
+		Status:   user.Status.String(),
+		Role:     user.Role.String(),
+	}
+}
+
+// Registers a webhook, a secret is generated when none is given
+func Create(url string, secret string, events []string, createdBy string) (*db.Webhook, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, errors.New("webhook url must use http or https")
+	}
+	for _, event := range events {
+		if !isEvent(event) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownEvent, event)
+		}
+	}
+	if len(secret) == 0 {
+		b := make([]byte, 32)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		secret = "whsec_" + hex.EncodeToString(b)
+	}
+	webhook := &db.Webhook{
+		URL:       url,
+		Secret:    secret,
+		Events:    strings.Join(events, ","),
+		CreatedBy: createdBy,
+	}
+	return webhook, webhookDb.CreateWebhook(webhook)
+}
+
+// Queues a delivery of the event to every webhook subscribed to it, the
+// deliveries are sent in the background
+func Emit(event string, actor string, user User) {
+	if webhookDb == nil {
+		return
+	}
+	for _, webhook := range webhookDb.GetWebhooks() {
+		if !webhook.Subscribes(event) {
+			continue
+		}
+		delivery := &db.WebhookDelivery{WebhookID: webhook.ID, Event: event}
+		err := webhookDb.CreateDelivery(delivery)
+		if err != nil {
+			log.Err(err).Uint("webhook", webhook.ID).Msg("failed to create webhook delivery")
+			continue
+		}
+		payload, err := json.Marshal(Payload{
+			ID:        delivery.ID,
+			Event:     event,
+			Timestamp: delivery.CreatedAt.UTC(),
+			Actor:     actor,
+			User:      user,
+		})
+		if err != nil {
+			log.Err(err).Msg("failed to marshal webhook payload")
+			continue
+		}
+		delivery.Payload = string(payload)
+		err = webhookDb.SaveDelivery(*delivery)
+		if err != nil {
+			log.Err(err).Uint("delivery", delivery.ID).Msg("failed to save webhook delivery")
+			continue
+		}
+		go deliver(webhook, *delivery, maxAttempts)
+	}
+}
+
+// Sends the delivery again once, regardless of its previous outcome
+func Redeliver(id uint) (*db.WebhookDelivery, error) {
+	delivery, err := webhookDb.GetDelivery(id)
+	if err != nil {
+		return nil, err
+	}
+	webhook, err := webhookDb.GetWebhook(delivery.WebhookID)
+	if err != nil {
+		return nil, err
+	}
+	result := send(*webhook, *delivery)
+	return &result, nil
+}
+
+// Sends the delivery, retrying with exponential backoff until it succeeds
+// or attempts are exhausted
+func deliver(webhook db.Webhook, delivery db.WebhookDelivery, attempts int) {
+	delay := time.Second
+	for i := 0; i < attempts; i++ {
+		delivery = send(webhook, delivery)
+		if delivery.DeliveredAt != nil {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+	log.Warn().Uint("webhook", webhook.ID).Uint("delivery", delivery.ID).
+		Msg("giving up on webhook delivery")
+}
+
+// Makes one delivery attempt and stores its outcome
+func send(webhook db.Webhook, delivery db.WebhookDelivery) db.WebhookDelivery {
+	delivery.Attempts++
+	delivery.StatusCode = 0
+	delivery.Error = ""
+	delivery.DeliveredAt = nil
+
+	status, err := post(webhook, delivery)
+	delivery.StatusCode = status
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		now := time.Now()
+		delivery.DeliveredAt = &now
+	}
+
+	err = webhookDb.SaveDelivery(delivery)
+	if err != nil {
+		log.Err(err).Uint("delivery", delivery.ID).Msg("failed to save webhook delivery")
+	}
+	return delivery
+}
+
+// Posts the payload of the delivery and returns the response status
+func post(webhook db.Webhook, delivery db.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(IDHeader, strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(SignatureHeader, Sign([]byte(webhook.Secret), time.Now(), body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Returns the signature header value t=<unix time>,v1=<hex hmac>, where the
+// HMAC-SHA256 covers "<unix time>.<body>"
+func Sign(secret []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+// Verifies the signature header of a delivery, rejecting signatures whose
+// timestamp differs from now by more than tolerance
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			sig, err := hex.DecodeString(value)
+			if err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrInvalidSignature
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrSignatureExpired
+	}
+	expected := mac(secret, timestamp, body)
+	for _, sig := range signatures {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+func isEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func Webhooks() []db.Webhook {
+	return webhookDb.GetWebhooks()
+}
+
+func Delete(id uint) error {
+	return webhookDb.DeleteWebhook(id)
+}
+
+func Deliveries(webhookID uint) []db.WebhookDelivery {
+	return webhookDb.GetDeliveries(webhookID, 50)
+}
@@ -0,0 +1,146 @@
+// Package webhookstest provides a local webhook receiver that verifies
+// signatures, for use in integration tests and manual testing
+package webhookstest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/a19simma/go-webauthn-htmx/pkg/webhooks"
+)
+
+// A delivery accepted by the receiver
+type Delivery struct {
+	ID      string
+	Event   string
+	Payload webhooks.Payload
+	Body    []byte
+}
+
+// Accepts deliveries with a valid signature and records them. Replayed
+// deliveries, with an id that was already accepted, are acknowledged but
+// not recorded again.
+type Receiver struct {
+	secret []byte
+	// Respond with this status instead of accepting deliveries, useful to
+	// test retries. Use SetFailWith once the receiver is running.
+	FailWith int
+	// Called with every accepted delivery
+	OnDelivery func(Delivery)
+
+	mu         sync.Mutex
+	deliveries []Delivery
+	rejected   int
+	seen       map[string]bool
+	notify     chan struct{}
+}
+
+func NewReceiver(secret string) *Receiver {
+	return &Receiver{
+		secret: []byte(secret),
+		seen:   map[string]bool{},
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Starts the receiver on a random local port and returns the server, its
+// URL is the webhook url
+func (r *Receiver) Start() *httptest.Server {
+	return httptest.NewServer(r)
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	err = webhooks.Verify(r.secret, req.Header.Get(webhooks.SignatureHeader), body,
+		webhooks.DefaultTolerance)
+	if err != nil {
+		r.mu.Lock()
+		r.rejected++
+		r.mu.Unlock()
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	delivery := Delivery{
+		ID:    req.Header.Get(webhooks.IDHeader),
+		Event: req.Header.Get(webhooks.EventHeader),
+		Body:  body,
+	}
+	err = json.Unmarshal(body, &delivery.Payload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mu.Lock()
+	if r.FailWith != 0 {
+		r.mu.Unlock()
+		w.WriteHeader(r.FailWith)
+		return
+	}
+	replayed := r.seen[delivery.ID]
+	if !replayed {
+		r.seen[delivery.ID] = true
+		r.deliveries = append(r.deliveries, delivery)
+	}
+	r.mu.Unlock()
+	if replayed {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+	if r.OnDelivery != nil {
+		r.OnDelivery(delivery)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Makes deliveries fail with the status, 0 accepts deliveries again
+func (r *Receiver) SetFailWith(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.FailWith = status
+}
+
+// Returns the accepted deliveries in the order they arrived
+func (r *Receiver) Deliveries() []Delivery {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Delivery{}, r.deliveries...)
+}
+
+// Returns the number of deliveries rejected for an invalid signature
+func (r *Receiver) Rejected() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rejected
+}
+
+// Waits until n deliveries have been accepted or the timeout passes and
+// returns the accepted deliveries
+func (r *Receiver) Wait(n int, timeout time.Duration) []Delivery {
+	deadline := time.After(timeout)
+	for {
+		deliveries := r.Deliveries()
+		if len(deliveries) >= n {
+			return deliveries
+		}
+		select {
+		case <-r.notify:
+		case <-deadline:
+			return deliveries
+		}
+	}
+}
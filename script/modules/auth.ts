@@ -8,27 +8,129 @@ import {
 } from "@simplewebauthn/typescript-types";
 
 export {};
+declare const htmx: any;
 declare global {
   interface Window {
     registerClick: Function;
     loginClick: Function;
+    recoverClick: Function;
+    upgradeClick: Function;
+    readLargeBlob: Function;
+    writeLargeBlob: Function;
   }
 }
-/** This function begins the registration process
- *  @param {string} usernameEl - username of user to register
- *  @param {string} statusEl - status element
+/** Returns the CSRF token of the page, it has to be sent in the
+ *  X-CSRF-Token header of every state changing request */
+function csrfToken(): string {
+  const meta = document.querySelector<HTMLMetaElement>('meta[name="csrf-token"]');
+  return meta ? meta.content : "";
+}
+
+/** Key the PRF output of the last login is kept under in sessionStorage */
+const prfStorageKey = "webauthn-prf";
+
+function base64URLToBuffer(value: string): ArrayBuffer {
+  const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(base64.padEnd(Math.ceil(base64.length / 4) * 4, "="));
+  return Uint8Array.from(binary, (c) => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64URL(buffer: ArrayBuffer): string {
+  const binary = String.fromCharCode(...new Uint8Array(buffer));
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=/g, "");
+}
+
+/** Runs an authentication ceremony with the extensions the server asked
+ *  for. Their binary outputs stay in the browser, the PRF output is kept in
+ *  sessionStorage and dispatched as a webauthnPRF event for application
+ *  level encryption, the server only learns what the authenticator did.
+ *  @param {any} publicKey - request options returned by the server
+ *  @param {BufferSource} blob - data to write when a large blob write was requested
+ *  @returns the response for the server and the large blob that was read
  */
-async function register(usernameEl: string, statusEl: string, btnId: string) {
-  const usernameInput = document.getElementById(usernameEl) as HTMLInputElement;
-  const statusLabel = document.getElementById(statusEl) as HTMLElement;
-  const btn = document.getElementById(btnId) as HTMLButtonElement;
-  const resp = await fetch(`/auth/register/begin/${usernameInput.value}`);
+async function authenticate(
+  publicKey: any,
+  blob?: BufferSource,
+): Promise<{ response: AuthenticationResponseJSON; blob: ArrayBuffer | null }> {
+  const extensions = publicKey.extensions || {};
+  if (extensions.prf && extensions.prf.eval) {
+    extensions.prf.eval.first = base64URLToBuffer(extensions.prf.eval.first);
+  }
+  if (extensions.largeBlob && "write" in extensions.largeBlob) {
+    extensions.largeBlob.write = blob;
+  }
+  const response = await startAuthentication(publicKey);
+  const results = response.clientExtensionResults as any;
+  let read: ArrayBuffer | null = null;
+  if (results.prf) {
+    if (results.prf.results) {
+      const output = results.prf.results.first as ArrayBuffer;
+      sessionStorage.setItem(prfStorageKey, bufferToBase64URL(output));
+      document.dispatchEvent(new CustomEvent("webauthnPRF", { detail: output }));
+    }
+    results.prf = { enabled: !!results.prf.results };
+  }
+  if (results.largeBlob) {
+    read = results.largeBlob.blob || null;
+    results.largeBlob = { written: !!results.largeBlob.written };
+  }
+  return { response, blob: read };
+}
+
+/** Runs a login ceremony for the logged in user that reads or writes the
+ *  large blob of the credential
+ *  @param {string} op - read or write
+ *  @param {BufferSource} data - data to write
+ */
+async function largeBlob(op: string, data?: BufferSource) {
+  const status = await fetch("/auth/status");
+  const username = await status.text();
+  if (!status.ok || username.length === 0) {
+    throw new Error("not logged in");
+  }
+  const resp = await fetch(
+    `/auth/generate-authentication-options/${username}?largeBlob=${op}`,
+  );
   if (!resp.ok) {
-    clearClasslist([usernameInput, statusLabel]);
-    usernameInput.classList.add("input-error");
-    statusLabel.classList.add("text-error");
-    statusLabel.innerHTML = await resp.text();
-    return;
+    throw new Error(await resp.text());
+  }
+  const options = (await resp.json()) as any;
+  const { response, blob } = await authenticate(options.publicKey, data);
+  const result = await fetch(`/auth/verify-authentication/${username}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: JSON.stringify(response),
+  });
+  if (!result.ok) {
+    throw new Error(await result.text());
+  }
+  const results = response.clientExtensionResults as any;
+  return { blob, written: !!results.largeBlob && results.largeBlob.written };
+}
+
+/** Reads the large blob stored on the authenticator of the logged in user
+ *  @returns the blob, null when the authenticator has none
+ */
+window.readLargeBlob = async () => (await largeBlob("read")).blob;
+
+/** Stores data in the large blob of the authenticator of the logged in user
+ *  @param {BufferSource} data - data to store
+ *  @returns whether the authenticator stored it
+ */
+window.writeLargeBlob = async (data: BufferSource) =>
+  (await largeBlob("write", data)).written;
+
+/** Runs the registration ceremony for the user and returns the response
+ *  of the request that failed or the final verification request
+ *  @param {string} username - username of user to register
+ */
+async function registerCredential(username: string): Promise<Response> {
+  const resp = await fetch(`/auth/register/begin/${username}`);
+  if (!resp.ok) {
+    return resp;
   }
   const registrationOptions = (await resp.json()).publicKey;
   let attResp;
@@ -46,16 +148,25 @@ async function register(usernameEl: string, statusEl: string, btnId: string) {
     }
     throw error;
   }
-  const result = await fetch(
-    `/auth/verify-registration/${usernameInput.value}`,
-    {
-      method: "POST",
-      headers: {
-        "Content-Type": "application/json",
-      },
-      body: JSON.stringify(attResp),
+  return fetch(`/auth/verify-registration/${username}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
     },
-  );
+    body: JSON.stringify(attResp),
+  });
+}
+
+/** This function begins the registration process
+ *  @param {string} usernameEl - username of user to register
+ *  @param {string} statusEl - status element
+ */
+async function register(usernameEl: string, statusEl: string, btnId: string) {
+  const usernameInput = document.getElementById(usernameEl) as HTMLInputElement;
+  const statusLabel = document.getElementById(statusEl) as HTMLElement;
+  const btn = document.getElementById(btnId) as HTMLButtonElement;
+  const result = await registerCredential(usernameInput.value);
   if (!result.ok) {
     clearClasslist([usernameInput, statusLabel]);
     usernameInput.classList.add("input-error");
@@ -66,6 +177,7 @@ async function register(usernameEl: string, statusEl: string, btnId: string) {
     usernameInput.classList.add("input-success");
     statusLabel.classList.add("text-success");
     statusLabel.innerHTML = "Success! You can now login.";
+    showRecoveryCodes(statusLabel, (await result.json()).recoveryCodes);
   }
 }
 window.registerClick = register;
@@ -74,6 +186,10 @@ async function login(usernameEl: string, statusEl: string, btnId: string) {
   const usernameInput = document.getElementById(usernameEl) as HTMLInputElement;
   const statusLabel = document.getElementById(statusEl) as HTMLElement;
   const btn = document.getElementById(btnId) as HTMLButtonElement;
+  const rememberInput = document.getElementById(
+    "rememberInput",
+  ) as HTMLInputElement | null;
+  const remember = rememberInput !== null && rememberInput.checked;
   const fetchLoginOptions = async (username: string) =>
     fetch(`/auth/generate-authentication-options/${username}`);
 
@@ -81,10 +197,11 @@ async function login(usernameEl: string, statusEl: string, btnId: string) {
     attResp: AuthenticationResponseJSON,
     username: string,
   ) =>
-    fetch(`/auth/verify-authentication/${username}`, {
+    fetch(`/auth/verify-authentication/${username}?remember=${remember}`, {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
+        "X-CSRF-Token": csrfToken(),
       },
       body: JSON.stringify(attResp),
     });
@@ -97,7 +214,19 @@ async function login(usernameEl: string, statusEl: string, btnId: string) {
     return;
   }
   const options = (await resp.json()) as any;
-  let loginResp = await startAuthentication(options.publicKey);
+  let loginResp: AuthenticationResponseJSON;
+  try {
+    loginResp = (await authenticate(options.publicKey)).response;
+  } catch (error: any) {
+    // Unknown usernames get credentials no authenticator has, so this is
+    // reported like any other failed login
+    console.log(error);
+    clearClasslist([usernameInput, statusLabel]);
+    usernameInput.classList.add("input-error");
+    statusLabel.classList.add("text-error");
+    statusLabel.innerHTML = "Authentication failed";
+    return;
+  }
   let result = await verifyLogin(loginResp, usernameInput.value);
   if (!result.ok) {
     clearClasslist([usernameInput, statusLabel]);
@@ -111,10 +240,186 @@ async function login(usernameEl: string, statusEl: string, btnId: string) {
     statusLabel.classList.add("text-success");
     statusLabel.innerHTML = "Success! Redirecting...";
   }
+  // Logins with legacy U2F keys are sent on to replace the key
+  if (result.headers.get("Content-Type")?.startsWith("application/json")) {
+    window.location.href = (await result.json()).upgrade;
+    return;
+  }
   btn.dispatchEvent(new Event("refreshModal"));
 }
 window.loginClick = login;
 
+/** Registers a passkey replacing the legacy U2F keys of the logged in user
+ *  @param {string} statusEl - status element
+ */
+async function upgrade(statusEl: string, btnId: string) {
+  const statusLabel = document.getElementById(statusEl) as HTMLElement;
+  const btn = document.getElementById(btnId) as HTMLButtonElement;
+  const resp = await fetch("/api/account/upgrade/begin");
+  if (!resp.ok) {
+    statusLabel.innerHTML = await resp.text();
+    return;
+  }
+  let attResp;
+  try {
+    attResp = await startRegistration((await resp.json()).publicKey);
+  } catch (error: any) {
+    console.log(error);
+    statusLabel.innerHTML = "Registration was cancelled";
+    return;
+  }
+  const result = await fetch("/api/account/upgrade/finish", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: JSON.stringify(attResp),
+  });
+  if (!result.ok) {
+    statusLabel.innerHTML = await result.text();
+    return;
+  }
+  btn.disabled = true;
+  window.location.reload();
+}
+window.upgradeClick = upgrade;
+
+/** Re-authenticates the logged in user when the server requires a recent
+ *  assertion for a sensitive operation and then retries the original request
+ *  @param {Event} evt - stepUpRequired event triggered by the server
+ */
+async function stepUp(evt: Event) {
+  const detail = (evt as CustomEvent).detail;
+  const status = await fetch("/auth/status");
+  const username = await status.text();
+  if (!status.ok || username.length === 0) {
+    window.location.href = "/login";
+    return;
+  }
+  const resp = await fetch(`/auth/generate-authentication-options/${username}`);
+  if (!resp.ok) {
+    console.log(await resp.text());
+    return;
+  }
+  const options = (await resp.json()) as any;
+  const loginResp = (await authenticate(options.publicKey)).response;
+  const result = await fetch(`/auth/verify-authentication/${username}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: JSON.stringify(loginResp),
+  });
+  if (!result.ok) {
+    console.log(await result.text());
+    return;
+  }
+  htmx.ajax(detail.method, detail.path, { source: evt.target });
+}
+document.addEventListener("stepUpRequired", stepUp);
+
+/** Signs the operation described by the server with the passkey of the
+ *  logged in user and retries the original request with the confirmation
+ *  @param {Event} evt - confirmationRequired event triggered by the server
+ */
+async function confirmOperation(evt: Event) {
+  const detail = (evt as CustomEvent).detail;
+  const resp = await fetch("/api/confirmations", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/x-www-form-urlencoded",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: new URLSearchParams({
+      action: detail.action,
+      target: detail.target,
+      details: detail.details,
+    }),
+  });
+  if (!resp.ok) {
+    console.log(await resp.text());
+    return;
+  }
+  const confirmation = (await resp.json()) as any;
+  const assertion = await startAuthentication(confirmation.publicKey);
+  const result = await fetch(`/api/confirmations/${confirmation.id}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: JSON.stringify(assertion),
+  });
+  if (!result.ok) {
+    console.log(await result.text());
+    return;
+  }
+  htmx.ajax(detail.method, detail.path, {
+    source: evt.target,
+    headers: { "X-Confirmation": confirmation.id },
+  });
+}
+document.addEventListener("confirmationRequired", confirmOperation);
+
+/** Redeems a recovery code and registers a new passkey for the account
+ *  @param {string} usernameEl - username of the account to recover
+ *  @param {string} codeEl - recovery code element
+ *  @param {string} statusEl - status element
+ */
+async function recover(
+  usernameEl: string,
+  codeEl: string,
+  statusEl: string,
+  btnId: string,
+) {
+  const usernameInput = document.getElementById(usernameEl) as HTMLInputElement;
+  const codeInput = document.getElementById(codeEl) as HTMLInputElement;
+  const statusLabel = document.getElementById(statusEl) as HTMLElement;
+  const btn = document.getElementById(btnId) as HTMLButtonElement;
+  const resp = await fetch(`/auth/recover/${usernameInput.value}`, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/x-www-form-urlencoded",
+      "X-CSRF-Token": csrfToken(),
+    },
+    body: new URLSearchParams({ code: codeInput.value }),
+  });
+  if (!resp.ok) {
+    clearClasslist([usernameInput, codeInput, statusLabel]);
+    codeInput.classList.add("input-error");
+    statusLabel.classList.add("text-error");
+    statusLabel.innerHTML = await resp.text();
+    return;
+  }
+  const result = await registerCredential(usernameInput.value);
+  if (!result.ok) {
+    clearClasslist([usernameInput, codeInput, statusLabel]);
+    statusLabel.classList.add("text-error");
+    statusLabel.innerHTML = await result.text();
+    return;
+  }
+  clearClasslist([usernameInput, codeInput, statusLabel]);
+  codeInput.classList.add("input-success");
+  statusLabel.classList.add("text-success");
+  statusLabel.innerHTML =
+    'Success! A new passkey has been registered. <a class="link" href="/">Continue</a>';
+  btn.disabled = true;
+  showRecoveryCodes(statusLabel, (await result.json()).recoveryCodes);
+}
+window.recoverClick = recover;
+
+function showRecoveryCodes(statusLabel: HTMLElement, codes: string[] | null) {
+  if (!codes || codes.length === 0) {
+    return;
+  }
+  const list = codes.map((code) => `<li>${code}</li>`).join("");
+  statusLabel.innerHTML +=
+    "<br/>Save these recovery codes somewhere safe, they will not be shown again:" +
+    `<ul class="font-mono">${list}</ul>`;
+}
+
 function clearClasslist(elements: HTMLElement[]) {
   elements.forEach(
     (x) =>